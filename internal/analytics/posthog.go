@@ -4,6 +4,8 @@ import (
 	"os"
 	"runtime"
 
+	"cli-gpt-flows/internal/llm"
+
 	"github.com/posthog/posthog-go"
 )
 
@@ -51,7 +53,9 @@ func (c *Client) Close() {
 	_ = c.ph.Close()
 }
 
-func (c *Client) StepCompleted(workflowName, stepID, stepType string, durationMs int64) {
+// StepCompleted reports a finished step. usage and costUSD are zero for steps
+// that made no model calls; cacheHits counts calls answered from the response cache.
+func (c *Client) StepCompleted(workflowName, stepID, stepType string, durationMs int64, usage llm.Usage, costUSD float64, cacheHits int) {
 	if c == nil || c.ph == nil {
 		return
 	}
@@ -61,6 +65,11 @@ func (c *Client) StepCompleted(workflowName, stepID, stepType string, durationMs
 		Set("step_id", stepID).
 		Set("step_type", stepType).
 		Set("duration_ms", durationMs).
+		Set("prompt_tokens", usage.PromptTokens).
+		Set("candidate_tokens", usage.CandidateTokens).
+		Set("total_tokens", usage.TotalTokens).
+		Set("cost_usd", costUSD).
+		Set("cache_hits", cacheHits).
 		Set("user_machine", c.userMachine)
 
 	c.ph.Enqueue(posthog.Capture{
@@ -70,6 +79,26 @@ func (c *Client) StepCompleted(workflowName, stepID, stepType string, durationMs
 	})
 }
 
+func (c *Client) ToolCalled(workflowName, stepID, tool string, durationMs int64, ok bool) {
+	if c == nil || c.ph == nil {
+		return
+	}
+
+	props := posthog.NewProperties().
+		Set("workflow_name", workflowName).
+		Set("step_id", stepID).
+		Set("tool", tool).
+		Set("ok", ok).
+		Set("duration_ms", durationMs).
+		Set("user_machine", c.userMachine)
+
+	c.ph.Enqueue(posthog.Capture{
+		DistinctId: c.distinctID,
+		Event:      "tool_called",
+		Properties: props,
+	})
+}
+
 func (c *Client) WorkflowRun(recipeName string, source string, stepsCount int, durationMs int64) {
 	if c == nil || c.ph == nil {
 		return
@@ -0,0 +1,132 @@
+// Package cache stores model responses on disk, keyed by everything that
+// influences the answer, so re-running a recipe during development doesn't
+// pay for identical calls again.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"cli-gpt-flows/internal/llm"
+)
+
+// Store is a directory of cached responses, one JSON file per key.
+type Store struct {
+	dir string
+}
+
+// DefaultDir is <user cache dir>/pals-gemflows/responses, next to the
+// fetcher's recipe cache.
+func DefaultDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil || dir == "" {
+		// Fallback to current directory if we can't find a cache dir.
+		dir = "."
+	}
+	return filepath.Join(dir, "pals-gemflows", "responses")
+}
+
+// New returns a store rooted at dir, or at DefaultDir when dir is empty.
+func New(dir string) *Store {
+	if dir == "" {
+		dir = DefaultDir()
+	}
+	return &Store{dir: dir}
+}
+
+type attachmentKey struct {
+	Name     string
+	MIMEType string
+	SHA256   string
+}
+
+// Key hashes the provider and every request field that changes the response.
+// endpoint names the server for providers that can point anywhere (the
+// OpenAI-compatible base URL), so two servers serving the same model name
+// don't share answers; it is empty for Gemini.
+func Key(provider, endpoint string, req llm.Request) string {
+	attachments := make([]attachmentKey, 0, len(req.Attachments))
+	for _, a := range req.Attachments {
+		h := sha256.Sum256(a.Data)
+		attachments = append(attachments, attachmentKey{Name: a.Name, MIMEType: a.MIMEType, SHA256: hex.EncodeToString(h[:])})
+	}
+	// encoding/json sorts map keys, so equal requests hash equally.
+	b, _ := json.Marshal(struct {
+		Provider       string
+		Endpoint       string
+		Model          string
+		SystemPrompt   string
+		UserPrompt     string
+		Generation     llm.GenerationConfig
+		ResponseFormat string
+		ResponseSchema map[string]any
+		Safety         map[string]string
+		History        []llm.Message
+		Tools          []llm.Tool
+		Attachments    []attachmentKey
+	}{
+		provider, endpoint, req.Model, req.SystemPrompt, req.UserPrompt, req.Generation, req.ResponseFormat,
+		req.ResponseSchema, req.Safety, req.History, req.Tools, attachments,
+	})
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// Get returns the response stored under key if it is younger than ttl
+// (ttl <= 0 means no expiry).
+func (s *Store) Get(key string, ttl time.Duration) (llm.Response, bool) {
+	path := s.path(key)
+	st, err := os.Stat(path)
+	if err != nil {
+		return llm.Response{}, false
+	}
+	if ttl > 0 && time.Since(st.ModTime()) > ttl {
+		return llm.Response{}, false
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return llm.Response{}, false
+	}
+	var resp llm.Response
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return llm.Response{}, false
+	}
+	return resp, true
+}
+
+// Put stores resp under key. Entries hold full prompts and responses, so the
+// directory and files are private to the user.
+func (s *Store) Put(key string, resp llm.Response) error {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	// Tighten directories created by earlier versions.
+	if err := os.Chmod(s.dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, "."+key+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path(key))
+}
+
+func (s *Store) path(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
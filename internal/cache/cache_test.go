@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"cli-gpt-flows/internal/llm"
+)
+
+func TestStore_GetPutAndTTL(t *testing.T) {
+	s := New(t.TempDir())
+	req := llm.Request{Model: "gemini-2.5-flash", UserPrompt: "hi"}
+	key := Key("gemini", "", req)
+
+	if _, ok := s.Get(key, time.Hour); ok {
+		t.Fatalf("expected a miss on an empty cache")
+	}
+	if err := s.Put(key, llm.Response{Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	resp, ok := s.Get(key, time.Hour)
+	if !ok || resp.Text != "hello" {
+		t.Fatalf("expected a hit, got %+v %v", resp, ok)
+	}
+	if runtime.GOOS != "windows" {
+		for path, want := range map[string]os.FileMode{s.dir: 0o700, s.path(key): 0o600} {
+			if st, err := os.Stat(path); err != nil || st.Mode().Perm() != want {
+				t.Fatalf("%s: expected mode %v, got %v (%v)", path, want, st.Mode().Perm(), err)
+			}
+		}
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(s.path(key), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get(key, time.Hour); ok {
+		t.Fatalf("expected an expired entry to miss")
+	}
+}
+
+func TestKey_DependsOnRequest(t *testing.T) {
+	base := llm.Request{Model: "m", UserPrompt: "hi"}
+	other := base
+	other.UserPrompt = "hello"
+
+	if Key("gemini", "", base) != Key("gemini", "", base) {
+		t.Fatalf("expected equal requests to share a key")
+	}
+	if Key("gemini", "", base) == Key("gemini", "", other) {
+		t.Fatalf("expected a different prompt to change the key")
+	}
+	if Key("gemini", "", base) == Key("openai", "", base) {
+		t.Fatalf("expected a different provider to change the key")
+	}
+	if Key("openai", "http://localhost:11434/v1", base) == Key("openai", "http://gpu-box:8000/v1", base) {
+		t.Fatalf("expected a different server to change the key")
+	}
+}
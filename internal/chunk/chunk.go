@@ -0,0 +1,75 @@
+// Package chunk splits long texts into overlapping pieces that each fit a
+// model's context window.
+package chunk
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CharsPerToken is the rough ratio used to turn token budgets into text
+// lengths. It is deliberately conservative for English prose.
+const CharsPerToken = 4
+
+// EstimateTokens guesses the token count of text without calling a model.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + CharsPerToken - 1) / CharsPerToken
+}
+
+// Split cuts text into chunks of about chunkTokens tokens, each starting
+// overlapTokens before the end of the previous one. Cuts prefer a paragraph
+// break, then a line break, then a space, in the last quarter of a chunk so
+// sentences aren't split mid-word when that can be avoided.
+func Split(text string, chunkTokens, overlapTokens int) []string {
+	if chunkTokens <= 0 {
+		return []string{text}
+	}
+	if overlapTokens < 0 || overlapTokens >= chunkTokens {
+		overlapTokens = 0
+	}
+	runes := []rune(text)
+	size := chunkTokens * CharsPerToken
+	overlap := overlapTokens * CharsPerToken
+	if len(runes) <= size {
+		return []string{text}
+	}
+
+	var out []string
+	start := 0
+	for start < len(runes) {
+		end := start + size
+		if end >= len(runes) {
+			out = append(out, string(runes[start:]))
+			break
+		}
+		end = cutPoint(runes, start+size*3/4, end)
+		out = append(out, string(runes[start:end]))
+
+		next := end
+		if overlap > 0 {
+			// Start the overlap on a word boundary too. A chunk cut early can
+			// be shorter than the overlap, so never go back past its start.
+			next = max(end-overlap, start+1)
+			for next < end && !unicode.IsSpace(runes[next-1]) {
+				next++
+			}
+		}
+		if next <= start {
+			next = end
+		}
+		start = next
+	}
+	return out
+}
+
+// cutPoint returns the best place to end a chunk in runes[min:max].
+func cutPoint(runes []rune, min, max int) int {
+	window := string(runes[min:max])
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		if i := strings.LastIndex(window, sep); i >= 0 {
+			return min + utf8.RuneCountInString(window[:i]) + utf8.RuneCountInString(sep)
+		}
+	}
+	return max
+}
@@ -0,0 +1,67 @@
+package chunk
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplit_ShortTextIsOneChunk(t *testing.T) {
+	got := Split("hello world", 100, 10)
+	if len(got) != 1 || got[0] != "hello world" {
+		t.Fatalf("unexpected chunks %q", got)
+	}
+}
+
+func TestSplit_CoversTextWithOverlap(t *testing.T) {
+	words := make([]string, 200)
+	for i := range words {
+		words[i] = "word"
+	}
+	text := strings.Join(words, " ")
+
+	// 10 tokens ~ 40 characters per chunk, 2 tokens ~ 8 characters of overlap.
+	chunks := Split(text, 10, 2)
+	if len(chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+	for i, c := range chunks {
+		if len(c) > 10*CharsPerToken {
+			t.Fatalf("chunk %d is %d characters, over the budget", i, len(c))
+		}
+		if i > 0 && !strings.HasPrefix(c, "word") {
+			t.Fatalf("chunk %d starts mid-word: %q", i, c)
+		}
+	}
+	if !strings.HasSuffix(chunks[len(chunks)-1], "word") {
+		t.Fatalf("last chunk does not reach the end of the text")
+	}
+}
+
+func TestSplit_LargeOverlaps(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		text           string
+		chunk, overlap int
+	}{
+		{"early cut", strings.Repeat("a", 31) + " " + strings.Repeat("b", 59), 10, 9},
+		{"overlap just under chunk", strings.Repeat("word ", 100), 10, 9},
+		{"no spaces", strings.Repeat("x", 200), 10, 9},
+		{"half", strings.Repeat("word ", 100), 10, 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks := Split(tc.text, tc.chunk, tc.overlap)
+			if len(chunks) < 2 {
+				t.Fatalf("expected several chunks, got %d", len(chunks))
+			}
+			last := chunks[len(chunks)-1]
+			if !strings.HasSuffix(tc.text, last) {
+				t.Fatalf("last chunk %q does not reach the end of the text", last)
+			}
+			for i, c := range chunks {
+				if c == "" || len(c) > tc.chunk*CharsPerToken {
+					t.Fatalf("chunk %d has %d characters", i, len(c))
+				}
+			}
+		})
+	}
+}
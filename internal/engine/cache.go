@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cli-gpt-flows/internal/cache"
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/workflow"
+)
+
+// cacheTTL is how long responses are reused for a workflow, or 0 when the
+// workflow hasn't opted in or caching is disabled for this engine. Recording
+// and replaying bypass the cache so every call ends up in the fixture.
+func (e *Engine) cacheTTL(wf workflow.Workflow) time.Duration {
+	if e.deps.NoCache || e.deps.Record != nil || e.deps.Replay != nil || wf.CacheTTL == "" {
+		return 0
+	}
+	// Validated when the workflow was loaded.
+	ttl, _ := time.ParseDuration(wf.CacheTTL)
+	return ttl
+}
+
+// cached wraps a provider so identical requests within the workflow's TTL
+// are answered from disk. Hits are logged and recorded on the ledger (at no
+// cost); misses are stored after a successful call.
+func (e *Engine) cached(rs *runState, step workflow.Step, p llm.Provider) llm.Provider {
+	ttl := e.cacheTTL(rs.wf)
+	if ttl <= 0 {
+		return p
+	}
+	provider := step.Provider
+	if provider == "" {
+		provider = workflow.ProviderGemini
+	}
+	var endpoint string
+	if provider == workflow.ProviderOpenAI && e.deps.OpenAI != nil {
+		endpoint = e.deps.OpenAI.BaseURL()
+	}
+	c := &cachedProvider{e: e, rs: rs, stepID: step.ID, provider: provider, endpoint: endpoint, ttl: ttl, p: p}
+	if sp, ok := p.(llm.StreamProvider); ok {
+		return &cachedStreamProvider{cachedProvider: c, sp: sp}
+	}
+	return c
+}
+
+type cachedProvider struct {
+	e        *Engine
+	rs       *runState
+	stepID   string
+	provider string
+	endpoint string
+	ttl      time.Duration
+	p        llm.Provider
+}
+
+func (c *cachedProvider) store() *cache.Store {
+	if c.e.deps.Cache != nil {
+		return c.e.deps.Cache
+	}
+	return cache.New("")
+}
+
+func (c *cachedProvider) lookup(req llm.Request) (string, llm.Response, bool) {
+	key := cache.Key(c.provider, c.endpoint, req)
+	resp, ok := c.store().Get(key, c.ttl)
+	if ok {
+		fmt.Printf("    cache hit (%s)\n", req.Model)
+		c.e.recordCacheHit(c.rs, c.stepID, req.Model)
+	}
+	return key, resp, ok
+}
+
+func (c *cachedProvider) save(key string, resp llm.Response) {
+	if err := c.store().Put(key, resp); err != nil {
+		fmt.Printf("    could not cache response: %v\n", err)
+	}
+}
+
+func (c *cachedProvider) Generate(ctx context.Context, req llm.Request) (llm.Response, error) {
+	key, resp, ok := c.lookup(req)
+	if ok {
+		return resp, nil
+	}
+	resp, err := c.p.Generate(ctx, req)
+	if err != nil {
+		return llm.Response{}, err
+	}
+	c.save(key, resp)
+	return resp, nil
+}
+
+type cachedStreamProvider struct {
+	*cachedProvider
+	sp llm.StreamProvider
+}
+
+func (c *cachedStreamProvider) GenerateStream(ctx context.Context, req llm.Request, onText func(string)) (llm.Response, error) {
+	key, resp, ok := c.lookup(req)
+	if ok {
+		if onText != nil {
+			onText(resp.Text)
+		}
+		return resp, nil
+	}
+	resp, err := c.sp.GenerateStream(ctx, req, onText)
+	if err != nil {
+		return llm.Response{}, err
+	}
+	c.save(key, resp)
+	return resp, nil
+}
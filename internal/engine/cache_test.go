@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"cli-gpt-flows/internal/cache"
+	"cli-gpt-flows/internal/openai"
+	"cli-gpt-flows/internal/workflow"
+)
+
+func TestRun_CachesResponses(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`))
+	}))
+	defer srv.Close()
+
+	noStream := false
+	wf := workflow.Workflow{Name: "t", CacheTTL: "1h", Steps: []workflow.Step{
+		{ID: "greet", Type: "gemini", Provider: workflow.ProviderOpenAI, Model: "llama3", UserPrompt: "hi", Stream: &noStream},
+	}}
+	deps := Dependencies{OpenAI: openai.NewClient(srv.URL, "", srv.Client()), Cache: cache.New(t.TempDir()), Headless: true}
+	run := func(deps Dependencies) *runState {
+		t.Helper()
+		rs := newRunState(wf)
+		if err := New(deps).run(context.Background(), rs); err != nil {
+			t.Fatal(err)
+		}
+		if rs.memory["greet"] != "hello" {
+			t.Fatalf("unexpected output %q", rs.memory["greet"])
+		}
+		return rs
+	}
+
+	if rs := run(deps); calls.Load() != 1 || rs.ledger.cacheHits("") != 0 {
+		t.Fatalf("first run: %d calls, %d hits", calls.Load(), rs.ledger.cacheHits(""))
+	}
+	rs := run(deps)
+	if calls.Load() != 1 || rs.ledger.cacheHits("greet") != 1 {
+		t.Fatalf("second run: expected a cache hit, got %d calls, %d hits", calls.Load(), rs.ledger.cacheHits("greet"))
+	}
+	if u, cost := rs.ledger.total("greet"); u.TotalTokens != 0 || cost != 0 {
+		t.Fatalf("expected a free hit, got %+v $%v", u, cost)
+	}
+
+	deps.NoCache = true
+	if rs := run(deps); calls.Load() != 2 || rs.ledger.cacheHits("") != 0 {
+		t.Fatalf("--no-cache: expected a call, got %d calls, %d hits", calls.Load(), rs.ledger.cacheHits(""))
+	}
+}
@@ -0,0 +1,230 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"cli-gpt-flows/internal/chunk"
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/templating"
+	"cli-gpt-flows/internal/workflow"
+)
+
+// partialsKey is the template variable holding the map results in a
+// chunking reduce_prompt.
+const partialsKey = "partials"
+
+// preflight measures a request against the step's input limit: max_input_tokens
+// if set, otherwise the model's context window when the provider knows it. It
+// returns the prompt size and the limit (0 when there is none). Text-only
+// prompts well under the limit are only estimated, so most steps don't pay for
+// an extra API call; attachments are always counted, since their size in
+// tokens can't be told from their bytes.
+func (e *Engine) preflight(ctx context.Context, p llm.Provider, step workflow.Step, req llm.Request) (int, int) {
+	tc, counts := p.(llm.TokenCounter)
+	limit := step.MaxInputTokens
+	if limit == 0 && counts {
+		limit = e.inputTokenLimit(ctx, tc, req.Model)
+	}
+	if limit == 0 {
+		return 0, 0
+	}
+
+	estimate := estimateTokens(req)
+	if !counts || (len(req.Attachments) == 0 && estimate < limit/2) {
+		return estimate, limit
+	}
+	n, err := tc.CountTokens(ctx, req)
+	if err != nil {
+		fmt.Printf("    could not count tokens (%v), using an estimate\n", err)
+		return estimate, limit
+	}
+	return n, limit
+}
+
+// inputTokenLimit returns a model's context window, looked up once per model.
+func (e *Engine) inputTokenLimit(ctx context.Context, tc llm.TokenCounter, model string) int {
+	if v, ok := e.limits.Load(model); ok {
+		return v.(int)
+	}
+	limit, err := tc.InputTokenLimit(ctx, model)
+	if err != nil {
+		fmt.Printf("    could not look up the input limit of %s: %v\n", model, err)
+		limit = 0
+	}
+	e.limits.Store(model, limit)
+	return limit
+}
+
+const (
+	// defaultChunkTokens sizes chunks when neither chunk_tokens nor the
+	// model's context window is known.
+	defaultChunkTokens = 20000
+	// defaultMapConcurrency bounds the map calls in flight at once.
+	defaultMapConcurrency = 4
+)
+
+// runChunked splits the step's chunking input, runs the user prompt over every
+// chunk and reduces the partial results with reduce_prompt. It returns the
+// final text and the reduce request, which stands in for the original prompt
+// in an interactive refine. limit is the input limit that was exceeded, or 0.
+func (e *Engine) runChunked(ctx context.Context, rs *runState, p llm.Provider, step workflow.Step, req llm.Request, limit int) (string, llm.Request, error) {
+	c := step.Chunking
+	input, ok := templating.Lookup(rs.memory, c.Input)
+	if !ok {
+		return "", req, fmt.Errorf("chunking.input %s is not set", c.Input)
+	}
+	raw, ok := rs.rawStep(step.ID)
+	if !ok {
+		return "", req, fmt.Errorf("step %s not found", step.ID)
+	}
+
+	size := c.ChunkTokens
+	switch {
+	case size > 0:
+	case limit > 0:
+		// Leave room for the rest of the prompt and the instructions around it.
+		size = limit / 2
+	default:
+		size = defaultChunkTokens
+	}
+	pieces := chunk.Split(input, size, c.OverlapTokens)
+	if limit > 0 {
+		fmt.Printf("    prompt is over the input limit of %d tokens; splitting %s into %d chunks\n", limit, c.Input, len(pieces))
+	} else {
+		fmt.Printf("    splitting %s into %d chunks\n", c.Input, len(pieces))
+	}
+
+	prompts := make([]string, 0, len(pieces))
+	for i, piece := range pieces {
+		prompt, err := templating.RenderString(raw.UserPrompt, withValue(rs.memory, c.Input, piece))
+		if err != nil {
+			return "", req, fmt.Errorf("render chunk %d: %w", i+1, err)
+		}
+		prompts = append(prompts, prompt)
+	}
+	partials, err := e.mapChunks(ctx, rs, p, step, req, prompts)
+	if err != nil {
+		return "", req, err
+	}
+
+	reduce, err := templating.RenderString(c.ReducePrompt, withValue(rs.memory, partialsKey, joinPartials(partials)))
+	if err != nil {
+		return "", req, fmt.Errorf("render reduce_prompt: %w", err)
+	}
+	fmt.Printf("    reducing %d partial results\n", len(partials))
+	req.UserPrompt = reduce
+	step.UserPrompt = reduce
+	text, err := e.generate(ctx, rs, p, step, req)
+	if err != nil {
+		return "", req, err
+	}
+	return text, req, nil
+}
+
+// mapChunks sends one prompt per chunk, at most `concurrency` at a time, and
+// returns the answers in chunk order. The first failure cancels the rest.
+func (e *Engine) mapChunks(ctx context.Context, rs *runState, p llm.Provider, step workflow.Step, req llm.Request, prompts []string) ([]string, error) {
+	// The map calls produce intermediate text; JSON and streaming only apply
+	// to the final answer.
+	step.ResponseFormat, step.ResponseSchema, step.SchemaRetries = "", nil, nil
+	noStream := false
+	step.Stream = &noStream
+	req.ResponseFormat, req.ResponseSchema = "", nil
+
+	concurrency := step.Chunking.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultMapConcurrency
+	}
+
+	childCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		index int
+		out   string
+		err   error
+	}
+
+	results := make(chan result, len(prompts))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, prompt := range prompts {
+		i, prompt := i, prompt
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if childCtx.Err() != nil {
+				results <- result{index: i, err: childCtx.Err()}
+				return
+			}
+
+			s, r := step, req
+			s.UserPrompt, r.UserPrompt = prompt, prompt
+			out, err := e.generate(childCtx, rs, p, s, r)
+			if err != nil {
+				cancel()
+			} else {
+				fmt.Printf("    chunk %d/%d done\n", i+1, len(prompts))
+			}
+			results <- result{index: i, out: out, err: err}
+		}()
+	}
+
+	wg.Wait()
+	close(results)
+
+	partials := make([]string, len(prompts))
+	var firstErr error
+	for r := range results {
+		if r.err != nil {
+			// Prefer the error that caused the cancellation over the
+			// context errors it triggered in the other calls.
+			if firstErr == nil || errors.Is(firstErr, context.Canceled) {
+				firstErr = fmt.Errorf("chunk %d: %w", r.index+1, r.err)
+			}
+			continue
+		}
+		partials[r.index] = r.out
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return partials, nil
+}
+
+// rawStep returns the unrendered definition of a step.
+func (rs *runState) rawStep(id string) (workflow.Step, bool) {
+	for _, s := range rs.wf.Steps {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return workflow.Step{}, false
+}
+
+// withValue returns a copy of memory with key set to value.
+func withValue(memory map[string]string, key, value string) map[string]string {
+	out := make(map[string]string, len(memory)+1)
+	for k, v := range memory {
+		out[k] = v
+	}
+	out[key] = value
+	return out
+}
+
+func joinPartials(partials []string) string {
+	var b strings.Builder
+	for i, p := range partials {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		fmt.Fprintf(&b, "--- part %d of %d ---\n%s", i+1, len(partials), strings.TrimSpace(p))
+	}
+	return b.String()
+}
@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/usage"
+	"cli-gpt-flows/internal/workflow"
+)
+
+// fakeProvider answers every call with its prompt's first line and records the prompts.
+type fakeProvider struct {
+	mu      sync.Mutex
+	prompts []string
+}
+
+func (f *fakeProvider) Generate(_ context.Context, req llm.Request) (llm.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prompts = append(f.prompts, req.UserPrompt)
+	return llm.Response{Text: "summary " + strings.SplitN(req.UserPrompt, "\n", 2)[0]}, nil
+}
+
+func TestRunModel_ChunksOversizedInput(t *testing.T) {
+	wf := workflow.Workflow{Name: "t", Steps: []workflow.Step{
+		{ID: "transcript", Type: "input"},
+		{
+			ID:             "summary",
+			Type:           "gemini",
+			Model:          "m",
+			UserPrompt:     "Summarize:\n{{ transcript }}",
+			MaxInputTokens: 50,
+			Chunking: &workflow.Chunking{
+				Input:        "transcript",
+				ChunkTokens:  40,
+				ReducePrompt: "Combine:\n{{ partials }}",
+			},
+		},
+	}}
+	rs := newRunState(wf)
+	rs.memory["transcript"] = strings.Repeat("lorem ipsum dolor sit amet ", 40)
+
+	step, err := renderStep(wf.Steps[1], rs.memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeProvider{}
+	e := &Engine{prices: usage.Prices{}}
+	req := llm.Request{Model: step.Model, UserPrompt: step.UserPrompt}
+	tokens, limit := e.preflight(context.Background(), fake, step, req)
+	if tokens <= limit {
+		t.Fatalf("expected prompt (%d tokens) to be over the limit (%d)", tokens, limit)
+	}
+
+	text, _, err := e.runChunked(context.Background(), rs, fake, step, req, limit)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fake.prompts) < 3 {
+		t.Fatalf("expected several map calls and a reduce, got %d calls", len(fake.prompts))
+	}
+	for _, p := range fake.prompts[:len(fake.prompts)-1] {
+		if !strings.HasPrefix(p, "Summarize:\n") || len(p) > 40*4+len("Summarize:\n") {
+			t.Fatalf("unexpected map prompt %q", p)
+		}
+	}
+	reduce := fake.prompts[len(fake.prompts)-1]
+	if !strings.HasPrefix(reduce, "Combine:\n--- part 1 of ") {
+		t.Fatalf("unexpected reduce prompt %q", reduce)
+	}
+	if text != "summary Combine:" {
+		t.Fatalf("unexpected result %q", text)
+	}
+}
+
+func TestMapChunks_KeepsChunkOrder(t *testing.T) {
+	step := workflow.Step{ID: "s", Type: workflow.TypeMapReduce, Chunking: &workflow.Chunking{Concurrency: 2}}
+	rs := newRunState(workflow.Workflow{Name: "t", Steps: []workflow.Step{step}})
+	fake := &fakeProvider{}
+	e := &Engine{prices: usage.Prices{}}
+
+	prompts := []string{"a", "b", "c", "d", "e"}
+	got, err := e.mapChunks(context.Background(), rs, fake, step, llm.Request{Model: "m"}, prompts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, p := range prompts {
+		if got[i] != "summary "+p {
+			t.Fatalf("partial %d: expected %q, got %q", i, "summary "+p, got[i])
+		}
+	}
+}
+
+// countingProvider reports a fixed token count and how often it was asked.
+type countingProvider struct {
+	fakeProvider
+	tokens, counted int
+}
+
+func (c *countingProvider) CountTokens(context.Context, llm.Request) (int, error) {
+	c.counted++
+	return c.tokens, nil
+}
+
+func (c *countingProvider) InputTokenLimit(context.Context, string) (int, error) {
+	return 1000, nil
+}
+
+func TestPreflight_MeasuresAttachments(t *testing.T) {
+	e := New(Dependencies{})
+	step := workflow.Step{ID: "s"}
+	small := llm.Request{Model: "m", UserPrompt: "describe this"}
+	withPDF := small
+	withPDF.Attachments = []llm.Attachment{{Name: "a.pdf", MIMEType: "application/pdf", Data: make([]byte, 1000)}}
+
+	p := &countingProvider{tokens: 5000}
+	if tokens, _ := e.preflight(context.Background(), p, step, small); tokens >= 500 || p.counted != 0 {
+		t.Fatalf("expected a small text prompt to be estimated, got %d tokens, %d counts", tokens, p.counted)
+	}
+	tokens, limit := e.preflight(context.Background(), p, step, withPDF)
+	if tokens != 5000 || limit != 1000 || p.counted != 1 {
+		t.Fatalf("expected the attachment to be counted, got %d/%d tokens, %d counts", tokens, limit, p.counted)
+	}
+
+	// Without a token counter, attachments still add to the estimate.
+	step.MaxInputTokens = 100
+	withPDF.Attachments[0].Data = make([]byte, 20000)
+	if tokens, _ := e.preflight(context.Background(), &fakeProvider{}, step, withPDF); tokens <= 100 {
+		t.Fatalf("expected the attachment in the estimate, got %d", tokens)
+	}
+}
@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cli-gpt-flows/internal/chunk"
+	"cli-gpt-flows/internal/gemini"
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/openai"
+	"cli-gpt-flows/internal/vectorindex"
+	"cli-gpt-flows/internal/workflow"
+)
+
+// defaultTopK is how many passages a retrieve step returns unless top_k is set.
+const defaultTopK = 5
+
+// embedder returns the embedding backend of an embed or retrieve step with
+// the provider name and model to use. Calls count against the run's budget
+// and are recorded with --record; under --replay the fixture answers them.
+// They are not cached.
+func (e *Engine) embedder(rs *runState, stepID, provider, model string) (llm.Embedder, string, string, error) {
+	if provider == "" {
+		provider = workflow.ProviderGemini
+	}
+	var (
+		p   llm.Provider
+		err error
+	)
+	if e.deps.Replay != nil {
+		p = e.deps.Replay.Provider(stepID, provider)
+	} else if p, err = e.provider(provider); err != nil {
+		return nil, "", "", err
+	}
+	emb, ok := p.(llm.Embedder)
+	if !ok {
+		return nil, "", "", fmt.Errorf("provider %s does not support embeddings here", provider)
+	}
+	if e.deps.Record != nil {
+		emb = e.deps.Record.WrapEmbedder(stepID, provider, emb)
+	}
+	emb = &meteredEmbedder{e: e, rs: rs, stepID: stepID, emb: emb}
+
+	if model == "" {
+		model = gemini.DefaultEmbeddingModel
+		if provider == workflow.ProviderOpenAI {
+			model = openai.DefaultEmbeddingModel
+		}
+	}
+	return emb, provider, model, nil
+}
+
+type embedding struct {
+	Text      string    `json:"text"`
+	Embedding []float32 `json:"embedding"`
+}
+
+// runEmbed embeds the step's input, or each of its chunks with chunk_tokens,
+// and stores a JSON list of {text, embedding}.
+func (e *Engine) runEmbed(ctx context.Context, rs *runState, step workflow.Step) (string, error) {
+	emb, _, model, err := e.embedder(rs, step.ID, step.Provider, step.Model)
+	if err != nil {
+		return "", err
+	}
+	texts := []string{step.Input}
+	if step.ChunkTokens > 0 {
+		texts = chunk.Split(step.Input, step.ChunkTokens, step.OverlapTokens)
+	}
+	vecs, err := emb.Embed(ctx, model, texts)
+	if err != nil {
+		return "", err
+	}
+	if len(vecs) != len(texts) {
+		return "", fmt.Errorf("got %d embeddings for %d texts", len(vecs), len(texts))
+	}
+	out := make([]embedding, len(texts))
+	for i := range texts {
+		out[i] = embedding{Text: texts[i], Embedding: vecs[i]}
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// runRetrieve searches the step's documents or named index for its query and
+// stores the best passages, each under a header naming its file and
+// similarity.
+func (e *Engine) runRetrieve(ctx context.Context, rs *runState, step workflow.Step) (string, error) {
+	var (
+		ix  *vectorindex.Index
+		emb llm.Embedder
+		err error
+	)
+	if step.Index != "" {
+		if ix, err = vectorindex.LoadNamed(step.Index); err != nil {
+			return "", err
+		}
+		if emb, _, _, err = e.embedder(rs, step.ID, ix.Provider, ix.Model); err != nil {
+			return "", err
+		}
+	} else {
+		var provider, model string
+		if emb, provider, model, err = e.embedder(rs, step.ID, step.Provider, step.Model); err != nil {
+			return "", err
+		}
+		dir := e.deps.IndexDir
+		switch {
+		case dir != "":
+		case e.deps.Record != nil || e.deps.Replay != nil:
+			// Build the index from scratch, so every chunk is embedded
+			// through the fixture rather than taken from an earlier run.
+			if dir, err = os.MkdirTemp("", "pals-gemflows-index-"); err != nil {
+				return "", err
+			}
+			defer os.RemoveAll(dir)
+		default:
+			dir = vectorindex.DefaultDir()
+		}
+		docs, err := e.readPath(step.Documents)
+		if err != nil {
+			return "", err
+		}
+		ix, err = vectorindex.Ensure(ctx, emb, provider, model, docs, dir, vectorindex.Options{
+			ChunkTokens:   step.ChunkTokens,
+			OverlapTokens: step.OverlapTokens,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	q, err := emb.Embed(ctx, ix.Model, []string{step.Query})
+	if err != nil {
+		return "", fmt.Errorf("embed query: %w", err)
+	}
+	if len(q) != 1 {
+		return "", fmt.Errorf("got %d embeddings for the query", len(q))
+	}
+
+	topK := step.TopK
+	if topK == 0 {
+		topK = defaultTopK
+	}
+	return formatHits(ix.Search(q[0], topK)), nil
+}
+
+// IndexOptions configure IndexDocuments. Empty fields use the defaults of
+// retrieve steps; Name defaults to the folder's name.
+type IndexOptions struct {
+	Name          string
+	Provider      string
+	Model         string
+	ChunkTokens   int
+	OverlapTokens int
+}
+
+// pdfModel transcribes PDFs for the `index` command.
+const pdfModel = "gemini-2.5-flash"
+
+// IndexDocuments builds or updates a named index of the Markdown, text and
+// (with a Gemini client) PDF files under dir, for retrieve steps that set
+// `index:`. Only new and changed files are embedded. It backs the `index`
+// command.
+func (e *Engine) IndexDocuments(ctx context.Context, dir string, opts IndexOptions) (*vectorindex.Index, vectorindex.Stats, error) {
+	name := opts.Name
+	if name == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, vectorindex.Stats{}, err
+		}
+		name = filepath.Base(abs)
+	}
+	rs := newRunState(workflow.Workflow{Name: "index"})
+	defer rs.ledger.printSummary()
+	emb, provider, model, err := e.embedder(rs, "index", opts.Provider, opts.Model)
+	if err != nil {
+		return nil, vectorindex.Stats{}, err
+	}
+	vopts := vectorindex.Options{ChunkTokens: opts.ChunkTokens, OverlapTokens: opts.OverlapTokens}
+	if e.deps.Replay == nil && e.deps.Gemini != nil {
+		vopts.PDFText = e.pdfText
+	}
+
+	fmt.Printf("==> indexing %s as %s (%s)\n", dir, name, model)
+	ix, st, err := vectorindex.UpdateNamed(ctx, emb, name, provider, model, dir, vopts)
+	if err != nil {
+		return nil, vectorindex.Stats{}, err
+	}
+	fmt.Printf("<== index %s revision %d: %d added, %d changed, %d removed, %d unchanged files; %d chunks\n",
+		name, ix.Revision, st.Added, st.Changed, st.Removed, st.Unchanged, st.Chunks)
+	return ix, st, nil
+}
+
+// pdfText asks Gemini for the text of a PDF.
+func (e *Engine) pdfText(ctx context.Context, name string, data []byte) (string, error) {
+	fmt.Printf("    extracting text from %s\n", name)
+	resp, err := e.deps.Gemini.Generate(ctx, llm.Request{
+		Model:       pdfModel,
+		UserPrompt:  "Transcribe all text of this document as Markdown, keeping headings, lists and tables. Output only the document text.",
+		Attachments: []llm.Attachment{{Name: name, MIMEType: "application/pdf", Data: data}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.Text, nil
+}
+
+func formatHits(hits []vectorindex.Hit) string {
+	var b strings.Builder
+	for i, h := range hits {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		fmt.Fprintf(&b, "[%d] %s (score %.2f)\n%s", i+1, h.Source, h.Score, strings.TrimSpace(h.Text))
+	}
+	return b.String()
+}
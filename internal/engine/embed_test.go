@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/models"
+	"cli-gpt-flows/internal/usage"
+	"cli-gpt-flows/internal/vectorindex"
+	"cli-gpt-flows/internal/workflow"
+)
+
+// wordProvider embeds a text as flags for a few known words and answers
+// prompts by echoing them.
+type wordProvider struct{}
+
+var embedWords = []string{"portal", "mobile", "billing"}
+
+func (wordProvider) Embed(_ context.Context, _ string, texts []string) ([][]float32, error) {
+	out := make([][]float32, len(texts))
+	for i, t := range texts {
+		out[i] = make([]float32, len(embedWords))
+		for j, w := range embedWords {
+			if strings.Contains(strings.ToLower(t), w) {
+				out[i][j] = 1
+			}
+		}
+	}
+	return out, nil
+}
+
+func (wordProvider) Generate(_ context.Context, req llm.Request) (llm.Response, error) {
+	return llm.Response{Text: req.UserPrompt}, nil
+}
+
+type wordReplayer struct{}
+
+func (wordReplayer) Inputs() map[string]string {
+	return map[string]string{"topic": "a customer portal"}
+}
+func (wordReplayer) Refined(string) (string, bool)        { return "", false }
+func (wordReplayer) Provider(string, string) llm.Provider { return wordProvider{} }
+
+func TestRun_RetrieveGroundsPrompt(t *testing.T) {
+	root := t.TempDir()
+	docs := filepath.Join(root, "specs")
+	if err := os.Mkdir(docs, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{
+		"acme.md":   "# Acme\nA self-service portal for Acme's customers.",
+		"globex.md": "# Globex\nA mobile app for field staff.",
+	} {
+		if err := os.WriteFile(filepath.Join(docs, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wf, err := workflow.LoadFromBytes("grounded.yaml", []byte(`
+name: grounded
+steps:
+  - id: topic
+    type: input
+  - id: context
+    type: retrieve
+    query: "{{ topic }}"
+    documents: specs
+    top_k: 1
+  - id: vectors
+    type: embed
+    input: "{{ topic }}"
+  - id: spec
+    type: gemini
+    model: gemini-2.5-flash
+    user_prompt: "Past work:\n{{ context }}"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := New(Dependencies{Prices: usage.Prices{}, Aliases: models.Aliases{}, Replay: wordReplayer{}, IndexDir: t.TempDir(), OutputDir: root})
+	out, err := e.RunOutputs(context.Background(), wf, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(out["context"], "[1] acme.md (score 1.00)\n# Acme") || strings.Contains(out["context"], "Globex") {
+		t.Fatalf("context = %q", out["context"])
+	}
+	if !strings.Contains(out["spec"], "self-service portal") {
+		t.Fatalf("spec prompt was not grounded: %q", out["spec"])
+	}
+	if out["vectors"] != `[{"text":"a customer portal","embedding":[1,0,0]}]` {
+		t.Fatalf("vectors = %s", out["vectors"])
+	}
+}
+
+func TestRun_RetrieveFromNamedIndex(t *testing.T) {
+	t.Setenv(vectorindex.EnvDataDir, t.TempDir())
+	docs := t.TempDir()
+	if err := os.WriteFile(filepath.Join(docs, "billing.md"), []byte("Billing runs monthly."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := New(Dependencies{Prices: usage.Prices{}, Aliases: models.Aliases{}, Replay: wordReplayer{}})
+	if _, _, err := e.IndexDocuments(context.Background(), docs, IndexOptions{Name: "specs"}); err != nil {
+		t.Fatal(err)
+	}
+
+	wf, err := workflow.LoadFromBytes("grounded.yaml", []byte(`
+name: grounded
+steps:
+  - id: context
+    type: retrieve
+    query: "how does billing work"
+    index: specs
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := e.RunOutputs(context.Background(), wf, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(out["context"], "[1] billing.md (score 1.00)") {
+		t.Fatalf("context = %q", out["context"])
+	}
+}
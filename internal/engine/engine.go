@@ -3,37 +3,175 @@ package engine
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"cli-gpt-flows/internal/analytics"
+	"cli-gpt-flows/internal/cache"
+	"cli-gpt-flows/internal/fixture"
 	"cli-gpt-flows/internal/gemini"
+	"cli-gpt-flows/internal/jsonschema"
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/models"
+	"cli-gpt-flows/internal/openai"
 	"cli-gpt-flows/internal/templating"
+	"cli-gpt-flows/internal/usage"
 	"cli-gpt-flows/internal/workflow"
 )
 
 type Dependencies struct {
 	Gemini    *gemini.Client
+	OpenAI    *openai.Client
 	Analytics *analytics.Client
+	// Prices is the per-model price table for cost accounting. When nil, the
+	// defaults merged with the user's prices file are used.
+	Prices usage.Prices
+	// Aliases maps model aliases to models. When nil, the defaults merged with
+	// the user's models file are used.
+	Aliases models.Aliases
+	// Cache holds responses for workflows that set cache_ttl; nil means the
+	// default location. NoCache (--no-cache) bypasses it for the whole run.
+	Cache   *cache.Store
+	NoCache bool
+	// Record (--record) captures model calls and input values of the run;
+	// Replay (--replay, recipe tests) answers them instead, so no provider is
+	// contacted and nothing is read from the terminal.
+	Record *fixture.Recorder
+	Replay Replayer
+	// AllowSideEffects (--allow-side-effects) lets shell and http steps run
+	// under Replay, which otherwise refuses them to stay offline and
+	// deterministic.
+	AllowSideEffects bool
+	// OutputDir is the directory steps read and write files in; empty means
+	// the working directory (--output-dir). InputDir, when set, is read from
+	// instead, so OutputDir only receives writes (recipe tests, evals). Paths
+	// leading out of them are rejected unless AllowAnyPath (--allow-any-path).
+	OutputDir    string
+	InputDir     string
+	AllowAnyPath bool
+	// Remote marks a recipe fetched from the remote catalog. Its shell steps
+	// only run with AllowShell (--allow-shell) and its http steps with
+	// AllowHTTP (--allow-http).
+	Remote     bool
+	AllowShell bool
+	AllowHTTP  bool
+	// IndexDir is where retrieve steps keep the indexes they build; empty
+	// means vectorindex.DefaultDir().
+	IndexDir string
+	// Headless runs never touch the terminal or clipboard: missing inputs are
+	// errors, clipboard steps are skipped and interactive_refine accepts the
+	// first version. Replays are always headless.
+	Headless bool
+}
+
+// Replayer stands in for the model providers and the terminal during a run.
+// *fixture.Replayer implements it.
+type Replayer interface {
+	// Inputs are the values of input steps, by step id.
+	Inputs() map[string]string
+	// Refined returns the accepted version of an interactive_refine step.
+	Refined(stepID string) (string, bool)
+	// Provider returns the fake provider used for one step.
+	Provider(stepID, provider string) llm.Provider
 }
 
 type Engine struct {
-	deps Dependencies
+	deps    Dependencies
+	prices  usage.Prices
+	aliases models.Aliases
+	// limits caches model context windows (model name -> tokens).
+	limits sync.Map
 }
 
 func New(deps Dependencies) *Engine {
-	return &Engine{deps: deps}
+	prices := deps.Prices
+	if prices == nil {
+		var err error
+		prices, err = usage.LoadPrices()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v (using default prices)\n", err)
+		}
+	}
+	aliases := deps.Aliases
+	if aliases == nil {
+		var err error
+		aliases, err = models.LoadAliases()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v (using default model aliases)\n", err)
+		}
+	}
+	return &Engine{deps: deps, prices: prices, aliases: aliases}
+}
+
+// runState is what the steps of a single Engine.Run share.
+type runState struct {
+	wf     workflow.Workflow
+	memory map[string]string
+
+	// inputs pre-fill `input` steps by id; depth > 0 marks a recipe started by
+	// the run_recipe tool, which must not prompt the user.
+	inputs map[string]string
+	depth  int
+
+	// caps is what the top-level recipe was shown to do (see
+	// workflow.Effective); recipes run_recipe starts from a remote recipe
+	// stay within it.
+	caps workflow.Capabilities
+
+	ledger *ledger
+
+	mu            sync.Mutex
+	conversations map[string][]llm.Message
+}
+
+func newRunState(wf workflow.Workflow) *runState {
+	return &runState{
+		wf:            wf,
+		caps:          workflow.Effective(wf),
+		memory:        map[string]string{},
+		inputs:        map[string]string{},
+		ledger:        newLedger(wf),
+		conversations: map[string][]llm.Message{},
+	}
 }
 
 func (e *Engine) Run(ctx context.Context, wf workflow.Workflow) error {
-	memory := map[string]string{}
+	_, err := e.RunOutputs(ctx, wf, nil)
+	return err
+}
+
+// RunOutputs is Run with values for input steps (by id), returning the step
+// outputs (memory) the run produced. On failure they are the outputs of the
+// steps that completed.
+func (e *Engine) RunOutputs(ctx context.Context, wf workflow.Workflow, inputs map[string]string) (map[string]string, error) {
+	rs := newRunState(wf)
+	if e.deps.Replay != nil {
+		for id, v := range e.deps.Replay.Inputs() {
+			rs.inputs[id] = v
+		}
+	}
+	for id, v := range inputs {
+		rs.inputs[id] = v
+	}
+	defer rs.ledger.printSummary()
+	err := e.run(ctx, rs)
+	return rs.memory, err
+}
+
+func (e *Engine) run(ctx context.Context, rs *runState) error {
+	wf, memory := rs.wf, rs.memory
 
 	for i := 0; i < len(wf.Steps); {
 		raw := wf.Steps[i]
@@ -43,7 +181,7 @@ func (e *Engine) Run(ctx context.Context, wf workflow.Workflow) error {
 			for j < len(wf.Steps) && wf.Steps[j].ParallelGroup == group {
 				j++
 			}
-			if err := e.runParallelGroup(ctx, wf, wf.Steps[i:j], memory); err != nil {
+			if err := e.runParallelGroup(ctx, rs, wf.Steps[i:j]); err != nil {
 				return err
 			}
 			i = j
@@ -55,14 +193,15 @@ func (e *Engine) Run(ctx context.Context, wf workflow.Workflow) error {
 			return fmt.Errorf("render step %s: %w", raw.ID, err)
 		}
 
-		out, durationMs, err := e.executeStep(ctx, step)
+		out, durationMs, err := e.executeStep(ctx, rs, step)
 		if err != nil {
 			return fmt.Errorf("step %s failed: %w", step.ID, err)
 		}
 
 		memory[step.ID] = out
 		if e.deps.Analytics != nil {
-			e.deps.Analytics.StepCompleted(wf.Name, step.ID, step.Type, durationMs)
+			u, cost := rs.ledger.total(step.ID)
+			e.deps.Analytics.StepCompleted(wf.Name, step.ID, step.Type, durationMs, u, cost, rs.ledger.cacheHits(step.ID))
 		}
 		i++
 	}
@@ -70,10 +209,11 @@ func (e *Engine) Run(ctx context.Context, wf workflow.Workflow) error {
 	return nil
 }
 
-func (e *Engine) runParallelGroup(ctx context.Context, wf workflow.Workflow, raws []workflow.Step, memory map[string]string) error {
+func (e *Engine) runParallelGroup(ctx context.Context, rs *runState, raws []workflow.Step) error {
 	if len(raws) == 0 {
 		return nil
 	}
+	wf, memory := rs.wf, rs.memory
 	group := raws[0].ParallelGroup
 	fmt.Printf("==> parallel group %q (%d steps)\n", group, len(raws))
 
@@ -86,6 +226,9 @@ func (e *Engine) runParallelGroup(ctx context.Context, wf workflow.Workflow, raw
 		if err != nil {
 			return fmt.Errorf("render step %s: %w", raw.ID, err)
 		}
+		// Interleaved tokens from concurrent steps would be unreadable.
+		noStream := false
+		step.Stream = &noStream
 		steps = append(steps, step)
 	}
 
@@ -107,7 +250,7 @@ func (e *Engine) runParallelGroup(ctx context.Context, wf workflow.Workflow, raw
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			out, durationMs, err := e.executeStep(childCtx, step)
+			out, durationMs, err := e.executeStep(childCtx, rs, step)
 			if err != nil {
 				cancel()
 			}
@@ -124,7 +267,8 @@ func (e *Engine) runParallelGroup(ctx context.Context, wf workflow.Workflow, raw
 		}
 		memory[r.id] = r.out
 		if e.deps.Analytics != nil {
-			e.deps.Analytics.StepCompleted(wf.Name, r.id, r.stepType, r.durationMs)
+			u, cost := rs.ledger.total(r.id)
+			e.deps.Analytics.StepCompleted(wf.Name, r.id, r.stepType, r.durationMs, u, cost, rs.ledger.cacheHits(r.id))
 		}
 	}
 
@@ -132,7 +276,7 @@ func (e *Engine) runParallelGroup(ctx context.Context, wf workflow.Workflow, raw
 	return nil
 }
 
-func (e *Engine) executeStep(ctx context.Context, step workflow.Step) (string, int64, error) {
+func (e *Engine) executeStep(ctx context.Context, rs *runState, step workflow.Step) (string, int64, error) {
 	fmt.Printf("==> step %s (%s)\n", step.ID, step.Type)
 	start := time.Now()
 
@@ -142,28 +286,57 @@ func (e *Engine) executeStep(ctx context.Context, step workflow.Step) (string, i
 	)
 	switch step.Type {
 	case "input":
-		if step.FromClipboard {
+		if v, ok := rs.inputs[step.ID]; ok {
+			out = v
+		} else if rs.depth > 0 || e.headless() {
+			err = fmt.Errorf("input %s was not provided", step.ID)
+		} else if step.FromClipboard {
 			out, err = runInputFromClipboard(step.Prompt)
 		} else if step.Multiline {
 			out, err = runInputMultiline(step.Prompt)
 		} else {
 			out, err = runInput(step.Prompt)
 		}
-	case "gemini":
-		if e.deps.Gemini == nil {
-			err = errors.New("gemini client is not configured")
-			break
+		if err == nil && rs.depth == 0 && e.deps.Record != nil {
+			e.deps.Record.RecordInput(step.ID, out)
 		}
-		out, err = e.deps.Gemini.Generate(ctx, step.Model, step.SystemPrompt, step.UserPrompt)
+	case workflow.TypeReadFile:
+		out, err = e.runReadFile(step)
+	case "gemini":
+		out, err = e.runModel(ctx, rs, step)
+	case workflow.TypeMapReduce:
+		out, err = e.runMapReduce(ctx, rs, step)
+	case workflow.TypeEmbed:
+		out, err = e.runEmbed(ctx, rs, step)
+	case workflow.TypeRetrieve:
+		out, err = e.runRetrieve(ctx, rs, step)
+	case workflow.TypeShell:
+		out, err = e.runShell(ctx, step)
+	case workflow.TypeHTTP:
+		out, err = e.runHTTP(ctx, step)
 	case "save":
-		out, err = runSave(step.Filename, step.Content)
+		var res saveResult
+		res, err = e.runSave(step)
+		if err == nil {
+			out = res.Path
+			rs.memory[step.ID+".bytes"] = strconv.Itoa(res.Bytes)
+		}
 	case "clipboard":
+		if e.headless() {
+			// Headless runs (go test, CI, eval) may have no clipboard.
+			out = "copied"
+			break
+		}
 		out, err = runClipboard(step.Content)
 	default:
 		err = fmt.Errorf("unsupported step type: %s", step.Type)
 	}
 
 	durationMs := time.Since(start).Milliseconds()
+	var blocked *llm.BlockedError
+	if errors.As(err, &blocked) && len(step.Safety) == 0 && step.Provider != workflow.ProviderOpenAI {
+		err = fmt.Errorf("%w; if this is a false positive, set safety: thresholds on the step", err)
+	}
 	if err != nil {
 		return "", durationMs, err
 	}
@@ -172,6 +345,224 @@ func (e *Engine) executeStep(ctx context.Context, step workflow.Step) (string, i
 	return out, durationMs, nil
 }
 
+func (e *Engine) headless() bool {
+	return e.deps.Headless || e.deps.Replay != nil
+}
+
+// defaultSchemaRetries is how often a JSON step is re-prompted when the
+// response doesn't parse or match its schema, unless schema_retries is set.
+const defaultSchemaRetries = 2
+
+func (e *Engine) runModel(ctx context.Context, rs *runState, step workflow.Step) (string, error) {
+	step, base, p, err := e.modelProvider(rs, step)
+	if err != nil {
+		return "", err
+	}
+
+	req := newRequest(step)
+	paths, err := e.readPaths(step.Attachments)
+	if err != nil {
+		return "", err
+	}
+	req.Attachments, err = e.loadAttachments(paths)
+	if err != nil {
+		return "", err
+	}
+	if step.Conversation != "" {
+		req.History = rs.history(step.Conversation)
+	}
+
+	var text string
+	tokens, limit := e.preflight(ctx, base, step, req)
+	switch {
+	case limit > 0 && tokens > limit && step.Chunking != nil:
+		text, req, err = e.runChunked(ctx, rs, p, step, req, limit)
+	case limit > 0 && tokens > limit:
+		err = fmt.Errorf("prompt is about %d tokens, over the input limit of %d for %s (shorten the input or add chunking: to the step)", tokens, limit, step.Model)
+	default:
+		text, err = e.generate(ctx, rs, p, step, req)
+	}
+	if err != nil {
+		return "", err
+	}
+	if step.InteractiveRefine {
+		text, err = e.refineOrReplay(ctx, rs, p, step, req, text)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if step.Conversation != "" {
+		rs.appendTurn(step.Conversation, step.UserPrompt, text)
+	}
+	return text, nil
+}
+
+// runMapReduce always splits the step's chunking input, maps the chunks
+// concurrently and reduces the partial results.
+func (e *Engine) runMapReduce(ctx context.Context, rs *runState, step workflow.Step) (string, error) {
+	step, _, p, err := e.modelProvider(rs, step)
+	if err != nil {
+		return "", err
+	}
+	text, _, err := e.runChunked(ctx, rs, p, step, newRequest(step), 0)
+	return text, err
+}
+
+// newRequest builds the model request for a rendered step.
+func newRequest(step workflow.Step) llm.Request {
+	req := llm.Request{
+		Model:          step.Model,
+		SystemPrompt:   step.SystemPrompt,
+		UserPrompt:     step.UserPrompt,
+		ResponseFormat: step.ResponseFormat,
+		ResponseSchema: step.ResponseSchema,
+		Safety:         step.Safety,
+	}
+	if step.Generation != nil {
+		req.Generation = *step.Generation
+	}
+	return req
+}
+
+func (e *Engine) generate(ctx context.Context, rs *runState, p llm.Provider, step workflow.Step, req llm.Request) (string, error) {
+	if len(step.Tools) > 0 {
+		return e.generateWithTools(ctx, rs, p, step, req)
+	}
+	if step.ResponseFormat != llm.FormatJSON {
+		if streams(p, step) {
+			resp, err := p.(llm.StreamProvider).GenerateStream(ctx, req, func(chunk string) { fmt.Print(chunk) })
+			fmt.Println()
+			if err != nil {
+				return "", err
+			}
+			return resp.Text, nil
+		}
+		resp, err := p.Generate(ctx, req)
+		if err != nil {
+			return "", err
+		}
+		return resp.Text, nil
+	}
+
+	retries := defaultSchemaRetries
+	if step.SchemaRetries != nil {
+		retries = *step.SchemaRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := p.Generate(ctx, req)
+		if err != nil {
+			return "", err
+		}
+		text, verr := validateJSON(resp.Text, step.ResponseSchema)
+		if verr == nil {
+			return text, nil
+		}
+		if attempt >= retries {
+			return "", fmt.Errorf("response is not valid JSON for the schema after %d attempt(s): %w", attempt+1, verr)
+		}
+		fmt.Printf("    response rejected (%v), re-prompting (%d/%d)\n", verr, attempt+1, retries)
+		req.UserPrompt = fmt.Sprintf("%s\n\nYour previous response was rejected: %v\n\nPrevious response:\n%s\n\nRespond again with only a JSON document that fixes this.",
+			step.UserPrompt, verr, resp.Text)
+	}
+}
+
+// history returns a copy of a named conversation's turns so far.
+func (rs *runState) history(name string) []llm.Message {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return append([]llm.Message(nil), rs.conversations[name]...)
+}
+
+func (rs *runState) appendTurn(name, userText, modelText string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.conversations[name] = append(rs.conversations[name],
+		llm.Message{Role: llm.RoleUser, Text: userText},
+		llm.Message{Role: llm.RoleModel, Text: modelText},
+	)
+}
+
+// loadAttachments reads attachment files and works out their MIME types,
+// from the extension first and by sniffing the content otherwise.
+func (e *Engine) loadAttachments(paths []string) ([]llm.Attachment, error) {
+	out := make([]llm.Attachment, 0, len(paths))
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			return nil, errors.New("attachment path is empty")
+		}
+		data, err := e.readFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read attachment: %w", err)
+		}
+
+		mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(path)))
+		if mimeType == "" {
+			mimeType = http.DetectContentType(data)
+		}
+		// Providers want the bare type, without "; charset=utf-8".
+		if mt, _, err := mime.ParseMediaType(mimeType); err == nil {
+			mimeType = mt
+		}
+
+		out = append(out, llm.Attachment{Name: filepath.Base(path), MIMEType: mimeType, Data: data})
+	}
+	return out, nil
+}
+
+// streams reports whether a step's tokens are echoed live. Streaming is on by
+// default for free-text steps whose provider supports it; `stream: false` turns it off.
+func streams(p llm.Provider, step workflow.Step) bool {
+	if step.Stream != nil && !*step.Stream {
+		return false
+	}
+	_, ok := p.(llm.StreamProvider)
+	return ok && step.ResponseFormat != llm.FormatJSON && len(step.Tools) == 0
+}
+
+// validateJSON strips a Markdown code fence if the model added one, then checks
+// the document parses and matches schema (when given). It returns the JSON text.
+func validateJSON(text string, schema map[string]any) (string, error) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```json")
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimSuffix(text, "```")
+		text = strings.TrimSpace(text)
+	}
+
+	var v any
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		return "", fmt.Errorf("invalid JSON: %w", err)
+	}
+	if schema != nil {
+		if err := jsonschema.Validate(schema, v); err != nil {
+			return "", err
+		}
+	}
+	return text, nil
+}
+
+// provider picks the model backend for a `gemini` step. An empty name means Gemini.
+func (e *Engine) provider(name string) (llm.Provider, error) {
+	switch name {
+	case "", workflow.ProviderGemini:
+		if e.deps.Gemini == nil {
+			return nil, errors.New("gemini client is not configured")
+		}
+		return e.deps.Gemini, nil
+	case workflow.ProviderOpenAI:
+		if e.deps.OpenAI == nil {
+			return nil, fmt.Errorf("openai client is not configured (set %s and/or %s)", openai.EnvBaseURL, openai.EnvAPIKey)
+		}
+		return e.deps.OpenAI, nil
+	default:
+		return nil, fmt.Errorf("unsupported provider: %s", name)
+	}
+}
+
 func renderStep(step workflow.Step, memory map[string]string) (workflow.Step, error) {
 	var err error
 	step.Prompt, err = templating.RenderString(step.Prompt, memory)
@@ -190,6 +581,15 @@ func renderStep(step workflow.Step, memory map[string]string) (workflow.Step, er
 	if err != nil {
 		return workflow.Step{}, err
 	}
+	fallbacks := make([]string, 0, len(step.FallbackModels))
+	for _, m := range step.FallbackModels {
+		m, err = templating.RenderString(m, memory)
+		if err != nil {
+			return workflow.Step{}, err
+		}
+		fallbacks = append(fallbacks, m)
+	}
+	step.FallbackModels = fallbacks
 	step.Filename, err = templating.RenderString(step.Filename, memory)
 	if err != nil {
 		return workflow.Step{}, err
@@ -198,6 +598,74 @@ func renderStep(step workflow.Step, memory map[string]string) (workflow.Step, er
 	if err != nil {
 		return workflow.Step{}, err
 	}
+	attachments := make([]string, 0, len(step.Attachments))
+	for _, a := range step.Attachments {
+		a, err = templating.RenderString(a, memory)
+		if err != nil {
+			return workflow.Step{}, err
+		}
+		attachments = append(attachments, a)
+	}
+	step.Attachments = attachments
+	step.Input, err = templating.RenderString(step.Input, memory)
+	if err != nil {
+		return workflow.Step{}, err
+	}
+	step.Query, err = templating.RenderString(step.Query, memory)
+	if err != nil {
+		return workflow.Step{}, err
+	}
+	step.Documents, err = templating.RenderString(step.Documents, memory)
+	if err != nil {
+		return workflow.Step{}, err
+	}
+	step.Index, err = templating.RenderString(step.Index, memory)
+	if err != nil {
+		return workflow.Step{}, err
+	}
+	step.Command, err = templating.RenderString(step.Command, memory)
+	if err != nil {
+		return workflow.Step{}, err
+	}
+	args := make([]string, 0, len(step.Args))
+	for _, a := range step.Args {
+		a, err = templating.RenderString(a, memory)
+		if err != nil {
+			return workflow.Step{}, err
+		}
+		args = append(args, a)
+	}
+	step.Args = args
+	step.Stdin, err = templating.RenderString(step.Stdin, memory)
+	if err != nil {
+		return workflow.Step{}, err
+	}
+	step.Path, err = templating.RenderString(step.Path, memory)
+	if err != nil {
+		return workflow.Step{}, err
+	}
+	step.URL, err = templating.RenderString(step.URL, memory)
+	if err != nil {
+		return workflow.Step{}, err
+	}
+	if step.Headers != nil {
+		headers := make(map[string]string, len(step.Headers))
+		for k, v := range step.Headers {
+			headers[k], err = templating.RenderString(v, memory)
+			if err != nil {
+				return workflow.Step{}, err
+			}
+		}
+		step.Headers = headers
+	}
+	step.Body, err = templating.RenderString(step.Body, memory)
+	if err != nil {
+		return workflow.Step{}, err
+	}
+	step.JSON, err = renderJSON(step.JSON, memory)
+	if err != nil {
+		return workflow.Step{}, err
+	}
 	return step, nil
 }
 
@@ -297,16 +765,6 @@ func readClipboard() (string, error) {
 	}
 }
 
-func runSave(filename string, content string) (string, error) {
-	if filename == "" {
-		return "", errors.New("filename is required")
-	}
-	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
-		return "", err
-	}
-	return filename, nil
-}
-
 func runClipboard(content string) (string, error) {
 	if content == "" {
 		return "", errors.New("content is required")
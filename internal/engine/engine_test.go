@@ -0,0 +1,45 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadAttachments_DetectsMIMETypes(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"photo.PNG":   {0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'},
+		"notes.txt":   []byte("hello"),
+		"report":      []byte("%PDF-1.7\n"),
+		"unknown.zzz": []byte("plain words"),
+	}
+	var paths []string
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"photo.PNG", "notes.txt", "report", "unknown.zzz"} {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+
+	e := New(Dependencies{InputDir: dir})
+	got, err := e.loadAttachments(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"image/png", "text/plain", "application/pdf", "text/plain"}
+	for i, a := range got {
+		if a.MIMEType != want[i] {
+			t.Errorf("%s: MIME type %q, want %q", a.Name, a.MIMEType, want[i])
+		}
+	}
+	if got[0].Name != "photo.PNG" || string(got[1].Data) != "hello" {
+		t.Fatalf("unexpected attachments %+v", got[:2])
+	}
+
+	if _, err := e.loadAttachments([]string{filepath.Join(dir, "missing.png")}); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,111 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/workflow"
+)
+
+// modelProvider resolves a step's model aliases and fallbacks. It returns the
+// step with its primary model filled in, the bare provider (for capability
+// checks such as token counting) and the provider the step should call, which
+// meters usage, consults the response cache and walks the fallback chain.
+func (e *Engine) modelProvider(rs *runState, step workflow.Step) (workflow.Step, llm.Provider, llm.Provider, error) {
+	base, err := e.stepProvider(step)
+	if err != nil {
+		return step, nil, nil, err
+	}
+	chain := e.aliases.Resolve(append([]string{step.Model}, step.FallbackModels...))
+	if len(chain) == 0 {
+		return step, nil, nil, errors.New("model is required")
+	}
+	step.Model, step.FallbackModels = chain[0], chain[1:]
+
+	p := e.cached(rs, step, e.metered(rs, step, base))
+	if len(chain) == 1 {
+		return step, base, p, nil
+	}
+	f := &fallbackProvider{models: chain, p: p}
+	if sp, ok := p.(llm.StreamProvider); ok {
+		return step, base, &fallbackStreamProvider{fallbackProvider: f, sp: sp}, nil
+	}
+	return step, base, f, nil
+}
+
+// stepProvider returns the provider for a step: the fixture's fake with
+// --replay, the real one (wrapped to record calls with --record) otherwise.
+func (e *Engine) stepProvider(step workflow.Step) (llm.Provider, error) {
+	name := step.Provider
+	if name == "" {
+		name = workflow.ProviderGemini
+	}
+	if e.deps.Replay != nil {
+		return e.deps.Replay.Provider(step.ID, name), nil
+	}
+	p, err := e.provider(step.Provider)
+	if err != nil {
+		return nil, err
+	}
+	if e.deps.Record != nil {
+		p = e.deps.Record.Wrap(step.ID, name, p)
+	}
+	return p, nil
+}
+
+// retryable reports whether another model might succeed where this one failed.
+func retryable(err error) bool {
+	return errors.Is(err, llm.ErrModelNotFound) || errors.Is(err, llm.ErrQuotaExceeded) || errors.Is(err, llm.ErrBlocked)
+}
+
+// fallbackProvider sends each call to the first model in the chain that
+// hasn't failed yet. A model that fails with a retryable error is skipped for
+// the rest of the step, so tool loops and refine turns don't retry it.
+type fallbackProvider struct {
+	models []string
+	p      llm.Provider
+
+	mu      sync.Mutex
+	current int
+}
+
+func (f *fallbackProvider) Generate(ctx context.Context, req llm.Request) (llm.Response, error) {
+	return f.try(req, func(req llm.Request) (llm.Response, error) {
+		return f.p.Generate(ctx, req)
+	})
+}
+
+type fallbackStreamProvider struct {
+	*fallbackProvider
+	sp llm.StreamProvider
+}
+
+func (f *fallbackStreamProvider) GenerateStream(ctx context.Context, req llm.Request, onText func(string)) (llm.Response, error) {
+	return f.try(req, func(req llm.Request) (llm.Response, error) {
+		return f.sp.GenerateStream(ctx, req, onText)
+	})
+}
+
+func (f *fallbackProvider) try(req llm.Request, call func(llm.Request) (llm.Response, error)) (llm.Response, error) {
+	for {
+		f.mu.Lock()
+		i := f.current
+		f.mu.Unlock()
+
+		req.Model = f.models[i]
+		resp, err := call(req)
+		if err == nil || !retryable(err) || i == len(f.models)-1 {
+			return resp, err
+		}
+
+		f.mu.Lock()
+		if f.current == i {
+			f.current++
+		}
+		f.mu.Unlock()
+		fmt.Printf("    %s failed (%v), falling back to %s\n", f.models[i], err, f.models[i+1])
+	}
+}
@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"cli-gpt-flows/internal/llm"
+)
+
+// retiredProvider fails for one model and echoes the model name otherwise.
+type retiredProvider struct {
+	retired string
+	calls   []string
+}
+
+func (r *retiredProvider) Generate(_ context.Context, req llm.Request) (llm.Response, error) {
+	r.calls = append(r.calls, req.Model)
+	if req.Model == r.retired {
+		return llm.Response{}, fmt.Errorf("%w: %s", llm.ErrModelNotFound, req.Model)
+	}
+	return llm.Response{Text: req.Model}, nil
+}
+
+func TestFallbackProvider_SkipsFailedModel(t *testing.T) {
+	p := &retiredProvider{retired: "old"}
+	f := &fallbackProvider{models: []string{"old", "new"}, p: p}
+
+	for i := 0; i < 2; i++ {
+		resp, err := f.Generate(context.Background(), llm.Request{UserPrompt: "hi"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp.Text != "new" {
+			t.Fatalf("expected fallback model, got %q", resp.Text)
+		}
+	}
+	// The retired model is only tried once per step.
+	if fmt.Sprint(p.calls) != "[old new new]" {
+		t.Fatalf("unexpected calls %v", p.calls)
+	}
+}
+
+func TestFallbackProvider_StopsOnOtherErrors(t *testing.T) {
+	boom := errors.New("boom")
+	f := &fallbackProvider{models: []string{"a", "b"}, p: providerFunc(func(llm.Request) (llm.Response, error) {
+		return llm.Response{}, boom
+	})}
+	if _, err := f.Generate(context.Background(), llm.Request{}); !errors.Is(err, boom) {
+		t.Fatalf("expected the original error, got %v", err)
+	}
+}
+
+type providerFunc func(llm.Request) (llm.Response, error)
+
+func (f providerFunc) Generate(_ context.Context, req llm.Request) (llm.Response, error) {
+	return f(req)
+}
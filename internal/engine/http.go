@@ -0,0 +1,224 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cli-gpt-flows/internal/templating"
+	"cli-gpt-flows/internal/workflow"
+)
+
+const (
+	// defaultHTTPTimeout bounds each attempt of an http step without a timeout.
+	defaultHTTPTimeout = 30 * time.Second
+	// maxHTTPBody caps how much of a response body is kept in memory.
+	maxHTTPBody = 10 << 20
+)
+
+// httpRetryBackoff is the wait before the first retry; it doubles after that.
+var httpRetryBackoff = 500 * time.Millisecond
+
+// httpResult is the output of an http step, so prompts can use
+// `{{ ticket.status }}`, `{{ ticket.headers.Location }}`, `{{ ticket.body }}`
+// and, for JSON responses, `{{ ticket.json.id }}`.
+type httpResult struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	JSON    json.RawMessage   `json:"json,omitempty"`
+}
+
+// runHTTP sends the step's request, retrying network errors, 429 and 502-504
+// responses, and stores the response as JSON.
+func (e *Engine) runHTTP(ctx context.Context, step workflow.Step) (string, error) {
+	if e.deps.Remote && !e.deps.AllowHTTP {
+		return "", errors.New("http steps of remote recipes only run with --allow-http; review the recipe first")
+	}
+	if e.deps.Replay != nil && !e.deps.AllowSideEffects {
+		return "", errors.New("http steps don't run in replays and recipe tests unless side effects are allowed (--allow-side-effects, or allow_side_effects: true in the test case)")
+	}
+	method := strings.ToUpper(step.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	timeout := defaultHTTPTimeout
+	if step.Timeout != "" {
+		d, err := time.ParseDuration(step.Timeout)
+		if err != nil {
+			return "", fmt.Errorf("invalid timeout: %w", err)
+		}
+		timeout = d
+	}
+
+	var body []byte
+	contentType := ""
+	switch {
+	case step.JSON != nil:
+		b, err := json.Marshal(step.JSON)
+		if err != nil {
+			return "", fmt.Errorf("encode json body: %w", err)
+		}
+		body, contentType = b, "application/json"
+	case step.Body != "":
+		body = []byte(step.Body)
+	}
+	token := ""
+	if step.BearerTokenEnv != "" {
+		if !strings.HasPrefix(step.BearerTokenEnv, workflow.TokenEnvPrefix) {
+			return "", fmt.Errorf("bearer_token_env must start with %s", workflow.TokenEnvPrefix)
+		}
+		token = strings.TrimSpace(os.Getenv(step.BearerTokenEnv))
+		if token == "" {
+			return "", fmt.Errorf("%s is not set", step.BearerTokenEnv)
+		}
+	}
+
+	fmt.Printf("    %s %s\n", method, step.URL)
+	backoff := httpRetryBackoff
+	for attempt := 0; ; attempt++ {
+		res, retry, err := sendHTTP(ctx, method, step, body, contentType, token, timeout)
+		if err == nil && !retry {
+			if (res.Status < 200 || res.Status > 299) && !step.AllowFailure {
+				return "", fmt.Errorf("%s %s returned HTTP %d%s", method, step.URL, res.Status, bodyTail(res.Body))
+			}
+			b, err := json.Marshal(res)
+			if err != nil {
+				return "", err
+			}
+			return string(b), nil
+		}
+		if attempt >= step.Retries || (err != nil && !retry) {
+			if err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("%s %s returned HTTP %d after %d attempts%s", method, step.URL, res.Status, attempt+1, bodyTail(res.Body))
+		}
+		if err != nil {
+			fmt.Printf("    attempt %d failed (%v), retrying in %s\n", attempt+1, err, backoff)
+		} else {
+			fmt.Printf("    attempt %d returned HTTP %d, retrying in %s\n", attempt+1, res.Status, backoff)
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// sendHTTP makes one attempt. retry reports a response worth retrying.
+// Failures after the request was written are only retried for GET, since
+// the server may already have acted on a POST, PUT, PATCH or DELETE. The
+// exception is a 429 or 503 with Retry-After, where the server says it
+// turned the request away.
+func sendHTTP(ctx context.Context, method string, step workflow.Step, body []byte, contentType, token string, timeout time.Duration) (httpResult, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var wrote atomic.Bool
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { wrote.Store(true) },
+	})
+	safe := method == http.MethodGet
+
+	req, err := http.NewRequestWithContext(ctx, method, step.URL, bytes.NewReader(body))
+	if err != nil {
+		return httpResult{}, false, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range step.Headers {
+		req.Header.Set(k, v)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		retry := safe || !wrote.Load()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return httpResult{}, retry, fmt.Errorf("%s %s timed out after %s", method, step.URL, timeout)
+		}
+		// Network errors are retried; a cancelled run is not.
+		return httpResult{}, retry && ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPBody+1))
+	if err != nil {
+		return httpResult{}, safe, fmt.Errorf("read response: %w", err)
+	}
+	if len(data) > maxHTTPBody {
+		return httpResult{}, false, fmt.Errorf("response body is larger than %d MB", maxHTTPBody>>20)
+	}
+
+	res := httpResult{Status: resp.StatusCode, Headers: map[string]string{}, Body: string(data)}
+	for k, v := range resp.Header {
+		res.Headers[k] = strings.Join(v, ", ")
+	}
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") && json.Valid(data) {
+		res.JSON = data
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return res, safe || resp.Header.Get("Retry-After") != "", nil
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return res, safe, nil
+	}
+	return res, false, nil
+}
+
+// bodyTail is the start of an error response's body, for its error message.
+func bodyTail(body string) string {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return ""
+	}
+	const max = 500
+	if len(body) > max {
+		body = body[:max] + "..."
+	}
+	return ": " + body
+}
+
+// renderJSON renders the templates in every string of a json: body.
+func renderJSON(v any, memory map[string]string) (any, error) {
+	switch node := v.(type) {
+	case string:
+		return templating.RenderString(node, memory)
+	case map[string]any:
+		out := make(map[string]any, len(node))
+		for k, child := range node {
+			r, err := renderJSON(child, memory)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(node))
+		for i, child := range node {
+			r, err := renderJSON(child, memory)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cli-gpt-flows/internal/models"
+	"cli-gpt-flows/internal/usage"
+	"cli-gpt-flows/internal/workflow"
+)
+
+func TestRun_HTTPStepPostsJSONAndRetries(t *testing.T) {
+	defer func(d time.Duration) { httpRetryBackoff = d }(httpRetryBackoff)
+	httpRetryBackoff = time.Millisecond
+	t.Setenv("PALSGEMFLOWS_TOKEN_TICKETS", "secret")
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/tickets/acme" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if got := r.Header.Get("X-Source"); got != "pals" {
+			t.Errorf("X-Source = %q", got)
+		}
+		var body map[string]any
+		b, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &body); err != nil || body["title"] != "Spec for acme" || body["priority"] != float64(2) {
+			t.Errorf("body = %s (%v)", b, err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id": 42}`))
+	}))
+	defer srv.Close()
+
+	wf, err := workflow.LoadFromBytes("http.yaml", []byte(`
+name: http
+steps:
+  - id: customer
+    type: input
+  - id: ticket
+    type: http
+    method: post
+    url: "`+srv.URL+`/tickets/{{ customer }}"
+    headers:
+      X-Source: pals
+    json:
+      title: "Spec for {{ customer }}"
+      priority: 2
+    bearer_token_env: PALSGEMFLOWS_TOKEN_TICKETS
+    retries: 2
+  - id: id
+    type: shell
+    args: ["echo", "-n", "{{ ticket.json.id }}/{{ ticket.status }}"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(Dependencies{Prices: usage.Prices{}, Aliases: models.Aliases{}, Headless: true})
+	out, err := e.RunOutputs(context.Background(), wf, map[string]string{"customer": "acme"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected a retry, got %d calls", calls.Load())
+	}
+	if !strings.Contains(out["id"], `"stdout":"42/201"`) {
+		t.Fatalf("id = %s", out["id"])
+	}
+}
+
+func TestRun_HTTPStepFailsOnErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such ticket", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	for _, allow := range []bool{false, true} {
+		step := workflow.Step{ID: "get", Type: workflow.TypeHTTP, URL: srv.URL, AllowFailure: allow}
+		out, err := New(Dependencies{}).runHTTP(context.Background(), step)
+		if !allow {
+			if err == nil || !strings.Contains(err.Error(), "HTTP 404: no such ticket") {
+				t.Fatalf("error = %v", err)
+			}
+			continue
+		}
+		if err != nil || !strings.Contains(out, `"status":404`) {
+			t.Fatalf("allow_failure: out = %s, err = %v", out, err)
+		}
+	}
+}
+
+func TestRunHTTP_GuardsRemoteRecipesAndTokens(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	}))
+	defer srv.Close()
+	t.Setenv("GEMINI_API_KEY", "secret")
+
+	step := workflow.Step{ID: "get", Type: workflow.TypeHTTP, URL: srv.URL}
+	if _, err := New(Dependencies{Remote: true}).runHTTP(context.Background(), step); err == nil || !strings.Contains(err.Error(), "--allow-http") {
+		t.Fatalf("remote recipe: err = %v", err)
+	}
+
+	step.BearerTokenEnv = "GEMINI_API_KEY"
+	if _, err := New(Dependencies{}).runHTTP(context.Background(), step); err == nil || !strings.Contains(err.Error(), workflow.TokenEnvPrefix) {
+		t.Fatalf("bearer_token_env: err = %v", err)
+	}
+	_, err := workflow.LoadFromBytes("http.yaml", []byte(`
+name: http
+steps:
+  - id: get
+    type: http
+    url: "`+srv.URL+`"
+    bearer_token_env: GEMINI_API_KEY
+`))
+	if err == nil || !strings.Contains(err.Error(), workflow.TokenEnvPrefix) {
+		t.Fatalf("load: err = %v", err)
+	}
+}
+
+func TestRunHTTP_RetriesBrokenResponsesOnlyForGET(t *testing.T) {
+	defer func(d time.Duration) { httpRetryBackoff = d }(httpRetryBackoff)
+	httpRetryBackoff = time.Millisecond
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		// Promise more body than is sent, so reading the response fails.
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("short"))
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		method string
+		calls  int32
+	}{
+		{http.MethodPost, 1},
+		{http.MethodGet, 3},
+	} {
+		calls.Store(0)
+		step := workflow.Step{ID: "send", Type: workflow.TypeHTTP, Method: tc.method, URL: srv.URL, Retries: 2}
+		if _, err := New(Dependencies{}).runHTTP(context.Background(), step); err == nil || !strings.Contains(err.Error(), "read response") {
+			t.Fatalf("%s: err = %v", tc.method, err)
+		}
+		if calls.Load() != tc.calls {
+			t.Errorf("%s: %d calls, want %d", tc.method, calls.Load(), tc.calls)
+		}
+	}
+}
+
+func TestRunHTTP_RetriesGatewayErrorsOnlyForGET(t *testing.T) {
+	defer func(d time.Duration) { httpRetryBackoff = d }(httpRetryBackoff)
+	httpRetryBackoff = time.Millisecond
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		method string
+		calls  int32
+	}{
+		{http.MethodPost, 1},
+		{http.MethodGet, 3},
+	} {
+		calls.Store(0)
+		step := workflow.Step{ID: "send", Type: workflow.TypeHTTP, Method: tc.method, URL: srv.URL, Retries: 2}
+		if _, err := New(Dependencies{}).runHTTP(context.Background(), step); err == nil || !strings.Contains(err.Error(), "HTTP 502") {
+			t.Fatalf("%s: err = %v", tc.method, err)
+		}
+		if calls.Load() != tc.calls {
+			t.Errorf("%s: %d calls, want %d", tc.method, calls.Load(), tc.calls)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"cli-gpt-flows/internal/workflow"
+)
+
+const (
+	defaultReadMaxFiles = 50
+	defaultReadMaxBytes = 1 << 20
+)
+
+// readFile is one file loaded by a read_file step.
+type readFile struct {
+	Path     string `json:"path"`
+	Encoding string `json:"encoding"`
+	Content  string `json:"content"`
+}
+
+// runReadFile loads the file or glob of a read_file step. A plain path
+// stores the file's text; a glob stores a JSON list of {path, encoding,
+// content}, or with concat one text with a `--- path ---` header per file.
+func (e *Engine) runReadFile(step workflow.Step) (string, error) {
+	maxFiles, maxBytes := step.MaxFiles, step.MaxBytes
+	if maxFiles == 0 {
+		maxFiles = defaultReadMaxFiles
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultReadMaxBytes
+	}
+
+	pattern, err := e.readPath(step.Path)
+	if err != nil {
+		return "", err
+	}
+	glob := strings.ContainsAny(step.Path, "*?[")
+	paths := []string{pattern}
+	if glob {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return "", fmt.Errorf("invalid glob %s: %w", step.Path, err)
+		}
+		paths = paths[:0]
+		for _, m := range matches {
+			// A match may be a symlink out of the sandbox.
+			if err := e.checkReadable(m); err != nil {
+				return "", err
+			}
+			if st, err := os.Stat(m); err == nil && st.Mode().IsRegular() {
+				paths = append(paths, m)
+			}
+		}
+		if len(paths) == 0 {
+			return "", fmt.Errorf("no files match %s", step.Path)
+		}
+		sort.Strings(paths)
+	}
+	if len(paths) > maxFiles {
+		return "", fmt.Errorf("%s matches %d files, more than max_files (%d)", step.Path, len(paths), maxFiles)
+	}
+
+	var (
+		files []readFile
+		total int64
+	)
+	for _, path := range paths {
+		st, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		if st.IsDir() {
+			return "", fmt.Errorf("%s is a directory; use a glob such as %s", path, filepath.Join(path, "*.md"))
+		}
+		total += st.Size()
+		if total > maxBytes {
+			return "", fmt.Errorf("%s is larger than max_bytes (%d bytes in total)", step.Path, maxBytes)
+		}
+		b, err := e.readFile(path)
+		if err != nil {
+			return "", err
+		}
+		text, enc, err := decodeText(b)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", path, err)
+		}
+		files = append(files, readFile{Path: path, Encoding: enc, Content: text})
+	}
+
+	switch {
+	case step.Concat:
+		var b strings.Builder
+		for i, f := range files {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(&b, "--- %s ---\n%s", f.Path, f.Content)
+			if !strings.HasSuffix(f.Content, "\n") {
+				b.WriteString("\n")
+			}
+		}
+		return b.String(), nil
+	case !glob:
+		return files[0].Content, nil
+	default:
+		b, err := json.Marshal(files)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
+
+// decodeText turns file bytes into a string, detecting UTF-8 (with or
+// without BOM) and UTF-16 (by BOM), and falling back to Windows-1252 for
+// other 8-bit text. Files with NUL bytes are rejected as binary.
+func decodeText(b []byte) (string, string, error) {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xEF, 0xBB, 0xBF}):
+		b = b[3:]
+	case bytes.HasPrefix(b, []byte{0xFF, 0xFE}):
+		return decodeUTF16(b[2:], false), "utf-16le", nil
+	case bytes.HasPrefix(b, []byte{0xFE, 0xFF}):
+		return decodeUTF16(b[2:], true), "utf-16be", nil
+	}
+	if bytes.IndexByte(b, 0) >= 0 {
+		return "", "", errors.New("looks like a binary file")
+	}
+	if utf8.Valid(b) {
+		return string(b), "utf-8", nil
+	}
+	var sb strings.Builder
+	for _, c := range b {
+		if r, ok := cp1252[c]; ok {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteRune(rune(c))
+		}
+	}
+	return sb.String(), "windows-1252", nil
+}
+
+func decodeUTF16(b []byte, bigEndian bool) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		if bigEndian {
+			u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+		} else {
+			u = append(u, uint16(b[i+1])<<8|uint16(b[i]))
+		}
+	}
+	return string(utf16.Decode(u))
+}
+
+// cp1252 maps the Windows-1252 bytes that differ from Latin-1.
+var cp1252 = map[byte]rune{
+	0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡',
+	0x88: 'ˆ', 0x89: '‰', 0x8A: 'Š', 0x8B: '‹', 0x8C: 'Œ', 0x8E: 'Ž',
+	0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—',
+	0x98: '˜', 0x99: '™', 0x9A: 'š', 0x9B: '›', 0x9C: 'œ', 0x9E: 'ž', 0x9F: 'Ÿ',
+}
@@ -0,0 +1,69 @@
+package engine
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cli-gpt-flows/internal/workflow"
+)
+
+func TestRunReadFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"a.md":     []byte("\xEF\xBB\xBFalpha\n"),
+		"b.md":     {0xFF, 0xFE, 'b', 0, 'e', 0, 't', 0, 'a', 0},
+		"c.md":     []byte("caf\xe9 \x93quoted\x94"),
+		"skip.txt": []byte("not matched"),
+	}
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := New(Dependencies{OutputDir: dir})
+	glob := "*.md"
+
+	out, err := e.runReadFile(workflow.Step{Path: "a.md"})
+	if err != nil || out != "alpha\n" {
+		t.Fatalf("single file: %q, %v", out, err)
+	}
+
+	out, err = e.runReadFile(workflow.Step{Path: glob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []readFile
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[1].Content != "beta" || list[1].Encoding != "utf-16le" ||
+		list[2].Content != "café “quoted”" || list[2].Encoding != "windows-1252" {
+		t.Fatalf("glob: %+v", list)
+	}
+
+	out, err = e.runReadFile(workflow.Step{Path: glob, Concat: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "--- " + filepath.Join(dir, "a.md") + " ---\nalpha\n\n--- " + filepath.Join(dir, "b.md") + " ---\nbeta\n"
+	if !strings.HasPrefix(out, want) {
+		t.Fatalf("concat:\n%s", out)
+	}
+
+	for _, tc := range []struct {
+		step workflow.Step
+		want string
+	}{
+		{workflow.Step{Path: glob, MaxFiles: 2}, "more than max_files"},
+		{workflow.Step{Path: glob, MaxBytes: 10}, "larger than max_bytes"},
+		{workflow.Step{Path: "*.pdf"}, "no files match"},
+		{workflow.Step{Path: "."}, "is a directory"},
+	} {
+		if _, err := e.runReadFile(tc.step); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error = %v, want %q", tc.step.Path, err, tc.want)
+		}
+	}
+}
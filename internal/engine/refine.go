@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/workflow"
+)
+
+const refineHelp = "Type a change to request it, /show to print the current version, /undo to go back, or press Enter on an empty line to accept."
+
+// refineOrReplay runs the refine loop, recording the accepted version with
+// --record and taking it from the fixture with --replay. Headless runs and
+// recipes started by run_recipe keep the first version.
+func (e *Engine) refineOrReplay(ctx context.Context, rs *runState, p llm.Provider, step workflow.Step, req llm.Request, text string) (string, error) {
+	if e.deps.Replay != nil {
+		if refined, ok := e.deps.Replay.Refined(step.ID); ok {
+			return refined, nil
+		}
+		return text, nil
+	}
+	if e.deps.Headless || rs.depth > 0 {
+		return text, nil
+	}
+	out, err := e.refine(ctx, rs, p, step, req, text, os.Stdin)
+	if err == nil && e.deps.Record != nil {
+		e.deps.Record.RecordRefined(step.ID, out)
+	}
+	return out, err
+}
+
+// refine runs an interactive loop over a model output: every instruction is
+// sent as a follow-up turn (with the full history) and the reply becomes the
+// current version. Instructions are read from in. It returns the version the
+// user accepts.
+func (e *Engine) refine(ctx context.Context, rs *runState, p llm.Provider, step workflow.Step, req llm.Request, text string, in io.Reader) (string, error) {
+	history := append(append([]llm.Message(nil), req.History...),
+		llm.Message{Role: llm.RoleUser, Text: req.UserPrompt},
+		llm.Message{Role: llm.RoleModel, Text: text},
+	)
+	versions := []string{text}
+
+	if !streams(p, step) {
+		fmt.Println(text)
+	}
+	fmt.Printf("\n--- refine %s ---\n%s\n", step.ID, refineHelp)
+	reader := bufio.NewReader(in)
+	for {
+		fmt.Print("refine> ")
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		eof := errors.Is(err, io.EOF)
+		instruction := strings.TrimSpace(line)
+
+		switch instruction {
+		case "":
+			if eof {
+				fmt.Println()
+			}
+			fmt.Printf("--- accepted version %d of %s ---\n", len(versions), step.ID)
+			return versions[len(versions)-1], nil
+		case "/show":
+			fmt.Println(versions[len(versions)-1])
+			continue
+		case "/undo":
+			if len(versions) == 1 {
+				fmt.Println("Nothing to undo.")
+				continue
+			}
+			versions = versions[:len(versions)-1]
+			// Drop the last instruction/reply pair so the model forgets it too.
+			history = history[:len(history)-2]
+			fmt.Printf("Back to version %d.\n", len(versions))
+			continue
+		}
+
+		next := req
+		next.History = history
+		next.UserPrompt = instruction
+		// Attachments were sent with the first turn; the replies already reflect them.
+		next.Attachments = nil
+
+		out, err := e.generate(ctx, rs, p, step, next)
+		if err != nil {
+			return "", err
+		}
+		history = append(history,
+			llm.Message{Role: llm.RoleUser, Text: instruction},
+			llm.Message{Role: llm.RoleModel, Text: out},
+		)
+		versions = append(versions, out)
+		if !streams(p, step) {
+			fmt.Println(out)
+		}
+		if eof {
+			fmt.Printf("--- accepted version %d of %s ---\n", len(versions), step.ID)
+			return out, nil
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package engine
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/workflow"
+)
+
+func TestRefine_Commands(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		// histories is the History length of each follow-up call.
+		histories []int
+	}{
+		{name: "accept on empty line", input: "\n", want: "v1"},
+		{name: "accept on EOF", input: "", want: "v1"},
+		{name: "one change", input: "shorter\n\n", want: "v2 shorter", histories: []int{2}},
+		{name: "history grows", input: "shorter\nfunnier\n\n", want: "v3 funnier", histories: []int{2, 4}},
+		{name: "show does not call the model", input: "/show\n\n", want: "v1"},
+		{name: "undo", input: "shorter\n/undo\n\n", want: "v1", histories: []int{2}},
+		{name: "undo forgets the turn", input: "shorter\n/undo\nfunnier\n\n", want: "v2 funnier", histories: []int{2, 2}},
+		{name: "nothing to undo", input: "/undo\n\n", want: "v1"},
+		{name: "instruction then EOF", input: "shorter", want: "v2 shorter", histories: []int{2}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var histories []int
+			p := providerFunc(func(req llm.Request) (llm.Response, error) {
+				histories = append(histories, len(req.History))
+				if len(req.Attachments) > 0 {
+					t.Errorf("attachments were sent again")
+				}
+				return llm.Response{Text: "v" + string(rune('1'+len(req.History)/2)) + " " + req.UserPrompt}, nil
+			})
+			req := llm.Request{UserPrompt: "draft", Attachments: []llm.Attachment{{Name: "a.png"}}}
+			e := New(Dependencies{})
+			got, err := e.refine(context.Background(), newRunState(workflow.Workflow{}), p, workflow.Step{ID: "draft"}, req, "v1", strings.NewReader(tc.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("accepted %q, want %q", got, tc.want)
+			}
+			if len(histories) != len(tc.histories) {
+				t.Fatalf("model called with histories %v, want %v", histories, tc.histories)
+			}
+			for i := range histories {
+				if histories[i] != tc.histories[i] {
+					t.Fatalf("model called with histories %v, want %v", histories, tc.histories)
+				}
+			}
+		})
+	}
+}
+
+func TestRefineOrReplay_KeepsFirstVersionInChildRecipes(t *testing.T) {
+	p := providerFunc(func(llm.Request) (llm.Response, error) {
+		t.Fatal("the model should not be called")
+		return llm.Response{}, nil
+	})
+	rs := newRunState(workflow.Workflow{})
+	rs.depth = 1
+	got, err := New(Dependencies{}).refineOrReplay(context.Background(), rs, p, workflow.Step{ID: "draft"}, llm.Request{}, "v1")
+	if err != nil || got != "v1" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"cli-gpt-flows/internal/cache"
+	"cli-gpt-flows/internal/fixture"
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/models"
+	"cli-gpt-flows/internal/openai"
+	"cli-gpt-flows/internal/usage"
+	"cli-gpt-flows/internal/workflow"
+)
+
+func TestRun_ReplaysFixtureOffline(t *testing.T) {
+	outDir := t.TempDir()
+	out := filepath.Join(outDir, "fixed.md")
+	wf, err := workflow.LoadFromBytes("grammar.yaml", []byte(`
+name: grammar
+steps:
+  - id: transcript
+    type: input
+  - id: fix
+    type: gemini
+    model: gemini-2.5-flash
+    user_prompt: "Fix: {{ transcript }}"
+  - id: save
+    type: save
+    filename: fixed.md
+    content: "# Result\n{{ fix }}"
+  - id: copy
+    type: clipboard
+    content: "{{ fix }}"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fixture.Fixture{
+		Inputs: map[string]string{"transcript": "helo wrld"},
+		Calls: []fixture.Call{{
+			Step:     "fix",
+			Key:      cache.Key(workflow.ProviderGemini, "", llm.Request{Model: "gemini-2.5-flash", UserPrompt: "Fix: helo wrld"}),
+			Response: llm.Response{Text: "hello world"},
+		}},
+	}
+	dir := t.TempDir()
+	if err := f.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := fixture.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := New(Dependencies{Prices: usage.Prices{}, Aliases: models.Aliases{}, Replay: fixture.NewReplayer(loaded), OutputDir: outDir})
+	if err := e.Run(context.Background(), wf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "# Result\nhello world" {
+		t.Fatalf("unexpected saved file %q", b)
+	}
+
+	// A changed input changes the prompt, which the fixture doesn't know.
+	loaded.Inputs["transcript"] = "something else"
+	e = New(Dependencies{Prices: usage.Prices{}, Aliases: models.Aliases{}, Replay: fixture.NewReplayer(loaded), OutputDir: outDir})
+	err = e.Run(context.Background(), wf)
+	if err == nil || !strings.Contains(err.Error(), "no recorded response") {
+		t.Fatalf("expected a missing-recording error, got %v", err)
+	}
+}
+
+func TestRun_ReplaysFallbackFromFailedModel(t *testing.T) {
+	wf, err := workflow.LoadFromBytes("fallback.yaml", []byte(`
+name: fallback
+steps:
+  - id: fix
+    type: gemini
+    model: [retired-model, gemini-2.5-flash]
+    stream: false
+    user_prompt: "Fix: helo"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Record the calls of a run whose primary model is gone.
+	rec := fixture.NewRecorder()
+	p := rec.Wrap("fix", workflow.ProviderGemini, providerFunc(func(req llm.Request) (llm.Response, error) {
+		if req.Model == "retired-model" {
+			return llm.Response{}, fmt.Errorf("%w: models/retired-model is not found", llm.ErrModelNotFound)
+		}
+		return llm.Response{Text: "hello"}, nil
+	}))
+	for _, model := range []string{"retired-model", "gemini-2.5-flash"} {
+		_, _ = p.Generate(context.Background(), llm.Request{Model: model, UserPrompt: "Fix: helo"})
+	}
+	dir := filepath.Join(t.TempDir(), "fixture")
+	if err := rec.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" {
+		for path, want := range map[string]os.FileMode{dir: 0o700, filepath.Join(dir, fixture.FileName): 0o600} {
+			if st, err := os.Stat(path); err != nil || st.Mode().Perm() != want {
+				t.Fatalf("%s: expected mode %v, got %v (%v)", path, want, st.Mode().Perm(), err)
+			}
+		}
+	}
+
+	loaded, err := fixture.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(Dependencies{Prices: usage.Prices{}, Aliases: models.Aliases{}, Replay: fixture.NewReplayer(loaded)})
+	out, err := e.RunOutputs(context.Background(), wf, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out["fix"] != "hello" {
+		t.Fatalf("expected the fallback's answer, got %q", out["fix"])
+	}
+}
+
+func TestRun_RecordsAndReplaysEmbeddings(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req struct {
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		vecs, _ := wordProvider{}.Embed(r.Context(), "", req.Input)
+		var data []map[string]any
+		for i, v := range vecs {
+			data = append(data, map[string]any{"index": i, "embedding": v})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+	}))
+	defer srv.Close()
+
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "specs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{"acme.md": "A portal for Acme.", "globex.md": "A mobile app for Globex."} {
+		if err := os.WriteFile(filepath.Join(root, "specs", name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wf := workflow.Workflow{Name: "emb", MaxTokens: 100000, Steps: []workflow.Step{
+		{ID: "context", Type: workflow.TypeRetrieve, Provider: workflow.ProviderOpenAI, Query: "customer portal", Documents: "specs", TopK: 1},
+		{ID: "vectors", Type: workflow.TypeEmbed, Provider: workflow.ProviderOpenAI, Input: "mobile billing"},
+	}}
+
+	rec := fixture.NewRecorder()
+	rs := newRunState(wf)
+	e := New(Dependencies{Prices: usage.Prices{}, Aliases: models.Aliases{}, OpenAI: openai.NewClient(srv.URL, "", srv.Client()), Record: rec, OutputDir: root, Headless: true})
+	if err := e.run(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := rs.ledger.total("vectors"); u.TotalTokens == 0 {
+		t.Fatal("embedding calls were not recorded on the ledger")
+	}
+	recorded := rs.memory
+	dir := filepath.Join(t.TempDir(), "fixture")
+	if err := rec.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	before := calls.Load()
+	loaded, err := fixture.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = New(Dependencies{Prices: usage.Prices{}, Aliases: models.Aliases{}, Replay: fixture.NewReplayer(loaded), OutputDir: root})
+	out, err := e.RunOutputs(context.Background(), wf, nil)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if calls.Load() != before {
+		t.Fatal("replay contacted the provider")
+	}
+	for _, id := range []string{"context", "vectors"} {
+		if out[id] != recorded[id] {
+			t.Errorf("%s: replayed %q, recorded %q", id, out[id], recorded[id])
+		}
+	}
+}
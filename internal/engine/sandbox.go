@@ -0,0 +1,188 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sandboxPath resolves a (rendered) path a step writes against the output
+// directory. Unless AllowAnyPath is set, absolute paths, `..` components and
+// symlinks that lead out of the directory are rejected, so a recipe can't
+// reach files such as ~/.ssh/authorized_keys.
+func (e *Engine) sandboxPath(path string) (string, error) {
+	return e.sandboxIn(e.writeRoot(), path)
+}
+
+// readPath is sandboxPath for a path a step reads, resolved against the
+// input directory.
+func (e *Engine) readPath(path string) (string, error) {
+	return e.sandboxIn(e.readRoot(), path)
+}
+
+func (e *Engine) writeRoot() string {
+	if e.deps.OutputDir == "" {
+		return "."
+	}
+	return e.deps.OutputDir
+}
+
+func (e *Engine) readRoot() string {
+	if e.deps.InputDir == "" {
+		return e.writeRoot()
+	}
+	return e.deps.InputDir
+}
+
+func (e *Engine) sandboxIn(root, path string) (string, error) {
+	if strings.TrimSpace(path) == "" {
+		return "", errors.New("path is empty")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	if e.deps.AllowAnyPath {
+		if filepath.IsAbs(path) {
+			return filepath.Clean(path), nil
+		}
+		return filepath.Join(root, path), nil
+	}
+
+	if filepath.IsAbs(path) || filepath.VolumeName(path) != "" || strings.HasPrefix(path, "/") || strings.HasPrefix(path, `\`) {
+		return "", fmt.Errorf("%s: absolute paths are not allowed; use a path inside %s (or --allow-any-path)", path, root)
+	}
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return "", fmt.Errorf("%s: paths may not contain ..; use a path inside %s (or --allow-any-path)", path, root)
+		}
+	}
+
+	full := filepath.Join(root, path)
+	realRoot, err := resolveExisting(root)
+	if err != nil {
+		return "", err
+	}
+	real, err := resolveExisting(full)
+	if err != nil {
+		return "", err
+	}
+	if !within(realRoot, real) {
+		return "", fmt.Errorf("%s: leads out of %s through a symlink (use --allow-any-path)", path, root)
+	}
+	return full, nil
+}
+
+// resolveExisting evaluates the symlinks of the longest existing prefix of
+// path and appends the rest, so paths that don't exist yet can be checked.
+func resolveExisting(path string) (string, error) {
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// readPaths is readPath for a list of paths.
+func (e *Engine) readPaths(paths []string) ([]string, error) {
+	out := make([]string, 0, len(paths))
+	for _, p := range paths {
+		p, err := e.readPath(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// checkReadable rejects an absolute path, such as a glob match, that
+// resolves to a file outside the input directory.
+func (e *Engine) checkReadable(path string) error {
+	if e.deps.AllowAnyPath {
+		return nil
+	}
+	root, err := filepath.Abs(e.readRoot())
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+	_, err = e.readPath(rel)
+	return err
+}
+
+// openRead opens a path readPath or checkReadable accepted. A symlink swapped
+// in between the check and the open could still lead out of the input
+// directory, so the opened file is checked again.
+func (e *Engine) openRead(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.checkOpened(f, e.readRoot()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// readFile is os.ReadFile through openRead.
+func (e *Engine) readFile(path string) ([]byte, error) {
+	f, err := e.openRead(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// checkOpened rejects an open file that is not the file its name resolves
+// to inside root, which happens when a path component was replaced by a
+// symlink after the path was checked.
+func (e *Engine) checkOpened(f *os.File, root string) error {
+	if e.deps.AllowAnyPath {
+		return nil
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	realRoot, err := resolveExisting(root)
+	if err != nil {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(f.Name())
+	if err != nil {
+		return err
+	}
+	opened, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	named, err := os.Stat(real)
+	if err != nil {
+		return err
+	}
+	if !within(realRoot, real) || !os.SameFile(opened, named) {
+		return fmt.Errorf("%s: leads out of %s through a symlink (use --allow-any-path)", f.Name(), root)
+	}
+	return nil
+}
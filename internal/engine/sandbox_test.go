@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"cli-gpt-flows/internal/workflow"
+)
+
+func TestSandboxPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := New(Dependencies{OutputDir: root})
+
+	for _, path := range []string{"spec.md", "out/new/spec.md", "./b.md"} {
+		got, err := e.sandboxPath(path)
+		if err != nil || !strings.HasPrefix(got, root) {
+			t.Errorf("%s: got %q, %v", path, got, err)
+		}
+	}
+	bad := map[string]string{
+		filepath.Join(outside, "x"):       "absolute paths",
+		"../../.ssh/authorized_keys":      "may not contain ..",
+		"notes/../../etc/passwd":          "may not contain ..",
+		`..\..\windows\system.ini`:        "may not contain ..",
+		"link/authorized_keys":            "symlink",
+		"link/deeper/dir/authorized_keys": "symlink",
+	}
+	for path, want := range bad {
+		if runtime.GOOS == "windows" && strings.HasPrefix(path, "link/") {
+			continue
+		}
+		if _, err := e.sandboxPath(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error = %v, want %q", path, err, want)
+		}
+	}
+
+	free := New(Dependencies{OutputDir: root, AllowAnyPath: true})
+	if got, err := free.sandboxPath(filepath.Join(outside, "x")); err != nil || got != filepath.Join(outside, "x") {
+		t.Errorf("allow any path: %q, %v", got, err)
+	}
+}
+
+func TestRunSave_RejectsTraversal(t *testing.T) {
+	root := t.TempDir()
+	e := New(Dependencies{OutputDir: filepath.Join(root, "out")})
+	_, err := e.runSave(workflow.Step{Filename: "../escaped.md", Content: "x"})
+	if err == nil || !strings.Contains(err.Error(), "..") {
+		t.Fatalf("error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped.md")); !os.IsNotExist(err) {
+		t.Fatal("file was written outside the output directory")
+	}
+}
+
+func TestOpenRead_RejectsSymlinkSwappedInAfterCheck(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "notes"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	e := New(Dependencies{OutputDir: root})
+	path, err := e.readPath("notes/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The directory passed the check; now it becomes a symlink out.
+	if err := os.Remove(filepath.Join(root, "notes")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "notes")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.readFile(path); err == nil || !strings.Contains(err.Error(), "symlink") {
+		t.Fatalf("read: error = %v", err)
+	}
+	if err := e.appendFile(path, []byte("x")); err == nil || !strings.Contains(err.Error(), "symlink") {
+		t.Fatalf("append: error = %v", err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(outside, "secret")); string(b) != "key" {
+		t.Fatalf("secret changed to %q", b)
+	}
+}
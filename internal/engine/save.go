@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cli-gpt-flows/internal/workflow"
+)
+
+// maxSaveVersions bounds the name-N suffixes tried by mode: version.
+const maxSaveVersions = 10000
+
+// linkFile is os.Link; tests replace it to mimic file systems without hard
+// links.
+var linkFile = os.Link
+
+// saveResult describes a finished save step. Path is the step output, so
+// `{{ save_step }}` still works as a filename; Bytes is stored under
+// `save_step.bytes`.
+type saveResult struct {
+	Path  string
+	Bytes int
+}
+
+// runSave writes the step's content according to its mode, creating parent
+// directories. Everything but append replaces the target atomically, so a
+// crash never leaves a half-written file.
+func (e *Engine) runSave(step workflow.Step) (saveResult, error) {
+	if step.Filename == "" {
+		return saveResult{}, errors.New("filename is required")
+	}
+	path, err := e.sandboxPath(step.Filename)
+	if err != nil {
+		return saveResult{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return saveResult{}, err
+	}
+	// Check again now that the parents exist, in case one of them was
+	// replaced by a symlink in the meantime.
+	if _, err := e.sandboxPath(step.Filename); err != nil {
+		return saveResult{}, err
+	}
+
+	data := []byte(step.Content)
+	switch step.Mode {
+	case "", workflow.SaveOverwrite:
+		err = writeAtomic(path, data, true)
+	case workflow.SaveCreateOnly:
+		err = writeAtomic(path, data, false)
+		if errors.Is(err, fs.ErrExist) {
+			err = fmt.Errorf("%s already exists (mode: create_only)", path)
+		}
+	case workflow.SaveVersion:
+		path, err = writeVersion(path, data)
+	case workflow.SaveAppend:
+		err = e.appendFile(path, data)
+	default:
+		err = fmt.Errorf("unsupported save mode: %s", step.Mode)
+	}
+	if err != nil {
+		return saveResult{}, err
+	}
+
+	return saveResult{Path: path, Bytes: len(data)}, nil
+}
+
+// writeAtomic writes data to a temporary file next to path and moves it into
+// place, keeping the mode of a file it replaces. Without overwrite it fails
+// with fs.ErrExist when path exists.
+func writeAtomic(path string, data []byte, overwrite bool) error {
+	mode := fs.FileMode(0o644)
+	if overwrite {
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+			mode = fi.Mode().Perm()
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		return err
+	}
+	if overwrite {
+		return os.Rename(tmp, path)
+	}
+	// A hard link fails if path exists, unlike rename, so concurrent runs
+	// can't both claim the same name.
+	if err := linkFile(tmp, path); err != nil {
+		if _, statErr := os.Lstat(path); statErr == nil {
+			return fs.ErrExist
+		}
+		// FAT, exFAT, SMB and some NFS or Android file systems have no hard
+		// links; claim the name with O_EXCL instead.
+		return createExclusive(path, data)
+	}
+	return nil
+}
+
+// createExclusive writes data to path, which must not exist yet. A failed
+// write removes the partial file.
+func createExclusive(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// writeVersion writes path, or the first free name-N.ext next to it.
+func writeVersion(path string, data []byte) (string, error) {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	candidate := path
+	for n := 1; n <= maxSaveVersions; n++ {
+		err := writeAtomic(candidate, data, false)
+		if err == nil {
+			return candidate, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s-%d%s", stem, n, ext)
+	}
+	return "", fmt.Errorf("no free version of %s", path)
+}
+
+// appendFile adds data to the end of path, first checking the opened file
+// is still inside the output directory.
+func (e *Engine) appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := e.checkOpened(f, e.writeRoot()); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cli-gpt-flows/internal/models"
+	"cli-gpt-flows/internal/usage"
+	"cli-gpt-flows/internal/workflow"
+)
+
+func TestRunSave_Modes(t *testing.T) {
+	dir := t.TempDir()
+	e := New(Dependencies{OutputDir: dir})
+	save := func(mode, content string) (saveResult, error) {
+		return e.runSave(workflow.Step{Filename: "out/spec.md", Content: content, Mode: mode})
+	}
+	read := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(dir, "out", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	res, err := save("", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Path != filepath.Join(dir, "out", "spec.md") || res.Bytes != 3 {
+		t.Fatalf("result = %+v", res)
+	}
+	if _, err := save(workflow.SaveOverwrite, "two"); err != nil || read("spec.md") != "two" {
+		t.Fatalf("overwrite: %q, %v", read("spec.md"), err)
+	}
+	if _, err := save(workflow.SaveAppend, "+three"); err != nil || read("spec.md") != "two+three" {
+		t.Fatalf("append: %q, %v", read("spec.md"), err)
+	}
+	if _, err := save(workflow.SaveCreateOnly, "four"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("create_only: %v", err)
+	}
+	for i, want := range []string{"spec-1.md", "spec-2.md"} {
+		res, err := save(workflow.SaveVersion, want)
+		if err != nil || filepath.Base(res.Path) != want || read(want) != want {
+			t.Fatalf("version %d: %+v, %v", i, res, err)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestRun_SaveOutputIsThePath(t *testing.T) {
+	dir := t.TempDir()
+	wf, err := workflow.LoadFromBytes("save.yaml", []byte(`
+name: save
+steps:
+  - id: spec
+    type: save
+    filename: spec.md
+    content: "hello"
+  - id: copy
+    type: save
+    filename: copy.txt
+    content: "{{ spec }} {{ spec.bytes }}"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(Dependencies{OutputDir: dir, Prices: usage.Prices{}, Aliases: models.Aliases{}, Headless: true})
+	out, err := e.RunOutputs(context.Background(), wf, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	path := filepath.Join(dir, "spec.md")
+	if out["spec"] != path {
+		t.Fatalf("spec = %q, want %q", out["spec"], path)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "copy.txt"))
+	if err != nil || string(b) != path+" 5" {
+		t.Fatalf("copy = %q, %v", b, err)
+	}
+}
+
+func TestWriteAtomic_KeepsModeAndWorksWithoutHardLinks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.md")
+	if err := os.WriteFile(path, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAtomic(path, []byte("new"), true); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("mode after overwrite = %v, %v", fi.Mode(), err)
+	}
+
+	defer func(link func(string, string) error) { linkFile = link }(linkFile)
+	linkFile = func(string, string) error { return errors.New("operation not permitted") }
+	fresh := filepath.Join(dir, "fresh.md")
+	if err := writeAtomic(fresh, []byte("fresh"), false); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(fresh); err != nil || string(b) != "fresh" {
+		t.Fatalf("fresh = %q, %v", b, err)
+	}
+	if err := writeAtomic(fresh, []byte("again"), false); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("second create: %v", err)
+	}
+}
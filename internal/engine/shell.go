@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"cli-gpt-flows/internal/workflow"
+)
+
+// defaultShellTimeout bounds shell steps without a timeout.
+const defaultShellTimeout = 60 * time.Second
+
+// shellResult is the output of a shell step, so prompts can use
+// `{{ build.stdout }}`, `{{ build.stderr }}` and `{{ build.exit_code }}`.
+type shellResult struct {
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exit_code"`
+}
+
+// runShell runs the step's command and stores its output as JSON.
+func (e *Engine) runShell(ctx context.Context, step workflow.Step) (string, error) {
+	if e.deps.Remote && !e.deps.AllowShell {
+		return "", errors.New("shell steps of remote recipes only run with --allow-shell; review the recipe first")
+	}
+	if e.deps.Replay != nil && !e.deps.AllowSideEffects {
+		return "", errors.New("shell steps don't run in replays and recipe tests unless side effects are allowed (--allow-side-effects, or allow_side_effects: true in the test case)")
+	}
+
+	timeout := defaultShellTimeout
+	if step.Timeout != "" {
+		d, err := time.ParseDuration(step.Timeout)
+		if err != nil {
+			return "", fmt.Errorf("invalid timeout: %w", err)
+		}
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if len(step.Args) > 0 {
+		fmt.Printf("    $ %s\n", strings.Join(step.Args, " "))
+		cmd = exec.CommandContext(ctx, step.Args[0], step.Args[1:]...)
+	} else {
+		fmt.Printf("    $ %s\n", step.Command)
+		if runtime.GOOS == "windows" {
+			cmd = exec.CommandContext(ctx, "cmd", "/C", step.Command)
+		} else {
+			cmd = exec.CommandContext(ctx, "sh", "-c", step.Command)
+		}
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if step.Stdin != "" {
+		cmd.Stdin = strings.NewReader(step.Stdin)
+	}
+	// Don't wait forever on children that inherited the pipes.
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	res := shellResult{Stdout: stdout.String(), Stderr: stderr.String()}
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return "", fmt.Errorf("command timed out after %s", timeout)
+	case errors.As(err, &exitErr):
+		res.ExitCode = exitErr.ExitCode()
+		if !step.AllowFailure {
+			return "", fmt.Errorf("command exited with code %d%s", res.ExitCode, stderrTail(res.Stderr))
+		}
+	case err != nil:
+		return "", err
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// stderrTail is the end of a failed command's stderr, for its error message.
+func stderrTail(stderr string) string {
+	stderr = strings.TrimSpace(stderr)
+	if stderr == "" {
+		return ""
+	}
+	const max = 500
+	if len(stderr) > max {
+		stderr = "..." + stderr[len(stderr)-max:]
+	}
+	return ": " + stderr
+}
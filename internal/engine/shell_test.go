@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+
+	"cli-gpt-flows/internal/models"
+	"cli-gpt-flows/internal/usage"
+	"cli-gpt-flows/internal/workflow"
+)
+
+func TestRun_ShellSteps(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	wf, err := workflow.LoadFromBytes("shell.yaml", []byte(`
+name: shell
+steps:
+  - id: name
+    type: input
+  - id: echo
+    type: shell
+    args: ["cat"]
+    stdin: "hello {{ name }}"
+  - id: piped
+    type: shell
+    command: "printf '%s' '{{ echo.stdout }}' | tr a-z A-Z; echo oops >&2"
+  - id: lint
+    type: shell
+    command: "exit 3"
+    allow_failure: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := New(Dependencies{Prices: usage.Prices{}, Aliases: models.Aliases{}, Headless: true})
+	out, err := e.RunOutputs(context.Background(), wf, map[string]string{"name": "acme"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := `{"stdout":"hello acme","stderr":"","exit_code":0}`; out["echo"] != want {
+		t.Errorf("echo = %s, want %s", out["echo"], want)
+	}
+	if want := `{"stdout":"HELLO ACME","stderr":"oops\n","exit_code":0}`; out["piped"] != want {
+		t.Errorf("piped = %s, want %s", out["piped"], want)
+	}
+	if !strings.Contains(out["lint"], `"exit_code":3`) {
+		t.Errorf("lint = %s", out["lint"])
+	}
+}
+
+func TestRun_ShellStepFailures(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	for _, tc := range []struct {
+		name, step string
+		deps       Dependencies
+		want       string
+	}{
+		{"exit code", `command: "echo broken >&2; exit 2"`, Dependencies{}, "exited with code 2: broken"},
+		{"timeout", "args: [sleep, \"5\"]\n    timeout: 50ms", Dependencies{}, "timed out after 50ms"},
+		{"remote", `command: "true"`, Dependencies{Remote: true}, "--allow-shell"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			wf, err := workflow.LoadFromBytes("shell.yaml", []byte("name: shell\nsteps:\n  - id: run\n    type: shell\n    "+tc.step+"\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.deps.Prices, tc.deps.Aliases = usage.Prices{}, models.Aliases{}
+			err = New(tc.deps).Run(context.Background(), wf)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error = %v, want it to contain %q", err, tc.want)
+			}
+		})
+	}
+}
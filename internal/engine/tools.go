@@ -0,0 +1,374 @@
+package engine
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/templating"
+	"cli-gpt-flows/internal/workflow"
+)
+
+const (
+	// defaultMaxToolCalls bounds the call/answer loop unless max_tool_calls is set.
+	defaultMaxToolCalls = 10
+	// maxToolReadBytes caps what read_file hands back to the model.
+	maxToolReadBytes = 256 << 10
+	// maxRecipeDepth stops run_recipe from recursing forever.
+	maxRecipeDepth = 3
+)
+
+var toolDecls = map[string]llm.Tool{
+	workflow.ToolReadFile: {
+		Name:        workflow.ToolReadFile,
+		Description: "Read a text file from an allowed directory.",
+		Parameters: map[string]any{
+			"type":     "object",
+			"required": []any{"path"},
+			"properties": map[string]any{
+				"path": map[string]any{"type": "string", "description": "File path, relative to an allowed directory."},
+			},
+		},
+	},
+	workflow.ToolLookup: {
+		Name:        workflow.ToolLookup,
+		Description: "Look up data in a local JSON or CSV file. For JSON pass a dotted path (e.g. customers.0.name); for CSV pass a column and value to get the matching rows.",
+		Parameters: map[string]any{
+			"type":     "object",
+			"required": []any{"file"},
+			"properties": map[string]any{
+				"file":   map[string]any{"type": "string", "description": "JSON or CSV file, relative to an allowed directory."},
+				"path":   map[string]any{"type": "string", "description": "JSON only: dotted path to read."},
+				"column": map[string]any{"type": "string", "description": "CSV only: column to match."},
+				"value":  map[string]any{"type": "string", "description": "CSV only: value the column must equal."},
+			},
+		},
+	},
+	workflow.ToolRunRecipe: {
+		Name:        workflow.ToolRunRecipe,
+		Description: "Run another local recipe and return the output of its last step. Values for its input steps are passed by step id.",
+		Parameters: map[string]any{
+			"type":     "object",
+			"required": []any{"recipe"},
+			"properties": map[string]any{
+				"recipe": map[string]any{"type": "string", "description": "Recipe file, relative to an allowed directory."},
+				"inputs": map[string]any{"type": "object", "description": "Values for the recipe's input steps, keyed by step id."},
+			},
+		},
+	},
+}
+
+// generateWithTools runs the function-calling loop: as long as the model asks
+// for tools, they are executed locally and their results sent back, until the
+// model answers with text.
+func (e *Engine) generateWithTools(ctx context.Context, rs *runState, p llm.Provider, step workflow.Step, req llm.Request) (string, error) {
+	for _, t := range step.Tools {
+		req.Tools = append(req.Tools, toolDecls[t.Name])
+	}
+	maxCalls := defaultMaxToolCalls
+	if step.MaxToolCalls > 0 {
+		maxCalls = step.MaxToolCalls
+	}
+
+	// Work on a copy so the caller's history isn't touched.
+	req.History = append([]llm.Message(nil), req.History...)
+	calls := 0
+	for {
+		resp, err := p.Generate(ctx, req)
+		if err != nil {
+			return "", err
+		}
+		if len(resp.ToolCalls) == 0 {
+			return resp.Text, nil
+		}
+		calls += len(resp.ToolCalls)
+		if calls > maxCalls {
+			return "", fmt.Errorf("model exceeded max_tool_calls (%d)", maxCalls)
+		}
+
+		// The prompt (and attachments) become history; from now on the tool
+		// results are the turn being sent.
+		if req.UserPrompt != "" || len(req.Attachments) > 0 {
+			req.History = append(req.History, llm.Message{Role: llm.RoleUser, Text: req.UserPrompt})
+			req.UserPrompt = ""
+			req.Attachments = nil
+		}
+		req.History = append(req.History, llm.Message{Role: llm.RoleModel, Text: resp.Text, ToolCalls: resp.ToolCalls})
+
+		results := make([]llm.ToolResult, 0, len(resp.ToolCalls))
+		for _, call := range resp.ToolCalls {
+			results = append(results, llm.ToolResult{
+				CallID: call.ID,
+				Name:   call.Name,
+				Output: e.callTool(ctx, rs, step, call),
+			})
+		}
+		req.History = append(req.History, llm.Message{Role: llm.RoleUser, ToolResults: results})
+	}
+}
+
+// callTool executes one tool call and logs it. Failures are reported back to
+// the model as {"error": ...} so it can recover, rather than failing the step.
+func (e *Engine) callTool(ctx context.Context, rs *runState, step workflow.Step, call llm.ToolCall) map[string]any {
+	start := time.Now()
+	args, _ := json.Marshal(call.Args)
+
+	var (
+		cfg   workflow.ToolConfig
+		found bool
+	)
+	for _, t := range step.Tools {
+		if t.Name == call.Name {
+			cfg, found = t, true
+			break
+		}
+	}
+
+	var (
+		out  map[string]any
+		dirs []string
+		err  error
+	)
+	if found {
+		dirs, err = e.toolDirs(cfg.AllowDirs)
+	}
+	switch {
+	case err != nil:
+	case !found:
+		err = fmt.Errorf("tool %s is not enabled for this step", call.Name)
+	case call.Name == workflow.ToolReadFile:
+		out, err = e.toolReadFile(dirs, call.Args)
+	case call.Name == workflow.ToolLookup:
+		out, err = e.toolLookup(dirs, call.Args)
+	case call.Name == workflow.ToolRunRecipe:
+		out, err = e.toolRunRecipe(ctx, rs, dirs, call.Args)
+	default:
+		err = fmt.Errorf("unknown tool %s", call.Name)
+	}
+
+	durationMs := time.Since(start).Milliseconds()
+	if e.deps.Analytics != nil {
+		e.deps.Analytics.ToolCalled(rs.wf.Name, step.ID, call.Name, durationMs, err == nil)
+	}
+	if err != nil {
+		fmt.Printf("    tool %s %s -> error: %v (%dms)\n", call.Name, args, err, durationMs)
+		return map[string]any{"error": err.Error()}
+	}
+	fmt.Printf("    tool %s %s -> ok (%dms)\n", call.Name, args, durationMs)
+	return out
+}
+
+// toolDirs resolves a tool's allow_dirs like any other path a step reads:
+// unless AllowAnyPath is set they must lie inside the input directory, so a
+// recipe from the remote catalog can't open "/" or the home directory to the
+// model.
+func (e *Engine) toolDirs(dirs []string) ([]string, error) {
+	out := make([]string, 0, len(dirs))
+	for _, d := range dirs {
+		p, err := e.readPath(strings.TrimSpace(d))
+		if err != nil {
+			return nil, fmt.Errorf("allow_dirs: %w", err)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// toolPath resolves a path the model passed to a tool within dirs and checks
+// the result is still inside the input directory.
+func (e *Engine) toolPath(dirs []string, path string) (string, error) {
+	p, err := resolveAllowed(dirs, path)
+	if err != nil {
+		return "", err
+	}
+	if err := e.checkReadable(p); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+func (e *Engine) toolReadFile(dirs []string, args map[string]any) (map[string]any, error) {
+	path, err := e.toolPath(dirs, stringArg(args, "path"))
+	if err != nil {
+		return nil, err
+	}
+	f, err := e.openRead(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(io.LimitReader(f, maxToolReadBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	truncated := len(b) > maxToolReadBytes
+	if truncated {
+		b = b[:maxToolReadBytes]
+	}
+	return map[string]any{"content": string(b), "truncated": truncated}, nil
+}
+
+func (e *Engine) toolLookup(dirs []string, args map[string]any) (map[string]any, error) {
+	path, err := e.toolPath(dirs, stringArg(args, "file"))
+	if err != nil {
+		return nil, err
+	}
+	b, err := e.readFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		key := stringArg(args, "path")
+		if key == "" {
+			return map[string]any{"value": string(b)}, nil
+		}
+		val, ok := templating.Lookup(map[string]string{"file": string(b)}, "file."+key)
+		if !ok {
+			return nil, fmt.Errorf("path %s not found", key)
+		}
+		return map[string]any{"value": val}, nil
+	case ".csv":
+		column, value := stringArg(args, "column"), stringArg(args, "value")
+		if column == "" {
+			return nil, errors.New("column is required for CSV files")
+		}
+		records, err := csv.NewReader(strings.NewReader(string(b))).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return map[string]any{"rows": []any{}}, nil
+		}
+		header := records[0]
+		col := -1
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), column) {
+				col = i
+				break
+			}
+		}
+		if col < 0 {
+			return nil, fmt.Errorf("column %s not found (have: %s)", column, strings.Join(header, ", "))
+		}
+		rows := []any{}
+		for _, rec := range records[1:] {
+			if col >= len(rec) || strings.TrimSpace(rec[col]) != value {
+				continue
+			}
+			row := map[string]any{}
+			for i, h := range header {
+				if i < len(rec) {
+					row[h] = rec[i]
+				}
+			}
+			rows = append(rows, row)
+		}
+		return map[string]any{"rows": rows}, nil
+	default:
+		return nil, errors.New("lookup supports .json and .csv files")
+	}
+}
+
+func (e *Engine) toolRunRecipe(ctx context.Context, rs *runState, dirs []string, args map[string]any) (map[string]any, error) {
+	if rs.depth+1 > maxRecipeDepth {
+		return nil, fmt.Errorf("recipes can nest at most %d levels", maxRecipeDepth)
+	}
+	path, err := e.toolPath(dirs, stringArg(args, "recipe"))
+	if err != nil {
+		return nil, err
+	}
+	wf, err := workflow.LoadFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if e.deps.Remote {
+		// The user trusted the remote recipe with rs.caps; a child recipe
+		// must not add capabilities, commands, hosts or tokens behind their
+		// back.
+		if missing := rs.caps.Exceeded(workflow.Required(wf)); len(missing) > 0 {
+			return nil, fmt.Errorf("%s needs %s, which the remote recipe was not trusted with", filepath.Base(path), strings.Join(missing, ", "))
+		}
+	}
+
+	child := newRunState(wf)
+	child.depth = rs.depth + 1
+	child.caps = rs.caps
+	child.ledger = rs.ledger
+	if raw, ok := args["inputs"].(map[string]any); ok {
+		for k, v := range raw {
+			child.inputs[k] = fmt.Sprint(v)
+		}
+	}
+	if err := e.run(ctx, child); err != nil {
+		return nil, err
+	}
+	last := wf.Steps[len(wf.Steps)-1].ID
+	return map[string]any{"output": child.memory[last]}, nil
+}
+
+// resolveAllowed maps a tool-supplied path onto a file inside one of dirs.
+// Relative paths are tried against each directory in order; symlinks are
+// resolved for the containment check so they can't point outside, but the
+// path is returned as joined.
+func resolveAllowed(dirs []string, path string) (string, error) {
+	if strings.TrimSpace(path) == "" {
+		return "", errors.New("path is required")
+	}
+
+	var candidates []string
+	if filepath.IsAbs(path) {
+		candidates = []string{path}
+	} else {
+		for _, d := range dirs {
+			candidates = append(candidates, filepath.Join(d, path))
+		}
+	}
+
+	for _, c := range candidates {
+		real, err := filepath.EvalSymlinks(c)
+		if err != nil {
+			continue
+		}
+		for _, d := range dirs {
+			root, err := filepath.EvalSymlinks(d)
+			if err != nil {
+				continue
+			}
+			if within(root, real) {
+				return c, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s is not a file in the allowed directories (%s)", path, strings.Join(dirs, ", "))
+}
+
+func within(root, path string) bool {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+func stringArg(args map[string]any, key string) string {
+	s, _ := args[key].(string)
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/workflow"
+)
+
+func TestResolveAllowed_RejectsPathsOutsideAllowedDirs(t *testing.T) {
+	root := t.TempDir()
+	allowed := filepath.Join(root, "docs")
+	if err := os.MkdirAll(allowed, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(allowed, "spec.md"), []byte("spec"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := resolveAllowed([]string{allowed}, "spec.md"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, p := range []string{"../secret.txt", filepath.Join(root, "secret.txt")} {
+		if _, err := resolveAllowed([]string{allowed}, p); err == nil {
+			t.Fatalf("expected %s to be rejected", p)
+		}
+	}
+}
+
+func TestToolLookup_JSONPathAndCSVRows(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "rates.json"), []byte(`{"rates":{"senior":150}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "clients.csv"), []byte("name,tier\nAcme,pro\nGlobex,free\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	e := New(Dependencies{OutputDir: dir})
+	out, err := e.toolLookup([]string{dir}, map[string]any{"file": "rates.json", "path": "rates.senior"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out["value"] != "150" {
+		t.Fatalf("expected 150, got %v", out["value"])
+	}
+
+	out, err = e.toolLookup([]string{dir}, map[string]any{"file": "clients.csv", "column": "tier", "value": "pro"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rows := out["rows"].([]any)
+	if len(rows) != 1 || rows[0].(map[string]any)["name"] != "Acme" {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+}
+
+func TestCallTool_ConfinesAllowDirsToOutputDir(t *testing.T) {
+	root := t.TempDir()
+	out := filepath.Join(root, "out")
+	if err := os.MkdirAll(filepath.Join(out, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(out, "data", "notes.txt"), []byte("notes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "id_rsa"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "id_rsa"), filepath.Join(out, "data", "key")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	call := func(deps Dependencies, dirs []string, path string) map[string]any {
+		step := workflow.Step{ID: "ask", Tools: []workflow.ToolConfig{{Name: workflow.ToolReadFile, AllowDirs: dirs}}}
+		return New(deps).callTool(context.Background(), newRunState(workflow.Workflow{}), step,
+			llm.ToolCall{Name: workflow.ToolReadFile, Args: map[string]any{"path": path}})
+	}
+	deps := Dependencies{OutputDir: out}
+
+	if got := call(deps, []string{"data"}, "notes.txt"); got["content"] != "notes" {
+		t.Fatalf("expected the file, got %v", got)
+	}
+	for _, tc := range []struct {
+		dirs []string
+		path string
+	}{
+		{[]string{"/"}, filepath.Join(root, "id_rsa")},
+		{[]string{".."}, "id_rsa"},
+		{[]string{"data"}, "key"},
+	} {
+		if got := call(deps, tc.dirs, tc.path); got["error"] == nil {
+			t.Fatalf("allow_dirs %v, path %s: expected an error, got %v", tc.dirs, tc.path, got)
+		}
+	}
+
+	deps.AllowAnyPath = true
+	if got := call(deps, []string{root}, "id_rsa"); got["content"] != "secret" {
+		t.Fatalf("expected --allow-any-path to lift the restriction, got %v", got)
+	}
+}
+
+func TestCallTool_KeepsChildRecipesOfRemoteRecipesWithinTrust(t *testing.T) {
+	out := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(out, "recipes"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	child := []byte(`
+name: child
+steps:
+  - id: wipe
+    type: shell
+    command: echo wiped
+`)
+	if err := os.WriteFile(filepath.Join(out, "recipes", "wipe.yaml"), child, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	step := workflow.Step{ID: "ask", Tools: []workflow.ToolConfig{{Name: workflow.ToolRunRecipe, AllowDirs: []string{"recipes"}}}}
+	parent := workflow.Workflow{Name: "parent", Steps: []workflow.Step{step}}
+	call := func(deps Dependencies) map[string]any {
+		return New(deps).callTool(context.Background(), newRunState(parent), step,
+			llm.ToolCall{Name: workflow.ToolRunRecipe, Args: map[string]any{"recipe": "wipe.yaml"}})
+	}
+
+	got := call(Dependencies{OutputDir: out, Remote: true, AllowShell: true, Headless: true})
+	if msg, _ := got["error"].(string); !strings.Contains(msg, "shell") {
+		t.Fatalf("expected the child's shell step to be refused, got %v", got)
+	}
+	if got := call(Dependencies{OutputDir: out, Headless: true}); got["error"] != nil {
+		t.Fatalf("local recipes may run any child, got %v", got)
+	}
+}
+
+func TestCallTool_ChildRecipesOnlyRunTrustedCommands(t *testing.T) {
+	out := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(out, "recipes"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, command := range map[string]string{"same.yaml": "echo listed", "other.yaml": "echo unlisted"} {
+		body := "name: child\nsteps:\n  - id: run\n    type: shell\n    command: " + command + "\n"
+		if err := os.WriteFile(filepath.Join(out, "recipes", name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	step := workflow.Step{ID: "ask", Tools: []workflow.ToolConfig{{Name: workflow.ToolRunRecipe, AllowDirs: []string{"recipes"}}}}
+	parent := workflow.Workflow{Name: "parent", Steps: []workflow.Step{
+		{ID: "list", Type: workflow.TypeShell, Command: "echo listed"},
+		step,
+	}}
+	e := New(Dependencies{OutputDir: out, Remote: true, AllowShell: true, Headless: true})
+	call := func(recipe string) map[string]any {
+		return e.callTool(context.Background(), newRunState(parent), step,
+			llm.ToolCall{Name: workflow.ToolRunRecipe, Args: map[string]any{"recipe": recipe}})
+	}
+
+	if got := call("same.yaml"); got["error"] != nil {
+		t.Fatalf("a child running the trusted command should run, got %v", got)
+	}
+	if msg, _ := call("other.yaml")["error"].(string); !strings.Contains(msg, "command echo unlisted") {
+		t.Fatalf("expected the unlisted command to be refused, got %q", msg)
+	}
+}
@@ -0,0 +1,333 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"cli-gpt-flows/internal/chunk"
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/usage"
+	"cli-gpt-flows/internal/workflow"
+)
+
+// ErrBudgetExceeded is returned when the next model call would take a run
+// past the workflow's max_cost or max_tokens.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// ledger collects the usage of a run. Recipes started by the run_recipe tool
+// share their parent's ledger, so they count against the same budget.
+type ledger struct {
+	maxCost   float64
+	maxTokens int
+
+	mu    sync.Mutex
+	calls []callUsage
+	// reserved is the estimate of calls in flight, so concurrent map calls
+	// can't all pass the budget check before any of them is recorded.
+	reserved     int
+	reservedCost float64
+}
+
+func newLedger(wf workflow.Workflow) *ledger {
+	return &ledger{maxCost: wf.MaxCost, maxTokens: wf.MaxTokens}
+}
+
+// callUsage is the accounting for one model call.
+type callUsage struct {
+	stepID string
+	model  string
+	usage  llm.Usage
+	cost   float64
+	priced bool
+	cached bool
+}
+
+// metered wraps a provider so every call is checked against the budget and
+// its usage recorded on the run.
+func (e *Engine) metered(rs *runState, step workflow.Step, p llm.Provider) llm.Provider {
+	m := &meteredProvider{e: e, rs: rs, stepID: step.ID, p: p}
+	if sp, ok := p.(llm.StreamProvider); ok {
+		return &meteredStreamProvider{meteredProvider: m, sp: sp}
+	}
+	return m
+}
+
+type meteredProvider struct {
+	e      *Engine
+	rs     *runState
+	stepID string
+	p      llm.Provider
+}
+
+func (m *meteredProvider) Generate(ctx context.Context, req llm.Request) (llm.Response, error) {
+	release, err := m.e.reserveBudget(ctx, m.rs, m.p, req)
+	if err != nil {
+		return llm.Response{}, err
+	}
+	defer release()
+	resp, err := m.p.Generate(ctx, req)
+	if err != nil {
+		return llm.Response{}, err
+	}
+	m.e.recordUsage(m.rs, m.stepID, req.Model, resp.Usage)
+	return resp, nil
+}
+
+type meteredStreamProvider struct {
+	*meteredProvider
+	sp llm.StreamProvider
+}
+
+func (m *meteredStreamProvider) GenerateStream(ctx context.Context, req llm.Request, onText func(string)) (llm.Response, error) {
+	release, err := m.e.reserveBudget(ctx, m.rs, m.p, req)
+	if err != nil {
+		return llm.Response{}, err
+	}
+	defer release()
+	resp, err := m.sp.GenerateStream(ctx, req, onText)
+	if err != nil {
+		return llm.Response{}, err
+	}
+	m.e.recordUsage(m.rs, m.stepID, req.Model, resp.Usage)
+	return resp, nil
+}
+
+// meteredEmbedder checks embedding calls against the budget and records
+// them on the run. Embedders don't report usage, so the estimate of the
+// texts is what gets recorded.
+type meteredEmbedder struct {
+	e      *Engine
+	rs     *runState
+	stepID string
+	emb    llm.Embedder
+}
+
+func (m *meteredEmbedder) Embed(ctx context.Context, model string, texts []string) ([][]float32, error) {
+	n := 0
+	for _, t := range texts {
+		n += chunk.EstimateTokens(t)
+	}
+	u := llm.Usage{PromptTokens: n, TotalTokens: n}
+	release, err := m.e.reserve(m.rs.ledger, model, u)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	vecs, err := m.emb.Embed(ctx, model, texts)
+	if err != nil {
+		return nil, err
+	}
+	m.e.recordUsage(m.rs, m.stepID, model, u)
+	return vecs, nil
+}
+
+// defaultOutputEstimate is the number of output tokens a call is assumed to
+// produce for the budget check when the step doesn't set max_output_tokens.
+const defaultOutputEstimate = 2048
+
+// imageTokens is roughly what Gemini charges for one image.
+const imageTokens = 258
+
+// estimateTokens guesses the input tokens of req without calling the model:
+// about four characters per token for text, a fixed size per image and one
+// token per hundred bytes for other attachments (PDF, audio, video), which
+// errs on the high side.
+func estimateTokens(req llm.Request) int {
+	text := req.SystemPrompt + req.UserPrompt
+	for _, m := range req.History {
+		text += m.Text
+	}
+	n := chunk.EstimateTokens(text)
+	for _, a := range req.Attachments {
+		switch {
+		case strings.HasPrefix(a.MIMEType, "text/") || a.MIMEType == "application/json":
+			n += chunk.EstimateTokens(string(a.Data))
+		case strings.HasPrefix(a.MIMEType, "image/"):
+			n += imageTokens
+		default:
+			n += len(a.Data) / 100
+		}
+	}
+	return n
+}
+
+// reserveBudget refuses a call when what has been spent, plus the calls in
+// flight, plus an estimate of this one would exceed the budget. Otherwise the
+// estimate is held until the returned release is called. The estimate counts
+// the prompt (measured by the provider when it has attachments and can count
+// tokens) and max_output_tokens of output.
+func (e *Engine) reserveBudget(ctx context.Context, rs *runState, p llm.Provider, req llm.Request) (func(), error) {
+	l := rs.ledger
+	if l.maxCost <= 0 && l.maxTokens <= 0 {
+		return func() {}, nil
+	}
+
+	prompt := estimateTokens(req)
+	if tc, ok := p.(llm.TokenCounter); ok && len(req.Attachments) > 0 {
+		if n, err := tc.CountTokens(ctx, req); err == nil {
+			prompt = n
+		}
+	}
+	output := defaultOutputEstimate
+	if req.Generation.MaxOutputTokens != nil {
+		output = int(*req.Generation.MaxOutputTokens)
+	}
+	return e.reserve(l, req.Model, llm.Usage{PromptTokens: prompt, CandidateTokens: output, TotalTokens: prompt + output})
+}
+
+// reserve holds estimate for a call to model unless it would take the run
+// past its budget.
+func (e *Engine) reserve(l *ledger, model string, estimate llm.Usage) (func(), error) {
+	if l.maxCost <= 0 && l.maxTokens <= 0 {
+		return func() {}, nil
+	}
+	estCost, priced := e.prices.Cost(model, estimate)
+	if l.maxCost > 0 && !priced {
+		return nil, fmt.Errorf("%w: max_cost is set but %s has no price; add it to the prices file (%s)",
+			ErrBudgetExceeded, model, usage.EnvPricesFile)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	spent, cost := l.sum("")
+	if l.maxTokens > 0 && spent.TotalTokens+l.reserved+estimate.TotalTokens > l.maxTokens {
+		return nil, fmt.Errorf("%w: %d tokens used, next call needs about %d more (max_tokens %d)",
+			ErrBudgetExceeded, spent.TotalTokens+l.reserved, estimate.TotalTokens, l.maxTokens)
+	}
+	if l.maxCost > 0 && cost+l.reservedCost+estCost > l.maxCost {
+		return nil, fmt.Errorf("%w: $%.4f spent, next call costs about $%.4f more (max_cost $%.2f)",
+			ErrBudgetExceeded, cost+l.reservedCost, estCost, l.maxCost)
+	}
+	l.reserved += estimate.TotalTokens
+	l.reservedCost += estCost
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.reserved -= estimate.TotalTokens
+			l.reservedCost -= estCost
+		})
+	}, nil
+}
+
+func (e *Engine) recordUsage(rs *runState, stepID, model string, u llm.Usage) {
+	cost, priced := e.prices.Cost(model, u)
+	l := rs.ledger
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, callUsage{stepID: stepID, model: model, usage: u, cost: cost, priced: priced})
+}
+
+func (e *Engine) recordCacheHit(rs *runState, stepID, model string) {
+	l := rs.ledger
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, callUsage{stepID: stepID, model: model, priced: true, cached: true})
+}
+
+// cacheHits counts the calls of a step answered from the response cache.
+func (l *ledger) cacheHits(stepID string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, c := range l.calls {
+		if c.cached && (stepID == "" || c.stepID == stepID) {
+			n++
+		}
+	}
+	return n
+}
+
+// total sums usage and cost for one step, or for everything when stepID is "".
+func (l *ledger) total(stepID string) (llm.Usage, float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sum(stepID)
+}
+
+// sum is total with l.mu held.
+func (l *ledger) sum(stepID string) (llm.Usage, float64) {
+	var (
+		total llm.Usage
+		cost  float64
+	)
+	for _, c := range l.calls {
+		if stepID == "" || c.stepID == stepID {
+			total = total.Add(c.usage)
+			cost += c.cost
+		}
+	}
+	return total, cost
+}
+
+// printSummary prints tokens and cost per step and model, then the total.
+func (l *ledger) printSummary() {
+	l.mu.Lock()
+	calls := append([]callUsage(nil), l.calls...)
+	l.mu.Unlock()
+	if len(calls) == 0 {
+		return
+	}
+
+	type row struct {
+		callUsage
+		calls int
+		hits  int
+	}
+	var rows []*row
+	index := map[string]*row{}
+	for _, c := range calls {
+		key := c.stepID + "\x00" + c.model
+		r, ok := index[key]
+		if !ok {
+			r = &row{callUsage: callUsage{stepID: c.stepID, model: c.model, priced: true}}
+			index[key] = r
+			rows = append(rows, r)
+		}
+		r.usage = r.usage.Add(c.usage)
+		r.cost += c.cost
+		r.priced = r.priced && c.priced
+		r.calls++
+		if c.cached {
+			r.hits++
+		}
+	}
+
+	fmt.Println("==> usage")
+	fmt.Printf("    %-24s %-22s %6s %6s %10s %10s %10s %10s\n", "step", "model", "calls", "cached", "prompt", "output", "total", "cost")
+	var (
+		total  llm.Usage
+		cost   float64
+		hits   int
+		priced = true
+	)
+	for _, r := range rows {
+		fmt.Printf("    %-24s %-22s %6d %6d %10d %10d %10d %10s\n",
+			r.stepID, r.model, r.calls, r.hits, r.usage.PromptTokens, r.usage.CandidateTokens, r.usage.TotalTokens, formatCost(r.cost, r.priced))
+		total = total.Add(r.usage)
+		cost += r.cost
+		hits += r.hits
+		priced = priced && r.priced
+	}
+	totalCost := formatCost(cost, true)
+	if !priced {
+		totalCost += "*"
+	}
+	fmt.Printf("    %-24s %-22s %6d %6d %10d %10d %10d %10s\n",
+		"total", "", len(calls), hits, total.PromptTokens, total.CandidateTokens, total.TotalTokens, totalCost)
+	if !priced {
+		fmt.Println("    * leaves out models without a price (add them to the prices file)")
+	}
+	fmt.Println()
+}
+
+func formatCost(cost float64, priced bool) string {
+	if !priced {
+		return "n/a"
+	}
+	return fmt.Sprintf("$%.4f", cost)
+}
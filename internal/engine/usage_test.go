@@ -0,0 +1,84 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/usage"
+	"cli-gpt-flows/internal/workflow"
+)
+
+// usageReplayer answers every model call with 500 tokens of usage.
+type usageReplayer struct{}
+
+func (usageReplayer) Inputs() map[string]string     { return nil }
+func (usageReplayer) Refined(string) (string, bool) { return "", false }
+func (usageReplayer) Provider(string, string) llm.Provider {
+	return providerFunc(func(req llm.Request) (llm.Response, error) {
+		return llm.Response{Text: "ok", Usage: llm.Usage{PromptTokens: 400, CandidateTokens: 100, TotalTokens: 500}}, nil
+	})
+}
+
+func TestRun_BudgetAbortsRun(t *testing.T) {
+	maxOut := int32(100)
+	step := func(id, model string) workflow.Step {
+		return workflow.Step{ID: id, Type: "gemini", Model: model, UserPrompt: "hi", Generation: &llm.GenerationConfig{MaxOutputTokens: &maxOut}}
+	}
+	prices := usage.Prices{"priced": {Input: 1, Output: 1}}
+
+	t.Run("max_tokens", func(t *testing.T) {
+		wf := workflow.Workflow{Name: "t", MaxTokens: 800, Steps: []workflow.Step{step("a", "priced"), step("b", "priced"), step("c", "priced")}}
+		out, err := New(Dependencies{Replay: usageReplayer{}, Prices: prices}).RunOutputs(context.Background(), wf, nil)
+		if !errors.Is(err, ErrBudgetExceeded) {
+			t.Fatalf("expected ErrBudgetExceeded, got %v", err)
+		}
+		if _, ok := out["b"]; !ok {
+			t.Fatalf("expected b to run within budget, got %v", out)
+		}
+		if _, ok := out["c"]; ok {
+			t.Fatalf("expected c to be refused")
+		}
+	})
+
+	t.Run("output counts", func(t *testing.T) {
+		// The prompt is tiny, but 2048 output tokens by default don't fit.
+		s := step("a", "priced")
+		s.Generation = nil
+		wf := workflow.Workflow{Name: "t", MaxTokens: 1000, Steps: []workflow.Step{s}}
+		if _, err := New(Dependencies{Replay: usageReplayer{}, Prices: prices}).RunOutputs(context.Background(), wf, nil); !errors.Is(err, ErrBudgetExceeded) {
+			t.Fatalf("expected ErrBudgetExceeded, got %v", err)
+		}
+	})
+
+	t.Run("unpriced model with max_cost", func(t *testing.T) {
+		wf := workflow.Workflow{Name: "t", MaxCost: 1, Steps: []workflow.Step{step("a", "local-model")}}
+		if _, err := New(Dependencies{Replay: usageReplayer{}, Prices: prices}).RunOutputs(context.Background(), wf, nil); !errors.Is(err, ErrBudgetExceeded) {
+			t.Fatalf("expected ErrBudgetExceeded, got %v", err)
+		}
+	})
+}
+
+func TestReserveBudget_CountsCallsInFlight(t *testing.T) {
+	e := New(Dependencies{Prices: usage.Prices{}})
+	rs := newRunState(workflow.Workflow{MaxTokens: 3000})
+	maxOut := int32(1000)
+	req := llm.Request{Model: "m", UserPrompt: "hi", Generation: llm.GenerationConfig{MaxOutputTokens: &maxOut}}
+	p := providerFunc(func(llm.Request) (llm.Response, error) { return llm.Response{}, nil })
+
+	release, err := e.reserveBudget(context.Background(), rs, p, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.reserveBudget(context.Background(), rs, p, req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.reserveBudget(context.Background(), rs, p, req); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("expected the third concurrent call to be refused, got %v", err)
+	}
+	release()
+	if _, err := e.reserveBudget(context.Background(), rs, p, req); err != nil {
+		t.Fatalf("expected room after a release, got %v", err)
+	}
+}
@@ -0,0 +1,504 @@
+// Package eval runs a recipe step over a dataset with several models or
+// prompt variants, scores the outputs with regex checks and an optional LLM
+// judge, and writes a side-by-side report. It backs the `eval` command.
+package eval
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cli-gpt-flows/internal/engine"
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/models"
+	"cli-gpt-flows/internal/usage"
+	"cli-gpt-flows/internal/workflow"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Modes of an evaluation.
+const (
+	// ModeStep runs only the evaluated step; dataset columns fill the memory
+	// keys its prompts reference.
+	ModeStep = "step"
+	// ModeRecipe runs the whole recipe; dataset columns are input step values.
+	ModeRecipe = "recipe"
+)
+
+// Config is an eval file. Relative paths are relative to the file.
+type Config struct {
+	Recipe   string    `yaml:"recipe"`
+	Step     string    `yaml:"step"`
+	Mode     string    `yaml:"mode"`
+	Dataset  string    `yaml:"dataset"`
+	Variants []Variant `yaml:"variants"`
+	Checks   []Check   `yaml:"checks"`
+	Judge    *Judge    `yaml:"judge"`
+	Report   string    `yaml:"report"`
+	// AllowSideEffects lets recipe mode run shell and http steps, once per
+	// row and variant.
+	AllowSideEffects bool `yaml:"allow_side_effects"`
+}
+
+// Variant overrides fields of the evaluated step. Unset fields keep the
+// recipe's values.
+type Variant struct {
+	Name         string                `yaml:"name"`
+	Model        string                `yaml:"model"`
+	Provider     string                `yaml:"provider"`
+	SystemPrompt string                `yaml:"system_prompt"`
+	UserPrompt   string                `yaml:"user_prompt"`
+	Generation   *llm.GenerationConfig `yaml:"generation"`
+}
+
+// Check is a regex every output should match (or, with Absent, must not).
+type Check struct {
+	Name   string `yaml:"name"`
+	Regex  string `yaml:"regex"`
+	Absent bool   `yaml:"absent"`
+
+	re *regexp.Regexp
+}
+
+// Judge scores each output from 1 to 5 against Rubric with another model.
+type Judge struct {
+	Model    string `yaml:"model"`
+	Provider string `yaml:"provider"`
+	Rubric   string `yaml:"rubric"`
+}
+
+// Run is one variant applied to one dataset row.
+type Run struct {
+	Row        int
+	Variant    string
+	Output     string
+	Err        string
+	DurationMs int64
+	Checks     []bool
+	Score      float64
+	Reason     string
+	Judged     bool
+}
+
+// Result is everything the report is built from.
+type Result struct {
+	Config Config
+	Rows   []map[string]string
+	Runs   []Run
+}
+
+// LoadConfig reads and validates an eval file.
+func LoadConfig(path string) (Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("read %s: %w", path, err)
+	}
+	var c Config
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return Config{}, fmt.Errorf("parse yaml %s: %w", path, err)
+	}
+
+	base := filepath.Dir(path)
+	for _, p := range []*string{&c.Recipe, &c.Dataset, &c.Report} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(base, *p)
+		}
+	}
+	if c.Mode == "" {
+		c.Mode = ModeStep
+	}
+	if c.Report == "" {
+		c.Report = strings.TrimSuffix(path, filepath.Ext(path)) + ".report.md"
+	}
+	if err := c.validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid eval %s: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c *Config) validate() error {
+	if c.Recipe == "" {
+		return errors.New("recipe is required")
+	}
+	if c.Step == "" {
+		return errors.New("step is required")
+	}
+	if c.Dataset == "" {
+		return errors.New("dataset is required")
+	}
+	if c.Mode != ModeStep && c.Mode != ModeRecipe {
+		return fmt.Errorf("mode must be %s or %s", ModeStep, ModeRecipe)
+	}
+	if len(c.Variants) == 0 {
+		return errors.New("variants is required")
+	}
+	seen := map[string]struct{}{}
+	for i, v := range c.Variants {
+		if v.Name == "" {
+			return fmt.Errorf("variants[%d].name is required", i)
+		}
+		if _, ok := seen[v.Name]; ok {
+			return fmt.Errorf("duplicate variant: %s", v.Name)
+		}
+		seen[v.Name] = struct{}{}
+	}
+	for i := range c.Checks {
+		re, err := regexp.Compile(c.Checks[i].Regex)
+		if err != nil || c.Checks[i].Regex == "" {
+			return fmt.Errorf("checks[%d].regex must be a valid regular expression", i)
+		}
+		c.Checks[i].re = re
+		if c.Checks[i].Name == "" {
+			c.Checks[i].Name = c.Checks[i].Regex
+		}
+	}
+	if c.Judge != nil && (c.Judge.Model == "" || strings.TrimSpace(c.Judge.Rubric) == "") {
+		return errors.New("judge needs model and rubric")
+	}
+	switch strings.ToLower(filepath.Ext(c.Report)) {
+	case ".md", ".html":
+	default:
+		return errors.New("report must be a .md or .html file")
+	}
+	return nil
+}
+
+// RunFile loads an eval file, runs it with an engine built from deps, writes
+// the report and prints a summary to w.
+func RunFile(ctx context.Context, path string, deps engine.Dependencies, w io.Writer) error {
+	c, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	res, err := Evaluate(ctx, c, deps, w)
+	if err != nil {
+		return err
+	}
+	if err := WriteReport(c.Report, res); err != nil {
+		return err
+	}
+	writeSummary(w, res)
+	fmt.Fprintf(w, "\nreport written to %s\n", c.Report)
+	return nil
+}
+
+// Evaluate runs every variant over every dataset row, printing progress to w.
+func Evaluate(ctx context.Context, c Config, deps engine.Dependencies, w io.Writer) (Result, error) {
+	wf, err := workflow.LoadFromFile(c.Recipe)
+	if err != nil {
+		return Result{}, err
+	}
+	idx := -1
+	for i, s := range wf.Steps {
+		if s.ID == c.Step {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return Result{}, fmt.Errorf("step %s not found in %s", c.Step, c.Recipe)
+	}
+	if !workflow.IsModelStep(wf.Steps[idx].Type) {
+		return Result{}, fmt.Errorf("step %s is a %s step; only model steps can be evaluated", c.Step, wf.Steps[idx].Type)
+	}
+	if c.Mode == ModeRecipe && !c.AllowSideEffects {
+		if need := workflow.Required(wf); need.Shell || need.HTTP {
+			return Result{}, fmt.Errorf("%s has shell or http steps, which recipe mode would run for every row and variant; set allow_side_effects: true to run them", c.Recipe)
+		}
+	}
+	rows, err := LoadDataset(c.Dataset)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// Every run gets its own engine writing into a temporary directory, so
+	// `save` steps never touch the user's files; reads still resolve against
+	// the user's directory.
+	deps.Headless = true
+	if deps.InputDir == "" {
+		deps.InputDir = deps.OutputDir
+	}
+	if deps.InputDir == "" {
+		deps.InputDir = "."
+	}
+	if deps.Prices == nil {
+		deps.Prices, err = usage.LoadPrices()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v (using default prices)\n", err)
+		}
+	}
+	if deps.Aliases == nil {
+		deps.Aliases, err = models.LoadAliases()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v (using default model aliases)\n", err)
+		}
+	}
+	judgeEngine := engine.New(deps)
+
+	res := Result{Config: c, Rows: rows}
+	for r, row := range rows {
+		for _, v := range c.Variants {
+			fmt.Fprintf(w, "==> eval row %d/%d, variant %s\n", r+1, len(rows), v.Name)
+			run := Run{Row: r, Variant: v.Name}
+			start := time.Now()
+			out, err := runVariant(ctx, deps, wf, idx, c.Mode, v, row)
+			run.DurationMs = time.Since(start).Milliseconds()
+			if err != nil {
+				run.Err = err.Error()
+			} else {
+				run.Output = out
+				for _, check := range c.Checks {
+					run.Checks = append(run.Checks, check.re.MatchString(out) != check.Absent)
+				}
+				if c.Judge != nil {
+					run.Score, run.Reason, err = judge(ctx, judgeEngine, *c.Judge, row, out)
+					if err != nil {
+						run.Reason = "judge failed: " + err.Error()
+					} else {
+						run.Judged = true
+					}
+				}
+			}
+			res.Runs = append(res.Runs, run)
+		}
+	}
+	return res, nil
+}
+
+func runVariant(ctx context.Context, deps engine.Dependencies, wf workflow.Workflow, idx int, mode string, v Variant, row map[string]string) (string, error) {
+	step := wf.Steps[idx]
+	if v.Model != "" {
+		step.Model, step.FallbackModels = v.Model, nil
+	}
+	if v.Provider != "" {
+		step.Provider = v.Provider
+	}
+	if v.SystemPrompt != "" {
+		step.SystemPrompt = v.SystemPrompt
+	}
+	if v.UserPrompt != "" {
+		step.UserPrompt = v.UserPrompt
+	}
+	if v.Generation != nil {
+		step.Generation = v.Generation
+	}
+	step.InteractiveRefine = false
+	noStream := false
+	step.Stream = &noStream
+
+	var run workflow.Workflow
+	if mode == ModeStep {
+		// Columns become input steps so they land in memory under their names.
+		run = workflow.Workflow{Name: wf.Name}
+		cols := make([]string, 0, len(row))
+		for col := range row {
+			if col != step.ID {
+				cols = append(cols, col)
+			}
+		}
+		sort.Strings(cols)
+		for _, col := range cols {
+			run.Steps = append(run.Steps, workflow.Step{ID: col, Type: "input"})
+		}
+		step.ParallelGroup = ""
+		run.Steps = append(run.Steps, step)
+	} else {
+		run = wf
+		run.Steps = append([]workflow.Step(nil), wf.Steps...)
+		run.Steps[idx] = step
+	}
+
+	dir, err := os.MkdirTemp("", "pals-gemflows-eval-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	deps.OutputDir = dir
+	outputs, err := engine.New(deps).RunOutputs(ctx, run, row)
+	if err != nil {
+		return "", err
+	}
+	return outputs[step.ID], nil
+}
+
+var judgeSchema = map[string]any{
+	"type":     "object",
+	"required": []any{"score", "reason"},
+	"properties": map[string]any{
+		"score":  map[string]any{"type": "integer", "description": "1 (poor) to 5 (excellent)"},
+		"reason": map[string]any{"type": "string"},
+	},
+}
+
+// judge asks the judge model to score an output against the rubric.
+func judge(ctx context.Context, e *engine.Engine, j Judge, row map[string]string, output string) (float64, string, error) {
+	input, _ := json.MarshalIndent(row, "", "  ")
+	wf := workflow.Workflow{Name: "eval-judge", Steps: []workflow.Step{
+		{ID: "judge_rubric", Type: "input"},
+		{ID: "judge_input", Type: "input"},
+		{ID: "judge_output", Type: "input"},
+		{
+			ID:             "judge",
+			Type:           workflow.TypeGemini,
+			Model:          j.Model,
+			Provider:       j.Provider,
+			ResponseFormat: llm.FormatJSON,
+			ResponseSchema: judgeSchema,
+			SystemPrompt:   "You are a strict evaluator. Score the output against the rubric from 1 (poor) to 5 (excellent) and explain the score in one or two sentences.",
+			UserPrompt:     "Rubric:\n{{ judge_rubric }}\n\nInput:\n{{ judge_input }}\n\nOutput to evaluate:\n{{ judge_output }}",
+		},
+	}}
+	out, err := e.RunOutputs(ctx, wf, map[string]string{
+		"judge_rubric": j.Rubric,
+		"judge_input":  string(input),
+		"judge_output": output,
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	var verdict struct {
+		Score  float64 `json:"score"`
+		Reason string  `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(out["judge"]), &verdict); err != nil {
+		return 0, "", err
+	}
+	// Gemini schemas can't restrict integers to an enum, so the range is
+	// checked here.
+	if verdict.Score < 1 || verdict.Score > 5 {
+		return 0, "", fmt.Errorf("judge score %v is outside 1-5", verdict.Score)
+	}
+	return verdict.Score, verdict.Reason, nil
+}
+
+// LoadDataset reads rows from a .jsonl file (one object per line) or a .csv
+// file (header row first). Non-string JSON values are kept as JSON text.
+func LoadDataset(path string) ([]map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read dataset: %w", err)
+	}
+
+	var rows []map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl":
+		for i, line := range strings.Split(string(b), "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			var obj map[string]any
+			if err := json.Unmarshal([]byte(line), &obj); err != nil {
+				return nil, fmt.Errorf("dataset line %d: %w", i+1, err)
+			}
+			row := map[string]string{}
+			for k, v := range obj {
+				if s, ok := v.(string); ok {
+					row[k] = s
+					continue
+				}
+				j, _ := json.Marshal(v)
+				row[k] = string(j)
+			}
+			rows = append(rows, row)
+		}
+	case ".csv":
+		records, err := csv.NewReader(strings.NewReader(string(b))).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("dataset: %w", err)
+		}
+		if len(records) > 0 {
+			header := records[0]
+			for _, rec := range records[1:] {
+				row := map[string]string{}
+				for i, h := range header {
+					if i < len(rec) {
+						row[strings.TrimSpace(h)] = rec[i]
+					}
+				}
+				rows = append(rows, row)
+			}
+		}
+	default:
+		return nil, errors.New("dataset must be a .jsonl or .csv file")
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("dataset %s has no rows", path)
+	}
+	return rows, nil
+}
+
+// variantStats summarises one variant across the dataset.
+type variantStats struct {
+	name     string
+	runs     int
+	errors   int
+	checks   int
+	passed   int
+	judged   int
+	scoreSum float64
+	ms       int64
+}
+
+func (s variantStats) avgScore() string {
+	if s.judged == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(s.scoreSum/float64(s.judged), 'f', 2, 64)
+}
+
+func (s variantStats) checkRate() string {
+	if s.checks == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d/%d", s.passed, s.checks)
+}
+
+func stats(res Result) []variantStats {
+	var out []variantStats
+	for _, v := range res.Config.Variants {
+		s := variantStats{name: v.Name}
+		for _, r := range res.Runs {
+			if r.Variant != v.Name {
+				continue
+			}
+			s.runs++
+			s.ms += r.DurationMs
+			if r.Err != "" {
+				s.errors++
+			}
+			for _, ok := range r.Checks {
+				s.checks++
+				if ok {
+					s.passed++
+				}
+			}
+			if r.Judged {
+				s.judged++
+				s.scoreSum += r.Score
+			}
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func writeSummary(w io.Writer, res Result) {
+	fmt.Fprintf(w, "%-24s %6s %6s %8s %10s %10s\n", "variant", "runs", "errors", "checks", "avg score", "avg ms")
+	for _, s := range stats(res) {
+		avgMs := int64(0)
+		if s.runs > 0 {
+			avgMs = s.ms / int64(s.runs)
+		}
+		fmt.Fprintf(w, "%-24s %6d %6d %8s %10s %10d\n", s.name, s.runs, s.errors, s.checkRate(), s.avgScore(), avgMs)
+	}
+}
@@ -0,0 +1,232 @@
+package eval
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cli-gpt-flows/internal/engine"
+	"cli-gpt-flows/internal/llm"
+)
+
+// echoReplayer answers every model step with the model name and prompt, and
+// the judge with a score that prefers the pro model.
+type echoReplayer struct{}
+
+func (echoReplayer) Inputs() map[string]string              { return nil }
+func (echoReplayer) Refined(string) (string, bool)          { return "", false }
+func (echoReplayer) Provider(stepID, _ string) llm.Provider { return echoProvider{stepID: stepID} }
+
+type echoProvider struct{ stepID string }
+
+func (p echoProvider) Generate(_ context.Context, req llm.Request) (llm.Response, error) {
+	if p.stepID == "judge" {
+		score := 3
+		if strings.Contains(req.UserPrompt, "gemini-2.5-pro") {
+			score = 5
+		}
+		return llm.Response{Text: fmt.Sprintf(`{"score": %d, "reason": "ok"}`, score)}, nil
+	}
+	return llm.Response{Text: req.Model + ": " + req.UserPrompt}, nil
+}
+
+func (p echoProvider) GenerateStream(ctx context.Context, req llm.Request, onText func(string)) (llm.Response, error) {
+	return p.Generate(ctx, req)
+}
+
+func TestRunFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("scoping.yaml", `
+name: scoping
+steps:
+  - id: notes
+    type: input
+  - id: scope
+    type: gemini
+    model: gemini-2.5-pro
+    user_prompt: "Scope: {{ notes }}"
+  - id: save
+    type: save
+    filename: scope.md
+    content: "{{ scope }}"
+`)
+	write("rows.jsonl", `{"notes": "portal for Acme"}
+{"notes": "mobile app", "budget": 5000}
+`)
+	write("eval.yaml", `
+recipe: scoping.yaml
+step: scope
+dataset: rows.jsonl
+variants:
+  - name: pro
+  - name: flash
+    model: gemini-2.5-flash
+checks:
+  - name: mentions acme
+    regex: (?i)acme
+judge:
+  model: gemini-2.5-pro
+  rubric: The scope names the customer.
+report: out/report.md
+`)
+
+	var out bytes.Buffer
+	if err := RunFile(context.Background(), filepath.Join(dir, "eval.yaml"), engine.Dependencies{Replay: echoReplayer{}}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "pro") || !strings.Contains(out.String(), "5.00") || !strings.Contains(out.String(), "3.00") {
+		t.Fatalf("summary:\n%s", out.String())
+	}
+
+	report, err := os.ReadFile(filepath.Join(dir, "out", "report.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"gemini-2.5-flash: Scope: portal for Acme",
+		"gemini-2.5-pro: Scope: mobile app",
+		"mentions acme: FAIL",
+		"| flash | 2 | 0 | 1/2 | 3.00 |",
+	} {
+		if !strings.Contains(string(report), want) {
+			t.Errorf("report missing %q:\n%s", want, report)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "scope.md")); err == nil {
+		t.Error("save step wrote into the eval directory")
+	}
+}
+
+func TestRunFile_RecipeModeReadsUserDirectory(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("brief.txt", "house style: terse")
+	write("scoping.yaml", `
+name: scoping
+steps:
+  - id: notes
+    type: input
+  - id: brief
+    type: read_file
+    path: brief.txt
+  - id: scope
+    type: gemini
+    model: gemini-2.5-pro
+    user_prompt: "{{ brief }} / {{ notes }}"
+  - id: save
+    type: save
+    filename: scope.md
+    content: "{{ scope }}"
+`)
+	write("rows.jsonl", `{"notes": "portal for Acme"}`+"\n")
+	write("eval.yaml", `
+recipe: scoping.yaml
+step: scope
+mode: recipe
+dataset: rows.jsonl
+variants:
+  - name: pro
+report: report.md
+`)
+
+	var out bytes.Buffer
+	deps := engine.Dependencies{Replay: echoReplayer{}, OutputDir: dir}
+	if err := RunFile(context.Background(), filepath.Join(dir, "eval.yaml"), deps, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "==> eval row 1/1, variant pro") {
+		t.Errorf("progress not written to w:\n%s", out.String())
+	}
+	report, err := os.ReadFile(filepath.Join(dir, "report.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), "house style: terse / portal for Acme") {
+		t.Errorf("read_file did not read the user's directory:\n%s", report)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "scope.md")); err == nil {
+		t.Error("save step wrote into the output directory")
+	}
+}
+
+func TestEvaluate_RefusesSideEffectsInRecipeMode(t *testing.T) {
+	dir := t.TempDir()
+	recipe := filepath.Join(dir, "build.yaml")
+	if err := os.WriteFile(recipe, []byte(`
+name: build
+steps:
+  - id: build
+    type: shell
+    command: make deploy
+  - id: summary
+    type: gemini
+    model: gemini-2.5-pro
+    user_prompt: "{{ build.stdout }}"
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Recipe: recipe, Step: "summary", Mode: ModeRecipe, Dataset: filepath.Join(dir, "rows.jsonl"), Variants: []Variant{{Name: "pro"}}}
+	_, err := Evaluate(context.Background(), c, engine.Dependencies{Replay: echoReplayer{}}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "allow_side_effects") {
+		t.Fatalf("err = %v, want a refusal naming allow_side_effects", err)
+	}
+}
+
+func TestLoadDatasetCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rows.csv")
+	if err := os.WriteFile(path, []byte("notes, owner\n\"a, b\",kim\nc,lee\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := LoadDataset(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0]["notes"] != "a, b" || rows[1]["owner"] != "lee" {
+		t.Fatalf("rows = %v", rows)
+	}
+}
+
+// scoreReplayer answers the judge with a fixed score.
+type scoreReplayer struct{ score int }
+
+func (scoreReplayer) Inputs() map[string]string     { return nil }
+func (scoreReplayer) Refined(string) (string, bool) { return "", false }
+func (r scoreReplayer) Provider(string, string) llm.Provider {
+	return providerFunc(func(req llm.Request) llm.Response {
+		return llm.Response{Text: fmt.Sprintf(`{"score": %d, "reason": "ok"}`, r.score)}
+	})
+}
+
+type providerFunc func(llm.Request) llm.Response
+
+func (f providerFunc) Generate(_ context.Context, req llm.Request) (llm.Response, error) {
+	return f(req), nil
+}
+
+func TestJudge_RejectsScoresOutOfRange(t *testing.T) {
+	j := Judge{Model: "gemini-2.5-pro", Rubric: "Be good."}
+	for score, ok := range map[int]bool{1: true, 5: true, 0: false, 7: false} {
+		e := engine.New(engine.Dependencies{Replay: scoreReplayer{score: score}, Headless: true})
+		got, _, err := judge(context.Background(), e, j, map[string]string{"notes": "x"}, "output")
+		if ok && (err != nil || got != float64(score)) {
+			t.Errorf("score %d: got %v, %v", score, got, err)
+		}
+		if !ok && (err == nil || !strings.Contains(err.Error(), "outside 1-5")) {
+			t.Errorf("score %d: expected a range error, got %v", score, err)
+		}
+	}
+}
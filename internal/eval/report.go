@@ -0,0 +1,153 @@
+package eval
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// WriteReport renders res as Markdown or HTML, depending on path's extension.
+func WriteReport(path string, res Result) error {
+	var body string
+	if strings.EqualFold(filepath.Ext(path), ".html") {
+		body = renderHTML(res)
+	} else {
+		body = renderMarkdown(res)
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	return nil
+}
+
+// verdict summarises check results and the judge score of a run.
+func (r Run) verdict(checks []Check) string {
+	if r.Err != "" {
+		return "error: " + r.Err
+	}
+	var parts []string
+	for i, ok := range r.Checks {
+		mark := "pass"
+		if !ok {
+			mark = "FAIL"
+		}
+		parts = append(parts, checks[i].Name+": "+mark)
+	}
+	if r.Judged {
+		parts = append(parts, fmt.Sprintf("score %.0f/5: %s", r.Score, r.Reason))
+	} else if r.Reason != "" {
+		parts = append(parts, r.Reason)
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (res Result) run(row int, variant string) Run {
+	for _, r := range res.Runs {
+		if r.Row == row && r.Variant == variant {
+			return r
+		}
+	}
+	return Run{Row: row, Variant: variant, Err: "not run"}
+}
+
+func rowText(row map[string]string) string {
+	keys := make([]string, 0, len(row))
+	for k := range row {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s: %s\n", k, row[k])
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func renderMarkdown(res Result) string {
+	c := res.Config
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Eval: %s / %s\n\n", filepath.Base(c.Recipe), c.Step)
+	fmt.Fprintf(&b, "Dataset `%s`, %d rows, mode `%s`.\n\n", filepath.Base(c.Dataset), len(res.Rows), c.Mode)
+
+	b.WriteString("## Summary\n\n| variant | runs | errors | checks passed | avg score | avg ms |\n|---|---|---|---|---|---|\n")
+	for _, s := range stats(res) {
+		avgMs := int64(0)
+		if s.runs > 0 {
+			avgMs = s.ms / int64(s.runs)
+		}
+		fmt.Fprintf(&b, "| %s | %d | %d | %s | %s | %d |\n", s.name, s.runs, s.errors, s.checkRate(), s.avgScore(), avgMs)
+	}
+
+	for i, row := range res.Rows {
+		fmt.Fprintf(&b, "\n## Row %d\n\n```\n%s\n```\n", i+1, rowText(row))
+		for _, v := range c.Variants {
+			r := res.run(i, v.Name)
+			fmt.Fprintf(&b, "\n### %s\n\n", v.Name)
+			if verdict := r.verdict(c.Checks); verdict != "" {
+				fmt.Fprintf(&b, "_%s_\n\n", verdict)
+			}
+			if r.Err == "" {
+				fmt.Fprintf(&b, "````\n%s\n````\n", strings.TrimSpace(r.Output))
+			}
+		}
+	}
+	return b.String()
+}
+
+func renderHTML(res Result) string {
+	c := res.Config
+	esc := html.EscapeString
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&b, "<title>Eval: %s / %s</title>\n", esc(filepath.Base(c.Recipe)), esc(c.Step))
+	b.WriteString("<style>body{font-family:sans-serif;margin:2em}table{border-collapse:collapse;width:100%}" +
+		"td,th{border:1px solid #ccc;padding:6px;vertical-align:top;text-align:left}" +
+		"pre{white-space:pre-wrap;margin:0}.verdict{color:#555;font-size:90%;margin-bottom:6px}.err{color:#b00}</style>\n")
+	b.WriteString("</head><body>\n")
+	fmt.Fprintf(&b, "<h1>Eval: %s / %s</h1>\n", esc(filepath.Base(c.Recipe)), esc(c.Step))
+	fmt.Fprintf(&b, "<p>Dataset <code>%s</code>, %d rows, mode <code>%s</code>.</p>\n", esc(filepath.Base(c.Dataset)), len(res.Rows), esc(c.Mode))
+
+	b.WriteString("<h2>Summary</h2>\n<table><tr><th>variant</th><th>runs</th><th>errors</th><th>checks passed</th><th>avg score</th><th>avg ms</th></tr>\n")
+	for _, s := range stats(res) {
+		avgMs := int64(0)
+		if s.runs > 0 {
+			avgMs = s.ms / int64(s.runs)
+		}
+		fmt.Fprintf(&b, "<tr><td>%s</td><td>%d</td><td>%d</td><td>%s</td><td>%s</td><td>%d</td></tr>\n",
+			esc(s.name), s.runs, s.errors, s.checkRate(), s.avgScore(), avgMs)
+	}
+	b.WriteString("</table>\n")
+
+	b.WriteString("<h2>Outputs</h2>\n<table><tr><th>input</th>")
+	for _, v := range c.Variants {
+		fmt.Fprintf(&b, "<th>%s</th>", esc(v.Name))
+	}
+	b.WriteString("</tr>\n")
+	for i, row := range res.Rows {
+		fmt.Fprintf(&b, "<tr><td><pre>%s</pre></td>", esc(rowText(row)))
+		for _, v := range c.Variants {
+			r := res.run(i, v.Name)
+			b.WriteString("<td>")
+			if r.Err != "" {
+				fmt.Fprintf(&b, "<div class=\"err\">%s</div>", esc(r.verdict(c.Checks)))
+			} else {
+				if verdict := r.verdict(c.Checks); verdict != "" {
+					fmt.Fprintf(&b, "<div class=\"verdict\">%s</div>", esc(verdict))
+				}
+				fmt.Fprintf(&b, "<pre>%s</pre>", esc(strings.TrimSpace(r.Output)))
+			}
+			b.WriteString("</td>")
+		}
+		b.WriteString("</tr>\n")
+	}
+	b.WriteString("</table>\n</body></html>\n")
+	return b.String()
+}
@@ -0,0 +1,373 @@
+// Package fixture records the model calls and input values of a workflow run
+// and replays them later with a fake provider, so recipes can be
+// regression-tested offline (e.g. from go test) without an API key.
+package fixture
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"cli-gpt-flows/internal/cache"
+	"cli-gpt-flows/internal/llm"
+)
+
+// FileName is the fixture file inside a --record/--replay directory.
+const FileName = "fixture.json"
+
+// Fixture is everything a run took from the outside world.
+type Fixture struct {
+	// Inputs are the values of `input` steps, by step id.
+	Inputs map[string]string `json:"inputs"`
+	// Refined holds the version accepted in interactive_refine steps.
+	Refined map[string]string `json:"refined,omitempty"`
+	Calls   []Call            `json:"calls"`
+	// Embeddings are the embedding calls of embed and retrieve steps.
+	Embeddings []EmbedCall `json:"embeddings,omitempty"`
+}
+
+// Call is one recorded model call. Key identifies the request (see
+// cache.Key); Prompt is kept only so the file is readable and diffable.
+// Calls that failed in a way a fallback model reacts to keep the error
+// instead of a response, so the fallback happens again on replay.
+type Call struct {
+	Step     string       `json:"step"`
+	Provider string       `json:"provider"`
+	Model    string       `json:"model"`
+	Key      string       `json:"key"`
+	Prompt   string       `json:"prompt"`
+	Response llm.Response `json:"response"`
+
+	// Error is ErrNotFound, ErrQuota or ErrBlocked; Message is the original
+	// error text and Blocked the details of a blocked response.
+	Error   string            `json:"error,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Blocked *llm.BlockedError `json:"blocked,omitempty"`
+}
+
+// EmbedCall is one recorded embedding call. Key identifies the provider,
+// model and texts (see embedKey); Texts are kept for readability.
+type EmbedCall struct {
+	Step     string      `json:"step"`
+	Provider string      `json:"provider"`
+	Model    string      `json:"model"`
+	Key      string      `json:"key"`
+	Texts    []string    `json:"texts"`
+	Vectors  [][]float32 `json:"vectors"`
+}
+
+// embedKey identifies an embedding request.
+func embedKey(provider, model string, texts []string) string {
+	b, _ := json.Marshal(struct {
+		Provider string   `json:"provider"`
+		Model    string   `json:"model"`
+		Texts    []string `json:"texts"`
+	}{provider, model, texts})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Error classes of recorded calls.
+const (
+	ErrNotFound = "not_found"
+	ErrQuota    = "quota"
+	ErrBlocked  = "blocked"
+)
+
+// errorClass returns the class of err, or "" for errors that aren't recorded.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, llm.ErrModelNotFound):
+		return ErrNotFound
+	case errors.Is(err, llm.ErrQuotaExceeded):
+		return ErrQuota
+	case errors.Is(err, llm.ErrBlocked):
+		return ErrBlocked
+	}
+	return ""
+}
+
+// err rebuilds the error of a failed call as the matching llm error.
+func (c Call) err() error {
+	switch c.Error {
+	case ErrBlocked:
+		if c.Blocked != nil {
+			return c.Blocked
+		}
+		return &llm.BlockedError{}
+	case ErrNotFound:
+		return recordedError{class: llm.ErrModelNotFound, msg: c.Message}
+	case ErrQuota:
+		return recordedError{class: llm.ErrQuotaExceeded, msg: c.Message}
+	}
+	return fmt.Errorf("recorded call failed with unknown error %q: %s", c.Error, c.Message)
+}
+
+// recordedError is a replayed failure: the recorded message, matching the
+// llm error it was classified as.
+type recordedError struct {
+	class error
+	msg   string
+}
+
+func (e recordedError) Error() string {
+	if e.msg == "" {
+		return e.class.Error()
+	}
+	return e.msg
+}
+
+func (e recordedError) Unwrap() error { return e.class }
+
+// Load reads dir/fixture.json.
+func Load(dir string) (*Fixture, error) {
+	path := filepath.Join(dir, FileName)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read fixture: %w", err)
+	}
+	var f Fixture
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("parse fixture %s: %w", path, err)
+	}
+	if f.Inputs == nil {
+		f.Inputs = map[string]string{}
+	}
+	return &f, nil
+}
+
+// Save writes the fixture to dir/fixture.json, creating dir if needed. The
+// fixture holds full prompts and responses, so both are private to the user.
+func (f *Fixture) Save(dir string) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, FileName)
+	if err := os.WriteFile(path, append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of a file that already exists.
+	return os.Chmod(path, 0o600)
+}
+
+// Recorder collects a fixture while a run talks to real providers.
+type Recorder struct {
+	mu sync.Mutex
+	f  Fixture
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{f: Fixture{Inputs: map[string]string{}}}
+}
+
+// RecordInput stores the value entered for an input step.
+func (r *Recorder) RecordInput(stepID, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.f.Inputs[stepID] = value
+}
+
+// RecordRefined stores the version accepted in an interactive_refine step.
+func (r *Recorder) RecordRefined(stepID, text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f.Refined == nil {
+		r.f.Refined = map[string]string{}
+	}
+	r.f.Refined[stepID] = text
+}
+
+// Wrap returns a provider that passes calls through to p and records them.
+func (r *Recorder) Wrap(stepID, provider string, p llm.Provider) llm.Provider {
+	rp := &recordingProvider{r: r, stepID: stepID, provider: provider, p: p}
+	if sp, ok := p.(llm.StreamProvider); ok {
+		return &recordingStreamProvider{recordingProvider: rp, sp: sp}
+	}
+	return rp
+}
+
+// WrapEmbedder returns an embedder that passes calls through to emb and
+// records them.
+func (r *Recorder) WrapEmbedder(stepID, provider string, emb llm.Embedder) llm.Embedder {
+	return &recordingEmbedder{r: r, stepID: stepID, provider: provider, emb: emb}
+}
+
+// Save writes what has been recorded so far.
+func (r *Recorder) Save(dir string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Save(dir)
+}
+
+// record stores a call. Failed calls are only kept when errorClass knows
+// them; other failures end the run anyway.
+func (r *Recorder) record(stepID, provider string, req llm.Request, resp llm.Response, err error) {
+	c := Call{
+		Step:     stepID,
+		Provider: provider,
+		Model:    req.Model,
+		Key:      cache.Key(provider, "", req),
+		Prompt:   req.UserPrompt,
+		Response: resp,
+	}
+	if err != nil {
+		c.Response = llm.Response{}
+		if c.Error = errorClass(err); c.Error == "" {
+			return
+		}
+		c.Message = err.Error()
+		var blocked *llm.BlockedError
+		if errors.As(err, &blocked) {
+			c.Blocked = blocked
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.f.Calls = append(r.f.Calls, c)
+}
+
+type recordingProvider struct {
+	r        *Recorder
+	stepID   string
+	provider string
+	p        llm.Provider
+}
+
+func (p *recordingProvider) Generate(ctx context.Context, req llm.Request) (llm.Response, error) {
+	resp, err := p.p.Generate(ctx, req)
+	p.r.record(p.stepID, p.provider, req, resp, err)
+	return resp, err
+}
+
+type recordingStreamProvider struct {
+	*recordingProvider
+	sp llm.StreamProvider
+}
+
+func (p *recordingStreamProvider) GenerateStream(ctx context.Context, req llm.Request, onText func(string)) (llm.Response, error) {
+	resp, err := p.sp.GenerateStream(ctx, req, onText)
+	p.r.record(p.stepID, p.provider, req, resp, err)
+	return resp, err
+}
+
+type recordingEmbedder struct {
+	r        *Recorder
+	stepID   string
+	provider string
+	emb      llm.Embedder
+}
+
+func (p *recordingEmbedder) Embed(ctx context.Context, model string, texts []string) ([][]float32, error) {
+	vecs, err := p.emb.Embed(ctx, model, texts)
+	if err != nil {
+		return nil, err
+	}
+	p.r.mu.Lock()
+	defer p.r.mu.Unlock()
+	p.r.f.Embeddings = append(p.r.f.Embeddings, EmbedCall{
+		Step:     p.stepID,
+		Provider: p.provider,
+		Model:    model,
+		Key:      embedKey(p.provider, model, texts),
+		Texts:    texts,
+		Vectors:  vecs,
+	})
+	return vecs, nil
+}
+
+// Replayer answers model calls from a fixture.
+type Replayer struct {
+	f *Fixture
+
+	mu   sync.Mutex
+	used map[int]bool
+}
+
+func NewReplayer(f *Fixture) *Replayer {
+	return &Replayer{f: f, used: map[int]bool{}}
+}
+
+// Inputs returns the recorded input values.
+func (r *Replayer) Inputs() map[string]string {
+	return r.f.Inputs
+}
+
+// Refined returns the accepted version of an interactive_refine step.
+func (r *Replayer) Refined(stepID string) (string, bool) {
+	text, ok := r.f.Refined[stepID]
+	return text, ok
+}
+
+// Provider returns the fake provider for one step.
+func (r *Replayer) Provider(stepID, provider string) llm.Provider {
+	return &replayProvider{r: r, stepID: stepID, provider: provider}
+}
+
+// lookup returns the first unused call recorded for the same request, or its
+// error if it failed. When a request was made more than once, the calls are
+// handed out in order and the last one is reused after that.
+func (r *Replayer) lookup(stepID, provider string, req llm.Request) (llm.Response, error) {
+	key := cache.Key(provider, "", req)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	last := -1
+	for i, c := range r.f.Calls {
+		if c.Key != key {
+			continue
+		}
+		last = i
+		if !r.used[i] {
+			r.used[i] = true
+			return c.result()
+		}
+	}
+	if last >= 0 {
+		return r.f.Calls[last].result()
+	}
+	return llm.Response{}, fmt.Errorf("no recorded response for this request of step %s (model %s); the prompt or settings changed since recording, re-record the fixture", stepID, req.Model)
+}
+
+func (c Call) result() (llm.Response, error) {
+	if c.Error != "" {
+		return llm.Response{}, c.err()
+	}
+	return c.Response, nil
+}
+
+type replayProvider struct {
+	r        *Replayer
+	stepID   string
+	provider string
+}
+
+func (p *replayProvider) Generate(_ context.Context, req llm.Request) (llm.Response, error) {
+	return p.r.lookup(p.stepID, p.provider, req)
+}
+
+func (p *replayProvider) GenerateStream(_ context.Context, req llm.Request, onText func(string)) (llm.Response, error) {
+	resp, err := p.r.lookup(p.stepID, p.provider, req)
+	if err == nil && onText != nil {
+		onText(resp.Text)
+	}
+	return resp, err
+}
+
+func (p *replayProvider) Embed(_ context.Context, model string, texts []string) ([][]float32, error) {
+	key := embedKey(p.provider, model, texts)
+	for _, c := range p.r.f.Embeddings {
+		if c.Key == key {
+			return c.Vectors, nil
+		}
+	}
+	return nil, fmt.Errorf("no recorded embeddings for this request of step %s (model %s); the texts or settings changed since recording, re-record the fixture", p.stepID, model)
+}
@@ -1,17 +1,34 @@
 package gemini
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"cli-gpt-flows/internal/llm"
 
 	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
 type Client struct {
 	client *genai.Client
+
+	// uploads maps attachment content hashes to files already sent through
+	// the File API, so retries and follow-up turns don't upload them again.
+	mu      sync.Mutex
+	uploads map[string]*genai.File
 }
 
 // CallGemini matches the required MVP signature.
@@ -23,7 +40,11 @@ func CallGemini(model, systemPrompt, userPrompt string) (string, error) {
 		return "", err
 	}
 	defer c.Close()
-	return c.Generate(ctx, model, systemPrompt, userPrompt)
+	resp, err := c.Generate(ctx, llm.Request{Model: model, SystemPrompt: systemPrompt, UserPrompt: userPrompt})
+	if err != nil {
+		return "", err
+	}
+	return resp.Text, nil
 }
 
 func NewClientFromEnv(ctx context.Context) (*Client, error) {
@@ -35,59 +56,599 @@ func NewClientFromEnv(ctx context.Context) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{client: c}, nil
+	return &Client{client: c, uploads: map[string]*genai.File{}}, nil
 }
 
+// Close deletes the attachments uploaded by this client and closes it.
 func (c *Client) Close() {
 	if c == nil || c.client == nil {
 		return
 	}
+	c.mu.Lock()
+	for _, f := range c.uploads {
+		// Uploaded files expire on their own; deleting is just tidy.
+		_ = c.client.DeleteFile(context.Background(), f.Name)
+	}
+	c.uploads = nil
+	c.mu.Unlock()
 	_ = c.client.Close()
 }
 
-func (c *Client) Generate(ctx context.Context, model, systemPrompt, userPrompt string) (string, error) {
+func (c *Client) Generate(ctx context.Context, req llm.Request) (llm.Response, error) {
+	if len(req.History) > 0 {
+		// ChatSession.SendMessage streams internally and its merged response
+		// keeps the first chunk's usage metadata (joinResponses in genai
+		// v0.20.1), so conversation turns read the final one from the stream.
+		return c.GenerateStream(ctx, req, nil)
+	}
+	m, err := c.model(req)
+	if err != nil {
+		return llm.Response{}, err
+	}
+	_, parts, err := c.contents(ctx, req)
+	if err != nil {
+		return llm.Response{}, err
+	}
+	resp, err := m.GenerateContent(ctx, parts...)
+	if err != nil {
+		return llm.Response{}, classify(err)
+	}
+	out, err := parseResponse(resp)
+	if err != nil {
+		return llm.Response{}, err
+	}
+	out.Usage = usageOf(resp.UsageMetadata)
+	return out, nil
+}
+
+// GenerateStream is like Generate but calls onText with each chunk of text as it arrives.
+// The returned response holds the full text.
+func (c *Client) GenerateStream(ctx context.Context, req llm.Request, onText func(string)) (llm.Response, error) {
+	m, err := c.model(req)
+	if err != nil {
+		return llm.Response{}, err
+	}
+
+	history, parts, err := c.contents(ctx, req)
+	if err != nil {
+		return llm.Response{}, err
+	}
+
+	var iter *genai.GenerateContentResponseIterator
+	if len(history) == 0 {
+		iter = m.GenerateContentStream(ctx, parts...)
+	} else {
+		cs := m.StartChat()
+		cs.History = history
+		iter = cs.SendMessageStream(ctx, parts...)
+	}
+	var usage *genai.UsageMetadata
+	for {
+		resp, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return llm.Response{}, classify(err)
+		}
+		if resp.UsageMetadata != nil {
+			usage = resp.UsageMetadata
+		}
+		// Chunks may legitimately carry no text (e.g. the final usage-only chunk).
+		if chunk, err := parseResponse(resp); err == nil && chunk.Text != "" && onText != nil {
+			onText(chunk.Text)
+		}
+	}
+
+	out, err := parseResponse(iter.MergedResponse())
+	if err != nil {
+		return llm.Response{}, err
+	}
+	out.Usage = usageOf(usage)
+	return out, nil
+}
+
+func usageOf(u *genai.UsageMetadata) llm.Usage {
+	if u == nil {
+		return llm.Usage{}
+	}
+	return llm.Usage{
+		PromptTokens:    int(u.PromptTokenCount),
+		CandidateTokens: int(u.CandidatesTokenCount),
+		TotalTokens:     int(u.TotalTokenCount),
+	}
+}
+
+// CountTokens asks the API how many input tokens req would use. History and
+// inline attachments are counted; attachments that go through the File API
+// are left out rather than uploaded just to be measured.
+func (c *Client) CountTokens(ctx context.Context, req llm.Request) (int, error) {
+	m, err := c.model(req)
+	if err != nil {
+		return 0, err
+	}
+	var parts []genai.Part
+	for _, msg := range req.History {
+		parts = append(parts, messageContent(msg).Parts...)
+	}
+	for i, inline := range inlined(req.Attachments) {
+		if inline {
+			a := req.Attachments[i]
+			parts = append(parts, genai.Blob{MIMEType: a.MIMEType, Data: a.Data})
+		}
+	}
+	if req.UserPrompt != "" {
+		parts = append(parts, genai.Text(req.UserPrompt))
+	}
+	if len(parts) == 0 {
+		return 0, nil
+	}
+	res, err := m.CountTokens(ctx, parts...)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.TotalTokens), nil
+}
+
+// InputTokenLimit looks up the model's context window.
+func (c *Client) InputTokenLimit(ctx context.Context, model string) (int, error) {
+	if c == nil || c.client == nil {
+		return 0, errors.New("gemini client not initialized")
+	}
+	info, err := c.client.GenerativeModel(model).Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return int(info.InputTokenLimit), nil
+}
+
+// DefaultEmbeddingModel is used by embed and retrieve steps without a model.
+const DefaultEmbeddingModel = "text-embedding-004"
+
+// maxEmbedBatch is the most texts the API embeds in one request.
+const maxEmbedBatch = 100
+
+// Embed returns one embedding per text, batching requests as needed.
+func (c *Client) Embed(ctx context.Context, model string, texts []string) ([][]float32, error) {
 	if c == nil || c.client == nil {
-		return "", errors.New("gemini client not initialized")
+		return nil, errors.New("gemini client not initialized")
 	}
-	if model == "" {
-		return "", errors.New("model is required")
+	em := c.client.EmbeddingModel(model)
+	out := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += maxEmbedBatch {
+		end := min(start+maxEmbedBatch, len(texts))
+		b := em.NewBatch()
+		for _, t := range texts[start:end] {
+			b.AddContent(genai.Text(t))
+		}
+		res, err := em.BatchEmbedContents(ctx, b)
+		if err != nil {
+			return nil, classify(err)
+		}
+		if len(res.Embeddings) != end-start {
+			return nil, fmt.Errorf("embedding response has %d vectors for %d texts", len(res.Embeddings), end-start)
+		}
+		for _, e := range res.Embeddings {
+			out = append(out, e.Values)
+		}
 	}
+	return out, nil
+}
 
-	m := c.client.GenerativeModel(model)
-	if systemPrompt != "" {
-		m.SystemInstruction = &genai.Content{Parts: []genai.Part{genai.Text(systemPrompt)}}
+// contents splits a request into the chat history and the parts of the turn
+// being sent.
+func (c *Client) contents(ctx context.Context, req llm.Request) ([]*genai.Content, []genai.Part, error) {
+	var history []*genai.Content
+	for _, msg := range req.History {
+		history = append(history, messageContent(msg))
 	}
 
-	resp, err := m.GenerateContent(ctx, genai.Text(userPrompt))
+	if req.UserPrompt == "" && len(req.Attachments) == 0 {
+		if len(history) == 0 {
+			return nil, nil, errors.New("prompt is empty")
+		}
+		last := history[len(history)-1]
+		return history[:len(history)-1], last.Parts, nil
+	}
+
+	parts, err := c.parts(ctx, req)
 	if err != nil {
-		return "", err
+		return nil, nil, err
+	}
+	return history, parts, nil
+}
+
+func messageContent(msg llm.Message) *genai.Content {
+	content := &genai.Content{Role: msg.Role}
+	if msg.Text != "" {
+		content.Parts = append(content.Parts, genai.Text(msg.Text))
+	}
+	for _, call := range msg.ToolCalls {
+		content.Parts = append(content.Parts, genai.FunctionCall{Name: call.Name, Args: call.Args})
+	}
+	for _, res := range msg.ToolResults {
+		content.Parts = append(content.Parts, genai.FunctionResponse{Name: res.Name, Response: res.Output})
+	}
+	return content
+}
+
+func (c *Client) model(req llm.Request) (*genai.GenerativeModel, error) {
+	if c == nil || c.client == nil {
+		return nil, errors.New("gemini client not initialized")
+	}
+	if req.Model == "" {
+		return nil, errors.New("model is required")
+	}
+
+	m := c.client.GenerativeModel(req.Model)
+	if req.SystemPrompt != "" {
+		m.SystemInstruction = &genai.Content{Parts: []genai.Part{genai.Text(req.SystemPrompt)}}
+	}
+	if err := applyGenerationConfig(m, req.Generation); err != nil {
+		return nil, err
+	}
+	for category, threshold := range req.Safety {
+		c, ok := harmCategories[category]
+		if !ok {
+			return nil, fmt.Errorf("unknown safety category %s", category)
+		}
+		t, ok := blockThresholds[threshold]
+		if !ok {
+			return nil, fmt.Errorf("unknown safety threshold %s", threshold)
+		}
+		m.SafetySettings = append(m.SafetySettings, &genai.SafetySetting{Category: c, Threshold: t})
 	}
+	if req.ResponseFormat == llm.FormatJSON {
+		m.ResponseMIMEType = "application/json"
+		if req.ResponseSchema != nil {
+			schema, err := schemaFromJSON(req.ResponseSchema)
+			if err != nil {
+				return nil, fmt.Errorf("response_schema: %w", err)
+			}
+			m.ResponseSchema = schema
+		}
+	}
+	if len(req.Tools) > 0 {
+		tool := &genai.Tool{}
+		for _, t := range req.Tools {
+			decl := &genai.FunctionDeclaration{Name: t.Name, Description: t.Description}
+			if t.Parameters != nil {
+				schema, err := schemaFromJSON(t.Parameters)
+				if err != nil {
+					return nil, fmt.Errorf("tool %s: %w", t.Name, err)
+				}
+				decl.Parameters = schema
+			}
+			tool.FunctionDeclarations = append(tool.FunctionDeclarations, decl)
+		}
+		m.Tools = []*genai.Tool{tool}
+	}
+	return m, nil
+}
+
+// maxInlineBytes is how much attachment data is inlined into one request;
+// the rest goes through the File API. Gemini caps a whole inline request at
+// 20MB, which leaves room for the prompt and history.
+const maxInlineBytes = 15 << 20
+
+// inlined decides per attachment whether it is inlined, in order, while the
+// total stays within maxInlineBytes.
+func inlined(attachments []llm.Attachment) []bool {
+	out := make([]bool, len(attachments))
+	budget := maxInlineBytes
+	for i, a := range attachments {
+		if len(a.Data) <= budget {
+			out[i] = true
+			budget -= len(a.Data)
+		}
+	}
+	return out
+}
+
+// parts builds the request content: attachments first, then the prompt text.
+// Attachments over the inline budget are uploaded (once per client).
+func (c *Client) parts(ctx context.Context, req llm.Request) ([]genai.Part, error) {
+	var parts []genai.Part
+	for i, inline := range inlined(req.Attachments) {
+		a := req.Attachments[i]
+		if inline {
+			parts = append(parts, genai.Blob{MIMEType: a.MIMEType, Data: a.Data})
+			continue
+		}
+		f, err := c.uploadOnce(ctx, a)
+		if err != nil {
+			return nil, fmt.Errorf("upload attachment %s: %w", a.Name, err)
+		}
+		parts = append(parts, genai.FileData{MIMEType: f.MIMEType, URI: f.URI})
+	}
+	if req.UserPrompt != "" {
+		parts = append(parts, genai.Text(req.UserPrompt))
+	}
+	return parts, nil
+}
+
+// uploadOnce uploads an attachment unless the same content was uploaded
+// before by this client.
+func (c *Client) uploadOnce(ctx context.Context, a llm.Attachment) (*genai.File, error) {
+	sum := sha256.Sum256(a.Data)
+	key := a.MIMEType + ":" + hex.EncodeToString(sum[:])
 
-	text, err := firstCandidateText(resp)
+	c.mu.Lock()
+	f, ok := c.uploads[key]
+	c.mu.Unlock()
+	if ok {
+		return f, nil
+	}
+	f, err := c.upload(ctx, a)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.uploads == nil {
+		c.uploads = map[string]*genai.File{}
+	}
+	c.uploads[key] = f
+	c.mu.Unlock()
+	return f, nil
+}
+
+// upload sends an attachment through the File API and waits until Gemini has
+// finished processing it (audio and video take a moment).
+func (c *Client) upload(ctx context.Context, a llm.Attachment) (*genai.File, error) {
+	f, err := c.client.UploadFile(ctx, "", bytes.NewReader(a.Data), &genai.UploadFileOptions{
+		DisplayName: a.Name,
+		MIMEType:    a.MIMEType,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for f.State == genai.FileStateProcessing {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+		if f, err = c.client.GetFile(ctx, f.Name); err != nil {
+			return nil, err
+		}
+	}
+	if f.State != genai.FileStateActive {
+		return nil, fmt.Errorf("file processing ended in state %s", f.State)
+	}
+	return f, nil
+}
+
+func applyGenerationConfig(m *genai.GenerativeModel, g llm.GenerationConfig) error {
+	if g.Seed != nil {
+		// Not exposed by the generative-ai-go SDK we build against.
+		return errors.New("seed is not supported by the gemini provider")
+	}
+	if g.Temperature != nil {
+		m.SetTemperature(*g.Temperature)
+	}
+	if g.TopP != nil {
+		m.SetTopP(*g.TopP)
+	}
+	if g.TopK != nil {
+		m.SetTopK(*g.TopK)
+	}
+	if g.MaxOutputTokens != nil {
+		m.SetMaxOutputTokens(*g.MaxOutputTokens)
+	}
+	if g.CandidateCount != nil {
+		m.SetCandidateCount(*g.CandidateCount)
+	}
+	if len(g.StopSequences) > 0 {
+		m.StopSequences = g.StopSequences
+	}
+	return nil
+}
+
+var schemaTypes = map[string]genai.Type{
+	"object":  genai.TypeObject,
+	"array":   genai.TypeArray,
+	"string":  genai.TypeString,
+	"number":  genai.TypeNumber,
+	"integer": genai.TypeInteger,
+	"boolean": genai.TypeBoolean,
+}
+
+// schemaFromJSON maps a JSON Schema document onto Gemini's OpenAPI-style schema.
+// A `type: [T, "null"]` list becomes a nullable T.
+func schemaFromJSON(in map[string]any) (*genai.Schema, error) {
+	out := &genai.Schema{}
+
+	var names []string
+	switch t := in["type"].(type) {
+	case string:
+		names = []string{t}
+	case []any:
+		for _, v := range t {
+			if s, ok := v.(string); ok {
+				names = append(names, s)
+			}
+		}
+	}
+	for _, name := range names {
+		if name == "null" {
+			out.Nullable = true
+			continue
+		}
+		t, ok := schemaTypes[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported type %q", name)
+		}
+		if out.Type != genai.TypeUnspecified {
+			return nil, errors.New("gemini schemas support a single type (plus null)")
+		}
+		out.Type = t
+	}
+
+	out.Description, _ = in["description"].(string)
+	out.Format, _ = in["format"].(string)
+	if enum, ok := in["enum"].([]any); ok {
+		// Gemini only accepts enums of strings, on string schemas.
+		if out.Type != genai.TypeString && out.Type != genai.TypeUnspecified {
+			return nil, errors.New("gemini schemas only support enum on string types; use a string enum or drop it")
+		}
+		for _, v := range enum {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("gemini schemas only support string enum values, got %v", v)
+			}
+			out.Enum = append(out.Enum, s)
+		}
+		out.Type = genai.TypeString
+	}
+	if req, ok := in["required"].([]any); ok {
+		for _, v := range req {
+			if s, ok := v.(string); ok {
+				out.Required = append(out.Required, s)
+			}
+		}
+	}
+	if props, ok := in["properties"].(map[string]any); ok {
+		out.Properties = map[string]*genai.Schema{}
+		for name, raw := range props {
+			sub, ok := raw.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("properties.%s must be a mapping", name)
+			}
+			s, err := schemaFromJSON(sub)
+			if err != nil {
+				return nil, fmt.Errorf("properties.%s: %w", name, err)
+			}
+			out.Properties[name] = s
+		}
+	}
+	if items, ok := in["items"].(map[string]any); ok {
+		s, err := schemaFromJSON(items)
+		if err != nil {
+			return nil, fmt.Errorf("items: %w", err)
+		}
+		out.Items = s
+	}
+	return out, nil
+}
+
+// classify wraps API failures in the llm errors callers inspect.
+func classify(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %w", llm.ErrModelNotFound, err)
+		case http.StatusTooManyRequests:
+			return fmt.Errorf("%w: %w", llm.ErrQuotaExceeded, err)
+		}
+	}
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		out := &llm.BlockedError{}
+		if c := blocked.Candidate; c != nil {
+			out.FinishReason = enumName(c.FinishReason.String(), "FinishReason")
+			out.Ratings = ratings(c.SafetyRatings)
+		}
+		if f := blocked.PromptFeedback; f != nil {
+			out.BlockReason = enumName(f.BlockReason.String(), "BlockReason")
+			out.Ratings = append(out.Ratings, ratings(f.SafetyRatings)...)
+		}
+		return out
+	}
+	return err
+}
+
+var harmCategories = map[string]genai.HarmCategory{
+	llm.HarmHarassment:       genai.HarmCategoryHarassment,
+	llm.HarmHateSpeech:       genai.HarmCategoryHateSpeech,
+	llm.HarmSexuallyExplicit: genai.HarmCategorySexuallyExplicit,
+	llm.HarmDangerousContent: genai.HarmCategoryDangerousContent,
+}
+
+var blockThresholds = map[string]genai.HarmBlockThreshold{
+	llm.BlockNone:           genai.HarmBlockNone,
+	llm.BlockOnlyHigh:       genai.HarmBlockOnlyHigh,
+	llm.BlockMediumAndAbove: genai.HarmBlockMediumAndAbove,
+	llm.BlockLowAndAbove:    genai.HarmBlockLowAndAbove,
+}
+
+func ratings(in []*genai.SafetyRating) []llm.SafetyRating {
+	var out []llm.SafetyRating
+	for _, r := range in {
+		if r == nil {
+			continue
+		}
+		category := enumName(r.Category.String(), "HarmCategory")
+		for name, c := range harmCategories {
+			if c == r.Category {
+				category = name
+			}
+		}
+		out = append(out, llm.SafetyRating{
+			Category:    category,
+			Probability: enumName(r.Probability.String(), "HarmProbability"),
+			Blocked:     r.Blocked,
+		})
+	}
+	return out
+}
+
+// enumName turns the SDK's enum names (FinishReasonMaxTokens) into the API's
+// (MAX_TOKENS), which is what the docs and error messages people search use.
+func enumName(s, prefix string) string {
+	s = strings.TrimPrefix(s, prefix)
+	var b strings.Builder
+	for i, r := range s {
+		if i > 0 && unicode.IsUpper(r) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// noText explains why a response carried no text: a blocked prompt or
+// candidate becomes a *llm.BlockedError, anything else a plain error.
+func noText(resp *genai.GenerateContentResponse, fallback string) error {
+	if resp != nil && resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != genai.BlockReasonUnspecified {
+		return classify(&genai.BlockedError{PromptFeedback: resp.PromptFeedback})
+	}
+	if resp == nil || len(resp.Candidates) == 0 || resp.Candidates[0] == nil {
+		return errors.New(fallback)
+	}
+	c := resp.Candidates[0]
+	switch c.FinishReason {
+	case genai.FinishReasonUnspecified, genai.FinishReasonStop:
+		return errors.New(fallback)
+	case genai.FinishReasonMaxTokens:
+		return fmt.Errorf("%s (finish reason: MAX_TOKENS; raise generation.max_output_tokens)", fallback)
+	default:
+		return classify(&genai.BlockedError{Candidate: c})
 	}
-	return text, nil
 }
 
-func firstCandidateText(resp *genai.GenerateContentResponse) (string, error) {
+// parseResponse collects the text and function calls of the first candidate.
+func parseResponse(resp *genai.GenerateContentResponse) (llm.Response, error) {
 	if resp == nil || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
-		return "", errors.New("empty response")
+		return llm.Response{}, noText(resp, "empty response")
 	}
 
-	var out string
-	for _, part := range resp.Candidates[0].Content.Parts {
+	var out llm.Response
+	for i, part := range resp.Candidates[0].Content.Parts {
 		switch v := part.(type) {
 		case genai.Text:
-			out += string(v)
+			out.Text += string(v)
+		case genai.FunctionCall:
+			// Gemini doesn't assign call ids; results are matched by name and order.
+			out.ToolCalls = append(out.ToolCalls, llm.ToolCall{ID: fmt.Sprintf("%s-%d", v.Name, i), Name: v.Name, Args: v.Args})
 		case fmt.Stringer:
-			out += v.String()
+			out.Text += v.String()
 		default:
-			// ignore non-text parts for MVP
+			// ignore other non-text parts for MVP
 		}
 	}
-	if out == "" {
-		return "", errors.New("no text in response")
+	if out.Text == "" && len(out.ToolCalls) == 0 {
+		return llm.Response{}, noText(resp, "no text in response")
 	}
 	return out, nil
 }
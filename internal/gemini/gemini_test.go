@@ -0,0 +1,77 @@
+package gemini
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"cli-gpt-flows/internal/llm"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestParseResponse_ReportsBlockedCandidate(t *testing.T) {
+	resp := &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{
+		FinishReason: genai.FinishReasonSafety,
+		SafetyRatings: []*genai.SafetyRating{
+			{Category: genai.HarmCategoryHarassment, Probability: genai.HarmProbabilityHigh, Blocked: true},
+			{Category: genai.HarmCategoryHateSpeech, Probability: genai.HarmProbabilityNegligible},
+		},
+	}}}
+
+	_, err := parseResponse(resp)
+	if !errors.Is(err, llm.ErrBlocked) {
+		t.Fatalf("expected ErrBlocked, got %v", err)
+	}
+	var blocked *llm.BlockedError
+	if !errors.As(err, &blocked) {
+		t.Fatalf("expected *llm.BlockedError, got %T", err)
+	}
+	if blocked.FinishReason != "SAFETY" {
+		t.Fatalf("expected finish reason SAFETY, got %q", blocked.FinishReason)
+	}
+	if len(blocked.Ratings) != 2 || blocked.Ratings[0] != (llm.SafetyRating{Category: llm.HarmHarassment, Probability: "HIGH", Blocked: true}) {
+		t.Fatalf("unexpected ratings %+v", blocked.Ratings)
+	}
+	if !strings.Contains(err.Error(), "harassment=HIGH (blocked)") {
+		t.Fatalf("expected ratings in message, got %q", err)
+	}
+}
+
+func TestParseResponse_ExplainsMaxTokens(t *testing.T) {
+	resp := &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{
+		FinishReason: genai.FinishReasonMaxTokens,
+		Content:      &genai.Content{},
+	}}}
+
+	_, err := parseResponse(resp)
+	if err == nil || errors.Is(err, llm.ErrBlocked) || !strings.Contains(err.Error(), "MAX_TOKENS") {
+		t.Fatalf("expected a MAX_TOKENS error, got %v", err)
+	}
+}
+
+func TestInlined_KeepsTotalWithinBudget(t *testing.T) {
+	mb := func(n int) llm.Attachment { return llm.Attachment{Data: make([]byte, n<<20)} }
+	got := inlined([]llm.Attachment{mb(8), mb(8), mb(4), mb(16), mb(3)})
+	want := []bool{true, false, true, false, true}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("inlined = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSchemaFromJSON_Enums(t *testing.T) {
+	s, err := schemaFromJSON(map[string]any{"type": "string", "enum": []any{"low", "high"}})
+	if err != nil || s.Type != genai.TypeString || len(s.Enum) != 2 {
+		t.Fatalf("string enum: %+v, %v", s, err)
+	}
+	for _, in := range []map[string]any{
+		{"type": "integer", "enum": []any{1, 2, 3}},
+		{"enum": []any{"a", 2}},
+	} {
+		if _, err := schemaFromJSON(in); err == nil || !strings.Contains(err.Error(), "enum") {
+			t.Errorf("%v: expected an enum error, got %v", in, err)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Package jsonschema validates decoded JSON against the subset of JSON Schema
+// that recipes use for structured model output: type, properties, required,
+// items, enum and additionalProperties.
+package jsonschema
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+var knownTypes = map[string]struct{}{
+	"object": {}, "array": {}, "string": {}, "number": {}, "integer": {}, "boolean": {}, "null": {},
+}
+
+// Check reports whether schema itself is usable. Recipes call it at load time
+// so a typo in a schema fails before any model call.
+func Check(schema map[string]any) error {
+	return check(schema, "")
+}
+
+func check(schema map[string]any, path string) error {
+	if _, err := types(schema, path); err != nil {
+		return err
+	}
+	if raw, ok := schema["properties"]; ok {
+		props, ok := raw.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%sproperties must be a mapping", prefix(path))
+		}
+		for name, sub := range props {
+			m, ok := sub.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%sproperties.%s must be a mapping", prefix(path), name)
+			}
+			if err := check(m, join(path, name)); err != nil {
+				return err
+			}
+		}
+	}
+	if raw, ok := schema["required"]; ok {
+		if _, err := stringList(raw); err != nil {
+			return fmt.Errorf("%srequired %w", prefix(path), err)
+		}
+	}
+	if raw, ok := schema["items"]; ok {
+		m, ok := raw.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%sitems must be a mapping", prefix(path))
+		}
+		if err := check(m, path+"[]"); err != nil {
+			return err
+		}
+	}
+	if raw, ok := schema["enum"]; ok {
+		if _, ok := raw.([]any); !ok {
+			return fmt.Errorf("%senum must be a list", prefix(path))
+		}
+	}
+	if raw, ok := schema["additionalProperties"]; ok {
+		if _, ok := raw.(bool); !ok {
+			return fmt.Errorf("%sadditionalProperties must be true or false", prefix(path))
+		}
+	}
+	return nil
+}
+
+// Validate checks a value produced by encoding/json against schema and
+// returns a readable description of the first mismatch.
+func Validate(schema map[string]any, v any) error {
+	return validate(schema, v, "")
+}
+
+func validate(schema map[string]any, v any, path string) error {
+	allowed, err := types(schema, path)
+	if err != nil {
+		return err
+	}
+	if len(allowed) > 0 {
+		got := typeOf(v)
+		if !typeAllowed(allowed, got) {
+			return fmt.Errorf("%s: expected %s, got %s", where(path), strings.Join(allowed, " or "), got)
+		}
+	}
+
+	if raw, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range raw {
+			if equal(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value %v is not one of %v", where(path), v, raw)
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		required, _ := stringList(schema["required"])
+		for _, name := range required {
+			if _, ok := val[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", where(path), name)
+			}
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sub, ok := props[k].(map[string]any)
+			if !ok {
+				if extra, ok := schema["additionalProperties"].(bool); ok && !extra {
+					return fmt.Errorf("%s: unexpected property %q", where(path), k)
+				}
+				continue
+			}
+			if err := validate(sub, val[k], join(path, k)); err != nil {
+				return err
+			}
+		}
+	case []any:
+		items, ok := schema["items"].(map[string]any)
+		if !ok {
+			return nil
+		}
+		for i, item := range val {
+			if err := validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func types(schema map[string]any, path string) ([]string, error) {
+	raw, ok := schema["type"]
+	if !ok {
+		return nil, nil
+	}
+	var out []string
+	switch t := raw.(type) {
+	case string:
+		out = []string{t}
+	case []any:
+		list, err := stringList(t)
+		if err != nil {
+			return nil, fmt.Errorf("%stype %w", prefix(path), err)
+		}
+		out = list
+	default:
+		return nil, fmt.Errorf("%stype must be a string or a list of strings", prefix(path))
+	}
+	for _, t := range out {
+		if _, ok := knownTypes[t]; !ok {
+			return nil, fmt.Errorf("%stype %q is not supported", prefix(path), t)
+		}
+	}
+	return out, nil
+}
+
+func typeOf(v any) string {
+	switch n := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if n == math.Trunc(n) {
+			return "integer"
+		}
+		return "number"
+	case int, int64:
+		return "integer"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func typeAllowed(allowed []string, got string) bool {
+	for _, t := range allowed {
+		if t == got || (t == "number" && got == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b any) bool {
+	// YAML decodes enum numbers as int, JSON decodes values as float64.
+	if af, ok := toFloat(a); ok {
+		bf, ok := toFloat(b)
+		return ok && af == bf
+	}
+	return a == b
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+func stringList(raw any) ([]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	list, ok := raw.([]any)
+	if !ok {
+		return nil, errors.New("must be a list of strings")
+	}
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, errors.New("must be a list of strings")
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func prefix(path string) string {
+	if path == "" {
+		return ""
+	}
+	return path + ": "
+}
+
+func where(path string) string {
+	if path == "" {
+		return "root"
+	}
+	return path
+}
@@ -0,0 +1,76 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const customerSchema = `
+type: object
+required: [name, tier]
+properties:
+  name: {type: string}
+  tier: {type: string, enum: [free, pro]}
+  seats: {type: integer}
+  contacts:
+    type: array
+    items: {type: string}
+`
+
+func loadSchema(t *testing.T, src string) map[string]any {
+	t.Helper()
+	var schema map[string]any
+	if err := yaml.Unmarshal([]byte(src), &schema); err != nil {
+		t.Fatalf("parse schema: %v", err)
+	}
+	if err := Check(schema); err != nil {
+		t.Fatalf("check schema: %v", err)
+	}
+	return schema
+}
+
+func decode(t *testing.T, src string) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal([]byte(src), &v); err != nil {
+		t.Fatalf("parse json: %v", err)
+	}
+	return v
+}
+
+func TestValidate_AcceptsMatchingDocument(t *testing.T) {
+	schema := loadSchema(t, customerSchema)
+	v := decode(t, `{"name":"Acme","tier":"pro","seats":12,"contacts":["a@acme.test"]}`)
+	if err := Validate(schema, v); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidate_ReportsMismatchPath(t *testing.T) {
+	schema := loadSchema(t, customerSchema)
+
+	cases := map[string]string{
+		`{"tier":"pro"}`:                              `missing required property "name"`,
+		`{"name":"Acme","tier":"gold"}`:               "tier: value gold is not one of",
+		`{"name":"Acme","tier":"pro","seats":1.5}`:    "seats: expected integer, got number",
+		`{"name":"Acme","tier":"pro","contacts":[1]}`: "contacts[0]: expected string, got integer",
+	}
+	for doc, want := range cases {
+		err := Validate(schema, decode(t, doc))
+		if err == nil {
+			t.Fatalf("%s: expected error", doc)
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: expected %q in error, got %v", doc, want, err)
+		}
+	}
+}
+
+func TestCheck_RejectsUnknownType(t *testing.T) {
+	if err := Check(map[string]any{"type": "decimal"}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,212 @@
+// Package llm holds the provider-neutral types shared by the model clients
+// (gemini, openai) and the engine.
+package llm
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// Request is a single model call.
+type Request struct {
+	Model        string
+	SystemPrompt string
+	UserPrompt   string
+	Generation   GenerationConfig
+
+	// ResponseFormat is "" for free text or FormatJSON. ResponseSchema optionally
+	// constrains the JSON (a JSON Schema document decoded into Go values).
+	ResponseFormat string
+	ResponseSchema map[string]any
+
+	// Attachments are sent alongside UserPrompt (images, PDFs, audio, ...).
+	Attachments []Attachment
+
+	// History holds earlier turns of the same conversation, oldest first.
+	// UserPrompt is sent as the next user turn after them. When UserPrompt and
+	// Attachments are empty, the last History message is the turn being sent
+	// (e.g. tool results).
+	History []Message
+
+	// Tools the model may call instead of answering directly.
+	Tools []Tool
+
+	// Safety maps harm categories (HarmHarassment, ...) to block thresholds
+	// (BlockNone, ...). Categories left out keep the provider default.
+	Safety map[string]string
+}
+
+// Harm categories and block thresholds for Request.Safety.
+const (
+	HarmHarassment       = "harassment"
+	HarmHateSpeech       = "hate_speech"
+	HarmSexuallyExplicit = "sexually_explicit"
+	HarmDangerousContent = "dangerous_content"
+
+	BlockNone           = "block_none"
+	BlockOnlyHigh       = "block_only_high"
+	BlockMediumAndAbove = "block_medium_and_above"
+	BlockLowAndAbove    = "block_low_and_above"
+)
+
+const (
+	RoleUser  = "user"
+	RoleModel = "model"
+)
+
+// Message is one turn of a conversation.
+type Message struct {
+	Role string // RoleUser or RoleModel
+	Text string
+
+	ToolCalls   []ToolCall   // RoleModel: calls the model asked for
+	ToolResults []ToolResult // RoleUser: answers to those calls
+}
+
+// Tool declares a function the model can call. Parameters is a JSON Schema.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  map[string]any
+}
+
+// ToolCall is a function call requested by the model.
+type ToolCall struct {
+	ID   string // provider-assigned; echoed back in ToolResult.CallID
+	Name string
+	Args map[string]any
+}
+
+// ToolResult answers a ToolCall.
+type ToolResult struct {
+	CallID string
+	Name   string
+	Output map[string]any
+}
+
+// Attachment is a file sent to the model next to the prompt.
+type Attachment struct {
+	Name     string // file name, for display and error messages
+	MIMEType string
+	Data     []byte
+}
+
+// FormatJSON asks the provider to return a single JSON document.
+const FormatJSON = "json"
+
+// GenerationConfig tunes sampling for one call. Nil fields keep the model defaults.
+type GenerationConfig struct {
+	Temperature     *float32 `yaml:"temperature"`
+	TopP            *float32 `yaml:"top_p"`
+	TopK            *int32   `yaml:"top_k"`
+	MaxOutputTokens *int32   `yaml:"max_output_tokens"`
+	StopSequences   []string `yaml:"stop_sequences"`
+	CandidateCount  *int32   `yaml:"candidate_count"`
+	Seed            *int64   `yaml:"seed"`
+}
+
+// Response is what a provider returned for a Request: text, or tool calls
+// the caller has to answer before the model can continue.
+type Response struct {
+	Text      string
+	ToolCalls []ToolCall
+	Usage     Usage
+}
+
+// Usage is the token accounting reported for one call.
+type Usage struct {
+	PromptTokens    int
+	CandidateTokens int
+	TotalTokens     int
+}
+
+// Add returns the sum of two usages.
+func (u Usage) Add(o Usage) Usage {
+	return Usage{
+		PromptTokens:    u.PromptTokens + o.PromptTokens,
+		CandidateTokens: u.CandidateTokens + o.CandidateTokens,
+		TotalTokens:     u.TotalTokens + o.TotalTokens,
+	}
+}
+
+// Errors providers wrap so callers can tell why a call failed; a step with
+// fallback models moves on to the next model on any of them.
+var (
+	ErrModelNotFound = errors.New("model not found")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrBlocked       = errors.New("response blocked")
+)
+
+// BlockedError reports a response the provider refused or cut off. It
+// matches ErrBlocked with errors.Is; use errors.As to read the details.
+type BlockedError struct {
+	// FinishReason is why the candidate stopped (e.g. SAFETY, RECITATION),
+	// BlockReason why the prompt itself was rejected. Either may be empty.
+	FinishReason string
+	BlockReason  string
+	Ratings      []SafetyRating
+}
+
+// SafetyRating is the provider's assessment of one harm category.
+type SafetyRating struct {
+	Category    string
+	Probability string
+	Blocked     bool
+}
+
+func (e *BlockedError) Error() string {
+	var parts []string
+	if e.BlockReason != "" {
+		parts = append(parts, "prompt blocked: "+e.BlockReason)
+	}
+	if e.FinishReason != "" {
+		parts = append(parts, "finish reason: "+e.FinishReason)
+	}
+	var ratings []string
+	for _, r := range e.Ratings {
+		s := r.Category + "=" + r.Probability
+		if r.Blocked {
+			s += " (blocked)"
+		}
+		ratings = append(ratings, s)
+	}
+	if len(ratings) > 0 {
+		parts = append(parts, "ratings: "+strings.Join(ratings, ", "))
+	}
+	if len(parts) == 0 {
+		return ErrBlocked.Error()
+	}
+	return ErrBlocked.Error() + " (" + strings.Join(parts, "; ") + ")"
+}
+
+func (e *BlockedError) Is(target error) bool {
+	return target == ErrBlocked
+}
+
+// Provider is implemented by every model backend a `gemini` step can use.
+type Provider interface {
+	Generate(ctx context.Context, req Request) (Response, error)
+}
+
+// StreamProvider is implemented by providers that can hand out text while it
+// is being generated. onText receives each chunk; the Response holds the full text.
+type StreamProvider interface {
+	GenerateStream(ctx context.Context, req Request, onText func(string)) (Response, error)
+}
+
+// TokenCounter is implemented by providers that can measure a request before
+// sending it, so oversized prompts fail (or get chunked) up front.
+type TokenCounter interface {
+	// CountTokens returns the number of input tokens req would use.
+	CountTokens(ctx context.Context, req Request) (int, error)
+	// InputTokenLimit returns the model's context window, or 0 if unknown.
+	InputTokenLimit(ctx context.Context, model string) (int, error)
+}
+
+// Embedder is implemented by providers that can turn text into vectors for
+// semantic search (`embed` and `retrieve` steps).
+type Embedder interface {
+	// Embed returns one vector per text, in order.
+	Embed(ctx context.Context, model string, texts []string) ([][]float32, error)
+}
@@ -0,0 +1,101 @@
+// Package models resolves model aliases (e.g. `fast`, `smart`) used in
+// workflows to concrete model names, so recipes survive model retirements.
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvModelsFile points at a YAML alias table that overrides the defaults.
+// Without it, <user config dir>/pals-gemflows/models.yaml is used if present.
+const EnvModelsFile = "PALSGEMFLOWS_MODELS_FILE"
+
+// Aliases maps an alias to one or more models, tried in order.
+type Aliases map[string][]string
+
+// DefaultAliases are the aliases shipped with the tool.
+func DefaultAliases() Aliases {
+	return Aliases{
+		"fast":  {"gemini-2.5-flash", "gemini-2.0-flash"},
+		"smart": {"gemini-2.5-pro", "gemini-2.5-flash"},
+		"cheap": {"gemini-2.5-flash-lite", "gemini-2.0-flash"},
+	}
+}
+
+// LoadAliases returns the default aliases merged with the user's models file.
+//
+// The file maps an alias to a model or a fallback list:
+//
+//	fast: gemini-2.5-flash
+//	smart: [gemini-2.5-pro, gemini-2.5-flash]
+func LoadAliases() (Aliases, error) {
+	aliases := DefaultAliases()
+
+	path := strings.TrimSpace(os.Getenv(EnvModelsFile))
+	explicit := path != ""
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err != nil || dir == "" {
+			return aliases, nil
+		}
+		path = filepath.Join(dir, "pals-gemflows", "models.yaml")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return aliases, nil
+		}
+		return aliases, fmt.Errorf("read models %s: %w", path, err)
+	}
+	var custom map[string]yaml.Node
+	if err := yaml.Unmarshal(b, &custom); err != nil {
+		return aliases, fmt.Errorf("parse models %s: %w", path, err)
+	}
+	for alias, node := range custom {
+		var list []string
+		switch node.Kind {
+		case yaml.ScalarNode:
+			list = []string{node.Value}
+		case yaml.SequenceNode:
+			if err := node.Decode(&list); err != nil {
+				return aliases, fmt.Errorf("parse models %s: %s: %w", path, alias, err)
+			}
+		default:
+			return aliases, fmt.Errorf("parse models %s: %s must be a model or a list of models", path, alias)
+		}
+		if len(list) == 0 {
+			return aliases, fmt.Errorf("parse models %s: %s is empty", path, alias)
+		}
+		aliases[alias] = list
+	}
+	return aliases, nil
+}
+
+// Resolve expands aliases in a model list and drops duplicates, keeping the
+// first occurrence. Names that aren't aliases are kept as they are.
+func (a Aliases) Resolve(names []string) []string {
+	var out []string
+	seen := map[string]struct{}{}
+	for _, name := range names {
+		expanded, ok := a[name]
+		if !ok {
+			expanded = []string{name}
+		}
+		for _, m := range expanded {
+			if _, dup := seen[m]; dup || m == "" {
+				continue
+			}
+			seen[m] = struct{}{}
+			out = append(out, m)
+		}
+	}
+	return out
+}
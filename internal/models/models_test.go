@@ -0,0 +1,40 @@
+package models
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResolve_ExpandsAliasesAndDropsDuplicates(t *testing.T) {
+	aliases := Aliases{"smart": {"gemini-2.5-pro", "gemini-2.5-flash"}}
+
+	got := aliases.Resolve([]string{"smart", "gemini-2.5-flash", "llama3.1"})
+	want := []string{"gemini-2.5-pro", "gemini-2.5-flash", "llama3.1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestLoadAliases_MergesFileOverDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "models.yaml")
+	if err := os.WriteFile(path, []byte("fast: gemini-3-flash\nlocal: [llama3.1, qwen2.5]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(EnvModelsFile, path)
+
+	aliases, err := LoadAliases()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(aliases["fast"], []string{"gemini-3-flash"}) {
+		t.Fatalf("expected file to override default, got %v", aliases["fast"])
+	}
+	if !reflect.DeepEqual(aliases["local"], []string{"llama3.1", "qwen2.5"}) {
+		t.Fatalf("unexpected local alias %v", aliases["local"])
+	}
+	if _, ok := aliases["smart"]; !ok {
+		t.Fatalf("expected defaults to be kept")
+	}
+}
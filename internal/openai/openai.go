@@ -0,0 +1,468 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cli-gpt-flows/internal/llm"
+)
+
+const (
+	// EnvBaseURL points the client at any server speaking the OpenAI
+	// chat-completions API (OpenAI itself, llama.cpp, vLLM, Ollama, ...).
+	// Example: http://localhost:11434/v1
+	EnvBaseURL = "OPENAI_BASE_URL"
+
+	// EnvAPIKey is sent as a bearer token. Local servers usually don't need it.
+	EnvAPIKey = "OPENAI_API_KEY"
+
+	DefaultBaseURL = "https://api.openai.com/v1"
+
+	// DefaultEmbeddingModel is used by embed and retrieve steps without a model.
+	DefaultEmbeddingModel = "text-embedding-3-small"
+)
+
+type Client struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+// NewClient creates a client for an OpenAI-compatible server.
+// An empty baseURL falls back to DefaultBaseURL; a nil httpClient gets a sane timeout.
+func NewClient(baseURL, apiKey string, httpClient *http.Client) *Client {
+	baseURL = strings.TrimRight(strings.TrimSpace(baseURL), "/")
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	if httpClient == nil {
+		// Local models can be slow on long transcripts.
+		httpClient = &http.Client{Timeout: 10 * time.Minute}
+	}
+	return &Client{baseURL: baseURL, apiKey: strings.TrimSpace(apiKey), http: httpClient}
+}
+
+// BaseURL is the server the client talks to.
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+// NewClientFromEnv configures the client from OPENAI_BASE_URL and OPENAI_API_KEY.
+// The key is only required when talking to the default (hosted) endpoint.
+func NewClientFromEnv() (*Client, error) {
+	baseURL := strings.TrimSpace(os.Getenv(EnvBaseURL))
+	apiKey := strings.TrimSpace(os.Getenv(EnvAPIKey))
+	if baseURL == "" && apiKey == "" {
+		return nil, fmt.Errorf("%s or %s is not set", EnvBaseURL, EnvAPIKey)
+	}
+	return NewClient(baseURL, apiKey, nil), nil
+}
+
+// chatMessage.Content is a plain string, or a []contentPart when the message
+// carries attachments.
+type chatMessage struct {
+	Role       string     `json:"role"`
+	Content    any        `json:"content"`
+	ToolCalls  []toolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+type toolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type toolDecl struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Parameters  map[string]any `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type contentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *imageURL `json:"image_url,omitempty"`
+}
+
+type imageURL struct {
+	URL string `json:"url"`
+}
+
+type assistantMessage struct {
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	ToolCalls []toolCall `json:"tool_calls"`
+}
+
+type chatRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+	Stream   bool          `json:"stream,omitempty"`
+	// StreamOptions asks for a final chunk carrying token usage.
+	StreamOptions *streamOptions `json:"stream_options,omitempty"`
+	Temperature   *float32       `json:"temperature,omitempty"`
+	TopP          *float32       `json:"top_p,omitempty"`
+	MaxTokens     *int32         `json:"max_tokens,omitempty"`
+	Stop          []string       `json:"stop,omitempty"`
+	N             *int32         `json:"n,omitempty"`
+	Seed          *int64         `json:"seed,omitempty"`
+	// TopK is not part of the OpenAI API but llama.cpp, vLLM and Ollama accept it.
+	TopK *int32 `json:"top_k,omitempty"`
+
+	ResponseFormat *responseFormat `json:"response_format,omitempty"`
+	Tools          []toolDecl      `json:"tools,omitempty"`
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func (u *usage) toLLM() llm.Usage {
+	if u == nil {
+		return llm.Usage{}
+	}
+	return llm.Usage{PromptTokens: u.PromptTokens, CandidateTokens: u.CompletionTokens, TotalTokens: u.TotalTokens}
+}
+
+type responseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *jsonSchema `json:"json_schema,omitempty"`
+}
+
+type jsonSchema struct {
+	Name   string         `json:"name"`
+	Schema map[string]any `json:"schema"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message      assistantMessage `json:"message"`
+		FinishReason string           `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *usage `json:"usage"`
+}
+
+type chatChunk struct {
+	Choices []struct {
+		Delta assistantMessage `json:"delta"`
+	} `json:"choices"`
+	Usage *usage `json:"usage"`
+}
+
+type errorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (c *Client) Generate(ctx context.Context, req llm.Request) (llm.Response, error) {
+	body, err := c.chatRequest(req)
+	if err != nil {
+		return llm.Response{}, err
+	}
+
+	var resp chatResponse
+	if err := c.post(ctx, "/chat/completions", body, &resp); err != nil {
+		return llm.Response{}, err
+	}
+	if len(resp.Choices) == 0 {
+		return llm.Response{}, errors.New("empty response")
+	}
+	if resp.Choices[0].FinishReason == "content_filter" {
+		return llm.Response{}, &llm.BlockedError{FinishReason: "content_filter"}
+	}
+	msg := resp.Choices[0].Message
+	out := llm.Response{Text: msg.Content, Usage: resp.Usage.toLLM()}
+	for _, tc := range msg.ToolCalls {
+		var args map[string]any
+		if tc.Function.Arguments != "" {
+			if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+				return llm.Response{}, fmt.Errorf("decode arguments of tool call %s: %w", tc.Function.Name, err)
+			}
+		}
+		out.ToolCalls = append(out.ToolCalls, llm.ToolCall{ID: tc.ID, Name: tc.Function.Name, Args: args})
+	}
+	if out.Text == "" && len(out.ToolCalls) == 0 {
+		return llm.Response{}, errors.New("no text in response")
+	}
+	return out, nil
+}
+
+// GenerateStream requests a server-sent-events stream and calls onText per delta.
+func (c *Client) GenerateStream(ctx context.Context, req llm.Request, onText func(string)) (llm.Response, error) {
+	body, err := c.chatRequest(req)
+	if err != nil {
+		return llm.Response{}, err
+	}
+	body.Stream = true
+	body.StreamOptions = &streamOptions{IncludeUsage: true}
+
+	resp, err := c.do(ctx, "/chat/completions", body)
+	if err != nil {
+		return llm.Response{}, err
+	}
+	defer resp.Body.Close()
+
+	var (
+		text  strings.Builder
+		total llm.Usage
+	)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		data, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var chunk chatChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return llm.Response{}, fmt.Errorf("decode openai stream: %w", err)
+		}
+		if chunk.Usage != nil {
+			total = chunk.Usage.toLLM()
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		delta := chunk.Choices[0].Delta.Content
+		text.WriteString(delta)
+		if onText != nil {
+			onText(delta)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return llm.Response{}, err
+	}
+	if text.Len() == 0 {
+		return llm.Response{}, errors.New("no text in response")
+	}
+	return llm.Response{Text: text.String(), Usage: total}, nil
+}
+
+func (c *Client) chatRequest(req llm.Request) (chatRequest, error) {
+	if c == nil {
+		return chatRequest{}, errors.New("openai client not initialized")
+	}
+	if req.Model == "" {
+		return chatRequest{}, errors.New("model is required")
+	}
+
+	g := req.Generation
+	body := chatRequest{
+		Model:       req.Model,
+		Temperature: g.Temperature,
+		TopP:        g.TopP,
+		TopK:        g.TopK,
+		MaxTokens:   g.MaxOutputTokens,
+		Stop:        g.StopSequences,
+		N:           g.CandidateCount,
+		Seed:        g.Seed,
+	}
+	if req.ResponseFormat == llm.FormatJSON {
+		body.ResponseFormat = &responseFormat{Type: "json_object"}
+		if req.ResponseSchema != nil {
+			body.ResponseFormat = &responseFormat{
+				Type:       "json_schema",
+				JSONSchema: &jsonSchema{Name: "response", Schema: req.ResponseSchema},
+			}
+		}
+	}
+	if req.SystemPrompt != "" {
+		body.Messages = append(body.Messages, chatMessage{Role: "system", Content: req.SystemPrompt})
+	}
+	for _, msg := range req.History {
+		msgs, err := historyMessages(msg)
+		if err != nil {
+			return chatRequest{}, err
+		}
+		body.Messages = append(body.Messages, msgs...)
+	}
+	if req.UserPrompt != "" || len(req.Attachments) > 0 {
+		user, err := userContent(req)
+		if err != nil {
+			return chatRequest{}, err
+		}
+		body.Messages = append(body.Messages, chatMessage{Role: "user", Content: user})
+	}
+	for _, t := range req.Tools {
+		var decl toolDecl
+		decl.Type = "function"
+		decl.Function.Name = t.Name
+		decl.Function.Description = t.Description
+		decl.Function.Parameters = t.Parameters
+		body.Tools = append(body.Tools, decl)
+	}
+	return body, nil
+}
+
+// historyMessages maps one conversation turn onto chat messages. Tool results
+// become one `tool` message per call.
+func historyMessages(msg llm.Message) ([]chatMessage, error) {
+	if len(msg.ToolResults) > 0 {
+		out := make([]chatMessage, 0, len(msg.ToolResults))
+		for _, res := range msg.ToolResults {
+			b, err := json.Marshal(res.Output)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, chatMessage{Role: "tool", ToolCallID: res.CallID, Content: string(b)})
+		}
+		return out, nil
+	}
+
+	if msg.Role != llm.RoleModel {
+		return []chatMessage{{Role: "user", Content: msg.Text}}, nil
+	}
+	out := chatMessage{Role: "assistant", Content: msg.Text}
+	for _, call := range msg.ToolCalls {
+		args, err := json.Marshal(call.Args)
+		if err != nil {
+			return nil, err
+		}
+		tc := toolCall{ID: call.ID, Type: "function"}
+		tc.Function.Name = call.Name
+		tc.Function.Arguments = string(args)
+		out.ToolCalls = append(out.ToolCalls, tc)
+	}
+	return []chatMessage{out}, nil
+}
+
+// userContent builds the user message. Images become image_url parts (data
+// URIs) and text files are inlined; other attachment types have no portable
+// representation in the chat-completions API.
+func userContent(req llm.Request) (any, error) {
+	if len(req.Attachments) == 0 {
+		return req.UserPrompt, nil
+	}
+
+	var parts []contentPart
+	for _, a := range req.Attachments {
+		switch {
+		case strings.HasPrefix(a.MIMEType, "image/"):
+			url := "data:" + a.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(a.Data)
+			parts = append(parts, contentPart{Type: "image_url", ImageURL: &imageURL{URL: url}})
+		case strings.HasPrefix(a.MIMEType, "text/") || a.MIMEType == "application/json":
+			parts = append(parts, contentPart{Type: "text", Text: fmt.Sprintf("File %s:\n%s", a.Name, a.Data)})
+		default:
+			return nil, fmt.Errorf("attachment %s: %s is not supported by the openai provider", a.Name, a.MIMEType)
+		}
+	}
+	parts = append(parts, contentPart{Type: "text", Text: req.UserPrompt})
+	return parts, nil
+}
+
+type embeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type embeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+// Embed calls /embeddings and returns the vectors in the order of texts.
+func (c *Client) Embed(ctx context.Context, model string, texts []string) ([][]float32, error) {
+	var resp embeddingResponse
+	if err := c.post(ctx, "/embeddings", embeddingRequest{Model: model, Input: texts}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Data) != len(texts) {
+		return nil, fmt.Errorf("embedding response has %d vectors for %d texts", len(resp.Data), len(texts))
+	}
+	out := make([][]float32, len(texts))
+	for _, d := range resp.Data {
+		if d.Index < 0 || d.Index >= len(out) {
+			return nil, fmt.Errorf("embedding response has out-of-range index %d", d.Index)
+		}
+		out[d.Index] = d.Embedding
+	}
+	return out, nil
+}
+
+func (c *Client) post(ctx context.Context, path string, in any, out any) error {
+	resp, err := c.do(ctx, path, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("decode openai response: %w", err)
+	}
+	return nil
+}
+
+// do sends a JSON POST and returns the response if it was a 200; other
+// statuses are turned into errors carrying the server's message.
+func (c *Client) do(ctx context.Context, path string, in any) (*http.Response, error) {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		msg := strings.TrimSpace(string(data))
+		var e errorResponse
+		if json.Unmarshal(data, &e) == nil && e.Error.Message != "" {
+			msg = e.Error.Message
+		}
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return nil, fmt.Errorf("openai request failed (HTTP %d): %w: %s", resp.StatusCode, llm.ErrModelNotFound, msg)
+		case http.StatusTooManyRequests:
+			return nil, fmt.Errorf("openai request failed (HTTP %d): %w: %s", resp.StatusCode, llm.ErrQuotaExceeded, msg)
+		}
+		return nil, fmt.Errorf("openai request failed (HTTP %d): %s", resp.StatusCode, msg)
+	}
+	return resp, nil
+}
@@ -0,0 +1,196 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cli-gpt-flows/internal/llm"
+)
+
+func TestGenerate_SendsSystemAndUserPrompts(t *testing.T) {
+	var got chatRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("unexpected Authorization %q", auth)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"fixed text"},"finish_reason":"stop"}]}`))
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL+"/v1/", "secret", srv.Client())
+	resp, err := c.Generate(context.Background(), llm.Request{
+		Model:        "llama3",
+		SystemPrompt: "You are an editor.",
+		UserPrompt:   "Fix this.",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Text != "fixed text" {
+		t.Fatalf("expected %q, got %q", "fixed text", resp.Text)
+	}
+
+	if got.Model != "llama3" {
+		t.Fatalf("expected model %q, got %q", "llama3", got.Model)
+	}
+	want := []chatMessage{{Role: "system", Content: "You are an editor."}, {Role: "user", Content: "Fix this."}}
+	if len(got.Messages) != len(want) {
+		t.Fatalf("expected %d messages, got %d", len(want), len(got.Messages))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got.Messages[i], want[i]) {
+			t.Fatalf("message %d: expected %+v, got %+v", i, want[i], got.Messages[i])
+		}
+	}
+}
+
+func TestGenerate_SurfacesServerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":{"message":"model 'nope' not found"}}`))
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, "", srv.Client())
+	_, err := c.Generate(context.Background(), llm.Request{Model: "nope", UserPrompt: "hi"})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(err.Error(), "model 'nope' not found") {
+		t.Fatalf("expected server message in error, got %v", err)
+	}
+	if !errors.Is(err, llm.ErrModelNotFound) {
+		t.Fatalf("expected ErrModelNotFound, got %v", err)
+	}
+}
+
+func TestGenerateStream_CollectsDeltas(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req chatRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if !req.Stream {
+			t.Errorf("expected stream=true")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: {\"choices\":[{\"delta\":{\"role\":\"assistant\"}}]}\n\n" +
+			"data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n" +
+			"data: {\"choices\":[{\"delta\":{\"content\":\"lo\"}}]}\n\n" +
+			"data: [DONE]\n\n"))
+	}))
+	defer srv.Close()
+
+	var chunks []string
+	c := NewClient(srv.URL, "", srv.Client())
+	resp, err := c.GenerateStream(context.Background(), llm.Request{Model: "llama3", UserPrompt: "hi"}, func(s string) {
+		chunks = append(chunks, s)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Text != "Hello" {
+		t.Fatalf("expected %q, got %q", "Hello", resp.Text)
+	}
+	if strings.Join(chunks, "|") != "Hel|lo" {
+		t.Fatalf("unexpected chunks %q", chunks)
+	}
+}
+
+func TestGenerate_SendsConversationHistory(t *testing.T) {
+	var got chatRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"shorter"}}]}`))
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, "", srv.Client())
+	_, err := c.Generate(context.Background(), llm.Request{
+		Model: "llama3",
+		History: []llm.Message{
+			{Role: llm.RoleUser, Text: "Write a spec."},
+			{Role: llm.RoleModel, Text: "Spec v1"},
+		},
+		UserPrompt: "Now shorten section 4.",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []chatMessage{
+		{Role: "user", Content: "Write a spec."},
+		{Role: "assistant", Content: "Spec v1"},
+		{Role: "user", Content: "Now shorten section 4."},
+	}
+	if len(got.Messages) != len(want) {
+		t.Fatalf("expected %d messages, got %d", len(want), len(got.Messages))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got.Messages[i], want[i]) {
+			t.Fatalf("message %d: expected %+v, got %+v", i, want[i], got.Messages[i])
+		}
+	}
+}
+
+func TestEmbed_OrdersVectorsByIndex(t *testing.T) {
+	var got embeddingRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		_, _ = w.Write([]byte(`{"data":[{"index":1,"embedding":[0,1]},{"index":0,"embedding":[1,0]}]}`))
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL+"/v1", "", srv.Client())
+	vecs, err := c.Embed(context.Background(), "text-embedding-3-small", []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Model != "text-embedding-3-small" || !reflect.DeepEqual(got.Input, []string{"a", "b"}) {
+		t.Fatalf("unexpected request %+v", got)
+	}
+	if !reflect.DeepEqual(vecs, [][]float32{{1, 0}, {0, 1}}) {
+		t.Fatalf("unexpected vectors %v", vecs)
+	}
+}
+
+func TestUserContent_MapsAttachments(t *testing.T) {
+	got, err := userContent(llm.Request{
+		UserPrompt: "Describe these.",
+		Attachments: []llm.Attachment{
+			{Name: "a.png", MIMEType: "image/png", Data: []byte("png")},
+			{Name: "notes.txt", MIMEType: "text/plain", Data: []byte("hello")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []contentPart{
+		{Type: "image_url", ImageURL: &imageURL{URL: "data:image/png;base64,cG5n"}},
+		{Type: "text", Text: "File notes.txt:\nhello"},
+		{Type: "text", Text: "Describe these."},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("userContent = %+v, want %+v", got, want)
+	}
+
+	_, err = userContent(llm.Request{UserPrompt: "x", Attachments: []llm.Attachment{{Name: "a.pdf", MIMEType: "application/pdf"}}})
+	if err == nil || !strings.Contains(err.Error(), "application/pdf") {
+		t.Fatalf("expected PDFs to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,394 @@
+// Package recipetest runs the declarative test cases of a recipe: inputs,
+// mocked model responses per step and assertions on step outputs and saved
+// files. It backs the `test` command.
+package recipetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"cli-gpt-flows/internal/engine"
+	"cli-gpt-flows/internal/llm"
+	"cli-gpt-flows/internal/models"
+	"cli-gpt-flows/internal/templating"
+	"cli-gpt-flows/internal/usage"
+	"cli-gpt-flows/internal/workflow"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Case is one test of a recipe.
+type Case struct {
+	Name   string            `yaml:"name"`
+	Inputs map[string]string `yaml:"inputs"`
+	// Mocks are model responses by step id. A string (or a mapping, sent as
+	// JSON) answers every call of the step; a list answers successive calls
+	// in order, repeating the last entry.
+	Mocks map[string]yaml.Node `yaml:"mocks"`
+	// Refined is the accepted version of interactive_refine steps.
+	Refined map[string]string `yaml:"refined"`
+	Expect  []Assertion       `yaml:"expect"`
+	// ExpectError makes the case pass only if the run fails with an error
+	// containing this text.
+	ExpectError string `yaml:"expect_error"`
+	// AllowSideEffects lets shell and http steps run for real; without it
+	// they fail the case, so tests stay offline and deterministic.
+	AllowSideEffects bool `yaml:"allow_side_effects"`
+}
+
+// Assertion checks a step output or a file written during the run. Exactly
+// one of Step and File is set; every check that is set must hold.
+type Assertion struct {
+	Step string `yaml:"step"`
+	File string `yaml:"file"`
+
+	Contains    string `yaml:"contains"`
+	NotContains string `yaml:"not_contains"`
+	Regex       string `yaml:"regex"`
+	// JSONPath (dotted, like templating) selects a value from JSON output
+	// to compare with Equals; without it, Equals compares the whole output.
+	JSONPath string  `yaml:"json_path"`
+	Equals   *string `yaml:"equals"`
+}
+
+// Result is the outcome of one case.
+type Result struct {
+	Name     string
+	Failures []string
+}
+
+func (r Result) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+type suite struct {
+	Tests []Case `yaml:"tests"`
+}
+
+// LoadCases reads the `tests:` section of a recipe file and of its sibling
+// <name>.test.yaml, if there is one.
+func LoadCases(recipePath string) ([]Case, error) {
+	ext := filepath.Ext(recipePath)
+	paths := []string{recipePath, strings.TrimSuffix(recipePath, ext) + ".test" + ext}
+
+	var cases []Case
+	for i, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			if i > 0 && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		var s suite
+		if err := yaml.Unmarshal(b, &s); err != nil {
+			return nil, fmt.Errorf("parse tests in %s: %w", path, err)
+		}
+		cases = append(cases, s.Tests...)
+	}
+	for i, c := range cases {
+		if strings.TrimSpace(c.Name) == "" {
+			return nil, fmt.Errorf("tests[%d].name is required", i)
+		}
+		for j, a := range c.Expect {
+			if err := a.validate(); err != nil {
+				return nil, fmt.Errorf("test %q: expect[%d]: %w", c.Name, j, err)
+			}
+		}
+	}
+	return cases, nil
+}
+
+func (a Assertion) validate() error {
+	if (a.Step == "") == (a.File == "") {
+		return errors.New("set exactly one of step and file")
+	}
+	if a.Contains == "" && a.NotContains == "" && a.Regex == "" && a.Equals == nil {
+		return errors.New("set at least one of contains, not_contains, regex and equals")
+	}
+	if a.JSONPath != "" && a.Equals == nil {
+		return errors.New("json_path requires equals")
+	}
+	if a.Regex != "" {
+		if _, err := regexp.Compile(a.Regex); err != nil {
+			return fmt.Errorf("regex: %w", err)
+		}
+	}
+	return nil
+}
+
+// RunFile loads a recipe and its test cases, runs them and writes a report
+// to w. It returns false if any case failed.
+func RunFile(ctx context.Context, recipePath string, w io.Writer) (bool, error) {
+	wf, err := workflow.LoadFromFile(recipePath)
+	if err != nil {
+		return false, err
+	}
+	cases, err := LoadCases(recipePath)
+	if err != nil {
+		return false, err
+	}
+	if len(cases) == 0 {
+		return false, fmt.Errorf("%s has no tests", recipePath)
+	}
+
+	results := make([]Result, 0, len(cases))
+	for _, c := range cases {
+		results = append(results, Run(ctx, wf, c, filepath.Dir(recipePath)))
+	}
+	return Report(w, wf.Name, results), nil
+}
+
+// Run executes one case with a fresh temporary directory as the output
+// directory, so `save` steps write there and file assertions read them back.
+// Steps read files (read_file, attachments, retrieve documents) from dir,
+// usually the recipe's directory.
+func Run(ctx context.Context, wf workflow.Workflow, c Case, dir string) Result {
+	res := Result{Name: c.Name}
+	fail := func(format string, args ...any) {
+		res.Failures = append(res.Failures, fmt.Sprintf(format, args...))
+	}
+
+	mocks, err := parseMocks(c.Mocks)
+	if err != nil {
+		fail("%v", err)
+		return res
+	}
+
+	out, err := os.MkdirTemp("", "pals-gemflows-test-")
+	if err != nil {
+		fail("%v", err)
+		return res
+	}
+	defer os.RemoveAll(out)
+
+	e := engine.New(engine.Dependencies{
+		Prices:           usage.DefaultPrices(),
+		Aliases:          models.DefaultAliases(),
+		Replay:           &mockReplayer{c: c, mocks: mocks, next: map[string]int{}},
+		AllowSideEffects: c.AllowSideEffects,
+		OutputDir:        out,
+		InputDir:         dir,
+		IndexDir:         filepath.Join(out, ".indexes"),
+	})
+	outputs, runErr := e.RunOutputs(ctx, wf, nil)
+
+	switch {
+	case c.ExpectError != "" && runErr == nil:
+		fail("expected an error containing %q, but the run succeeded", c.ExpectError)
+	case c.ExpectError != "" && !strings.Contains(runErr.Error(), c.ExpectError):
+		fail("expected an error containing %q, got: %v", c.ExpectError, runErr)
+	case c.ExpectError == "" && runErr != nil:
+		fail("run failed: %v", runErr)
+		return res
+	}
+
+	for _, a := range c.Expect {
+		for _, msg := range a.check(outputs, out) {
+			fail("%s", msg)
+		}
+	}
+	return res
+}
+
+// check runs the assertion; file paths are relative to dir.
+func (a Assertion) check(outputs map[string]string, dir string) []string {
+	var (
+		subject string
+		value   string
+	)
+	if a.Step != "" {
+		subject = "step " + a.Step
+		v, ok := outputs[a.Step]
+		if !ok {
+			return []string{subject + ": no output (step did not run)"}
+		}
+		value = v
+	} else {
+		subject = "file " + a.File
+		path := a.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return []string{fmt.Sprintf("%s: %v", subject, err)}
+		}
+		value = string(b)
+	}
+
+	var failures []string
+	if a.Contains != "" && !strings.Contains(value, a.Contains) {
+		failures = append(failures, fmt.Sprintf("%s: expected to contain %q, got %q", subject, a.Contains, excerpt(value)))
+	}
+	if a.NotContains != "" && strings.Contains(value, a.NotContains) {
+		failures = append(failures, fmt.Sprintf("%s: expected not to contain %q", subject, a.NotContains))
+	}
+	if a.Regex != "" && !regexp.MustCompile(a.Regex).MatchString(value) {
+		failures = append(failures, fmt.Sprintf("%s: expected to match /%s/, got %q", subject, a.Regex, excerpt(value)))
+	}
+	if a.Equals != nil {
+		got := value
+		if a.JSONPath != "" {
+			v, ok := templating.Lookup(map[string]string{"out": value}, "out."+a.JSONPath)
+			if !ok {
+				return append(failures, fmt.Sprintf("%s: json_path %s not found", subject, a.JSONPath))
+			}
+			got = v
+			subject += " " + a.JSONPath
+		}
+		if got != *a.Equals {
+			failures = append(failures, fmt.Sprintf("%s: expected %q, got %q", subject, *a.Equals, excerpt(got)))
+		}
+	}
+	return failures
+}
+
+// Report prints one line per case (and its failures) and a summary. It
+// returns true if all cases passed.
+func Report(w io.Writer, recipe string, results []Result) bool {
+	passed := 0
+	for _, r := range results {
+		if r.Passed() {
+			passed++
+			fmt.Fprintf(w, "PASS  %s\n", r.Name)
+			continue
+		}
+		fmt.Fprintf(w, "FAIL  %s\n", r.Name)
+		for _, f := range r.Failures {
+			fmt.Fprintf(w, "      %s\n", f)
+		}
+	}
+	fmt.Fprintf(w, "\n%s: %d/%d tests passed\n", recipe, passed, len(results))
+	return passed == len(results)
+}
+
+func excerpt(s string) string {
+	const limit = 200
+	if len(s) <= limit {
+		return s
+	}
+	return s[:limit] + "..."
+}
+
+// parseMocks turns the YAML mocks into response lists per step.
+func parseMocks(in map[string]yaml.Node) (map[string][]string, error) {
+	out := map[string][]string{}
+	for step, node := range in {
+		node := node
+		items := []*yaml.Node{&node}
+		if node.Kind == yaml.SequenceNode {
+			items = node.Content
+		}
+		for _, item := range items {
+			text, err := mockText(item)
+			if err != nil {
+				return nil, fmt.Errorf("mocks.%s: %w", step, err)
+			}
+			out[step] = append(out[step], text)
+		}
+		if len(out[step]) == 0 {
+			return nil, fmt.Errorf("mocks.%s is empty", step)
+		}
+	}
+	return out, nil
+}
+
+func mockText(n *yaml.Node) (string, error) {
+	if n.Kind == yaml.ScalarNode {
+		return n.Value, nil
+	}
+	var v any
+	if err := n.Decode(&v); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// mockReplayer feeds a case's inputs and mocked responses to the engine.
+type mockReplayer struct {
+	c     Case
+	mocks map[string][]string
+
+	mu   sync.Mutex
+	next map[string]int
+}
+
+func (m *mockReplayer) Inputs() map[string]string {
+	return m.c.Inputs
+}
+
+func (m *mockReplayer) Refined(stepID string) (string, bool) {
+	text, ok := m.c.Refined[stepID]
+	return text, ok
+}
+
+func (m *mockReplayer) Provider(stepID, _ string) llm.Provider {
+	return &mockProvider{m: m, stepID: stepID}
+}
+
+func (m *mockReplayer) respond(stepID string) (llm.Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list, ok := m.mocks[stepID]
+	if !ok {
+		return llm.Response{}, fmt.Errorf("no mock for step %s", stepID)
+	}
+	i := m.next[stepID]
+	if i >= len(list) {
+		i = len(list) - 1
+	}
+	m.next[stepID]++
+	return llm.Response{Text: list[i]}, nil
+}
+
+type mockProvider struct {
+	m      *mockReplayer
+	stepID string
+}
+
+// mockDims is the size of the vectors mockProvider.Embed returns.
+const mockDims = 64
+
+// Embed returns deterministic bag-of-words vectors (each word hashed to a
+// dimension), so embed and retrieve steps run without a model and retrieve
+// ranks documents by the words they share with the query.
+func (p *mockProvider) Embed(_ context.Context, _ string, texts []string) ([][]float32, error) {
+	out := make([][]float32, len(texts))
+	for i, t := range texts {
+		v := make([]float32, mockDims)
+		for _, w := range strings.FieldsFunc(strings.ToLower(t), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+			h := fnv.New32a()
+			h.Write([]byte(w))
+			v[h.Sum32()%mockDims]++
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (p *mockProvider) Generate(_ context.Context, _ llm.Request) (llm.Response, error) {
+	return p.m.respond(p.stepID)
+}
+
+func (p *mockProvider) GenerateStream(_ context.Context, _ llm.Request, onText func(string)) (llm.Response, error) {
+	resp, err := p.m.respond(p.stepID)
+	if err == nil && onText != nil {
+		onText(resp.Text)
+	}
+	return resp, err
+}
@@ -0,0 +1,213 @@
+package recipetest
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const recipe = `
+name: scoping
+steps:
+  - id: transcript
+    type: input
+  - id: extract
+    type: gemini
+    model: fast
+    response_format: json
+    user_prompt: "Extract the customer from: {{ transcript }}"
+  - id: spec
+    type: gemini
+    model: fast
+    user_prompt: "Write a spec for {{ extract.customer.name }}"
+  - id: save
+    type: save
+    filename: spec.md
+    content: "{{ spec }}"
+
+tests:
+  - name: writes the spec
+    inputs:
+      transcript: "Call with Acme about a portal."
+    mocks:
+      extract: {customer: {name: Acme}}
+      spec: "# Spec for Acme"
+    expect:
+      - step: extract
+        json_path: customer.name
+        equals: Acme
+      - file: spec.md
+        regex: "^# Spec"
+`
+
+func TestRunFile_ReportsPassAndFail(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "scoping.yaml")
+	if err := os.WriteFile(path, []byte(recipe), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sibling := `
+tests:
+  - name: missing mock
+    inputs: {transcript: "x"}
+    mocks:
+      extract: {customer: {name: Acme}}
+    expect_error: "no mock for step spec"
+  - name: wrong customer
+    inputs: {transcript: "x"}
+    mocks:
+      extract: {customer: {name: Initech}}
+      spec: "# Spec"
+    expect:
+      - step: extract
+        json_path: customer.name
+        equals: Acme
+`
+	if err := os.WriteFile(filepath.Join(dir, "scoping.test.yaml"), []byte(sibling), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	ok, err := RunFile(context.Background(), path, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok {
+		t.Fatalf("expected a failing case, got:\n%s", out.String())
+	}
+	report := out.String()
+	for _, want := range []string{
+		"PASS  writes the spec",
+		"PASS  missing mock",
+		"FAIL  wrong customer",
+		`expected "Acme", got "Initech"`,
+		"2/3 tests passed",
+	} {
+		if !strings.Contains(report, want) {
+			t.Fatalf("expected %q in report:\n%s", want, report)
+		}
+	}
+}
+
+func TestRunFile_RetrievesFromRecipeDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "specs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{
+		"acme.md":   "Acme wants a customer portal with billing.",
+		"globex.md": "Globex needs a mobile app for field staff.",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, "specs", name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grounded := `
+name: grounded
+steps:
+  - id: topic
+    type: input
+  - id: context
+    type: retrieve
+    query: "{{ topic }}"
+    documents: specs
+    top_k: 1
+  - id: save
+    type: save
+    filename: context.md
+    content: "{{ context }}"
+tests:
+  - name: finds the portal spec
+    inputs: {topic: "customer portal billing"}
+    expect:
+      - step: context
+        contains: acme.md
+      - file: context.md
+        not_contains: Globex
+`
+	path := filepath.Join(dir, "grounded.yaml")
+	if err := os.WriteFile(path, []byte(grounded), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	ok, err := RunFile(context.Background(), path, &out)
+	if err != nil || !ok {
+		t.Fatalf("expected the case to pass (%v):\n%s", err, out.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "context.md")); err == nil {
+		t.Fatalf("expected save to write into the temporary directory, not the recipe's")
+	}
+}
+
+func TestRunFile_ShellStepsNeedOptIn(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "build.yaml")
+	if err := os.WriteFile(path, []byte(`
+name: build
+steps:
+  - id: version
+    type: shell
+    command: echo v1
+tests:
+  - name: refused by default
+    expect_error: "allow_side_effects"
+  - name: runs with opt-in
+    allow_side_effects: true
+    expect:
+      - step: version
+        contains: v1
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	ok, err := RunFile(context.Background(), path, &out)
+	if err != nil || !ok {
+		t.Fatalf("expected both cases to pass (%v):\n%s", err, out.String())
+	}
+}
+
+func TestRunFile_HTTPStepsNeedOptIn(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_, _ = w.Write([]byte("pong"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ping.yaml")
+	if err := os.WriteFile(path, []byte(`
+name: ping
+steps:
+  - id: ping
+    type: http
+    url: `+srv.URL+`
+tests:
+  - name: no opt-in
+    expect:
+      - step: ping
+        contains: pong
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	ok, err := RunFile(context.Background(), path, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || !strings.Contains(out.String(), "allow_side_effects") {
+		t.Fatalf("expected the case to fail naming allow_side_effects:\n%s", out.String())
+	}
+	if calls.Load() != 0 {
+		t.Fatalf("the test contacted the server %d times", calls.Load())
+	}
+}
@@ -1,12 +1,14 @@
 package templating
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
-var tokenRe = regexp.MustCompile(`\{\{\s*([a-zA-Z0-9_\-]+)\s*\}\}`)
+var tokenRe = regexp.MustCompile(`\{\{\s*([a-zA-Z0-9_\-]+(?:\.[a-zA-Z0-9_\-]+)*)\s*\}\}`)
 
 func RenderString(in string, memory map[string]string) (string, error) {
 	if in == "" {
@@ -20,7 +22,7 @@ func RenderString(in string, memory map[string]string) (string, error) {
 			return match
 		}
 		key := parts[1]
-		val, ok := memory[key]
+		val, ok := Lookup(memory, key)
 		if !ok {
 			missing = append(missing, key)
 			return ""
@@ -34,6 +36,63 @@ func RenderString(in string, memory map[string]string) (string, error) {
 	return out, nil
 }
 
+// Lookup resolves a key from memory. An exact match wins; otherwise a dotted
+// key like `extract.customer.name` walks into the JSON stored under `extract`.
+func Lookup(memory map[string]string, key string) (string, bool) {
+	if val, ok := memory[key]; ok {
+		return val, true
+	}
+	head, rest, ok := strings.Cut(key, ".")
+	if !ok {
+		return "", false
+	}
+	raw, ok := memory[head]
+	if !ok {
+		return "", false
+	}
+
+	// UseNumber keeps large integers such as IDs exact instead of rounding
+	// them through float64.
+	var v any
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return "", false
+	}
+	for _, seg := range strings.Split(rest, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			v, ok = node[seg]
+			if !ok {
+				return "", false
+			}
+		case []any:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			v = node[i]
+		default:
+			return "", false
+		}
+	}
+
+	switch val := v.(type) {
+	case string:
+		return val, true
+	case json.Number:
+		return val.String(), true
+	case nil:
+		return "", true
+	default:
+		b, err := json.Marshal(val)
+		if err != nil {
+			return "", false
+		}
+		return string(b), true
+	}
+}
+
 func unique(in []string) []string {
 	seen := map[string]struct{}{}
 	out := make([]string, 0, len(in))
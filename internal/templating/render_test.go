@@ -28,3 +28,43 @@ func TestRenderString_MissingVariableErrors(t *testing.T) {
 		t.Fatalf("expected error")
 	}
 }
+
+func TestRenderString_DottedPathReadsJSON(t *testing.T) {
+	memory := map[string]string{
+		"extract": `{"customer":{"name":"Acme","seats":12},"contacts":["ann","bob"]}`,
+	}
+
+	got, err := RenderString("{{ extract.customer.name }} ({{ extract.customer.seats }}) via {{extract.contacts.1}}", memory)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "Acme (12) via bob" {
+		t.Fatalf("expected %q, got %q", "Acme (12) via bob", got)
+	}
+
+	if _, err := RenderString("{{ extract.customer.phone }}", memory); err == nil {
+		t.Fatalf("expected error for missing path")
+	}
+}
+
+func TestLookup_KeepsLargeNumbersExact(t *testing.T) {
+	memory := map[string]string{
+		"order": `{"id":123456789012345678,"total":19.99,"items":[{"sku":9007199254740993}]}`,
+	}
+
+	cases := map[string]string{
+		"order.id":          "123456789012345678",
+		"order.total":       "19.99",
+		"order.items.0":     `{"sku":9007199254740993}`,
+		"order.items.0.sku": "9007199254740993",
+	}
+	for key, want := range cases {
+		got, ok := Lookup(memory, key)
+		if !ok {
+			t.Fatalf("Lookup(%q) not found", key)
+		}
+		if got != want {
+			t.Fatalf("Lookup(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
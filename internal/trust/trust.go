@@ -0,0 +1,261 @@
+// Package trust asks before a remote recipe runs for the first time, or
+// after it changed, and remembers the answer per recipe content hash.
+package trust
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cli-gpt-flows/internal/workflow"
+)
+
+// EnvFile overrides where trust decisions are stored.
+const EnvFile = "PALSGEMFLOWS_TRUST_FILE"
+
+var (
+	// ErrUntrusted means the recipe needs a decision but nobody can be asked.
+	ErrUntrusted = errors.New("recipe is not trusted")
+	// ErrDeclined means the user said no, now or for this version before.
+	ErrDeclined = errors.New("recipe was declined")
+)
+
+// DefaultPath is $PALSGEMFLOWS_TRUST_FILE or
+// <user config dir>/pals-gemflows/trust.json.
+func DefaultPath() string {
+	if p := os.Getenv(EnvFile); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil || dir == "" {
+		dir = "."
+	}
+	return filepath.Join(dir, "pals-gemflows", "trust.json")
+}
+
+// Store is the file of remembered decisions.
+type Store struct {
+	path string
+}
+
+// New returns the store at path, or at DefaultPath when path is empty.
+func New(path string) *Store {
+	if path == "" {
+		path = DefaultPath()
+	}
+	return &Store{path: path}
+}
+
+// Decision is the user's answer for one version of a recipe.
+type Decision struct {
+	Recipe       string    `json:"recipe"`
+	URL          string    `json:"url,omitempty"`
+	Hash         string    `json:"hash"`
+	Trusted      bool      `json:"trusted"`
+	Capabilities []string  `json:"capabilities,omitempty"`
+	DecidedAt    time.Time `json:"decided_at"`
+}
+
+type file struct {
+	Decisions []Decision `json:"decisions"`
+}
+
+// Hash identifies a recipe version by its content.
+func Hash(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func (s *Store) load() (file, error) {
+	var f file
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return f, fmt.Errorf("parse trust store %s: %w", s.path, err)
+	}
+	return f, nil
+}
+
+// Get returns the decision for this version of a recipe, if any.
+func (s *Store) Get(recipe, hash string) (Decision, bool, error) {
+	f, err := s.load()
+	if err != nil {
+		return Decision{}, false, err
+	}
+	for _, d := range f.Decisions {
+		if d.Recipe == recipe && d.Hash == hash {
+			return d, true, nil
+		}
+	}
+	return Decision{}, false, nil
+}
+
+// trustedBefore reports whether another version of the recipe was trusted.
+func (s *Store) trustedBefore(recipe string) bool {
+	f, err := s.load()
+	if err != nil {
+		return false
+	}
+	for _, d := range f.Decisions {
+		if d.Recipe == recipe && d.Trusted {
+			return true
+		}
+	}
+	return false
+}
+
+// Put records d, replacing an earlier decision for the same version.
+func (s *Store) Put(d Decision) error {
+	f, err := s.load()
+	if err != nil {
+		return err
+	}
+	kept := f.Decisions[:0]
+	for _, old := range f.Decisions {
+		if old.Recipe != d.Recipe || old.Hash != d.Hash {
+			kept = append(kept, old)
+		}
+	}
+	f.Decisions = append(kept, d)
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Prompt is where Confirm asks. A nil In means nobody can answer (CI);
+// AssumeYes (--trust) trusts without asking.
+type Prompt struct {
+	In        io.Reader
+	Out       io.Writer
+	AssumeYes bool
+}
+
+// Confirm decides whether a remote recipe may run. A version decided before
+// is answered from the store; otherwise the recipe's capabilities are shown
+// and the user is asked, and the answer is remembered. Local recipes don't
+// need to go through it.
+func Confirm(s *Store, name, url string, data []byte, wf workflow.Workflow, p Prompt) error {
+	hash := Hash(data)
+	d, ok, err := s.Get(name, hash)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if d.Trusted {
+			return nil
+		}
+		return fmt.Errorf("%w: you declined this version of %s on %s; remove it from %s to be asked again",
+			ErrDeclined, name, d.DecidedAt.Local().Format("2006-01-02"), s.path)
+	}
+
+	out := p.Out
+	if out == nil {
+		out = io.Discard
+	}
+	caps, declared := Required(wf)
+	describe(out, name, url, hash, s.trustedBefore(name), caps, declared)
+
+	d = Decision{Recipe: name, URL: url, Hash: hash, Capabilities: caps.Describe(), DecidedAt: time.Now().UTC()}
+	switch {
+	case p.AssumeYes:
+		fmt.Fprintln(out, "Trusted (--trust).")
+		d.Trusted = true
+	case p.In == nil:
+		return fmt.Errorf("%w: %s needs to be reviewed; run it interactively once or pass --trust", ErrUntrusted, name)
+	default:
+		fmt.Fprint(out, "Run this recipe? [y/N] ")
+		line, err := readLine(p.In)
+		if err != nil {
+			return err
+		}
+		answer := strings.ToLower(strings.TrimSpace(line))
+		d.Trusted = answer == "y" || answer == "yes"
+	}
+	if err := s.Put(d); err != nil {
+		return fmt.Errorf("save trust decision: %w", err)
+	}
+	if !d.Trusted {
+		return fmt.Errorf("%w: %s was not run", ErrDeclined, name)
+	}
+	return nil
+}
+
+// Required returns the capabilities to show for wf: the declared ones, or
+// the ones inferred from its steps when it declares none. Either way the
+// commands, hosts, token variables and directories come from the steps.
+func Required(wf workflow.Workflow) (workflow.Capabilities, bool) {
+	return workflow.Effective(wf), wf.Capabilities != nil
+}
+
+// readLine reads up to a newline one byte at a time, so input piped to the
+// run after the answer is left for the recipe's input steps.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, b[0])
+		}
+		if errors.Is(err, io.EOF) {
+			return string(line), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+func describe(w io.Writer, name, url, hash string, changed bool, caps workflow.Capabilities, declared bool) {
+	if changed {
+		fmt.Fprintf(w, "Remote recipe %s changed since you last trusted it.\n", name)
+	} else {
+		fmt.Fprintf(w, "Remote recipe %s has not been run on this machine before.\n", name)
+	}
+	if url != "" {
+		fmt.Fprintf(w, "  source:  %s\n", url)
+	}
+	fmt.Fprintf(w, "  sha256:  %s\n", hash)
+	if declared {
+		fmt.Fprintln(w, "It declares that it will:")
+	} else {
+		fmt.Fprintln(w, "It declares no capabilities; from its steps it will:")
+	}
+	lines := caps.Describe()
+	if len(lines) == 0 {
+		lines = []string{"only prompt you for input"}
+	}
+	for _, l := range lines {
+		fmt.Fprintf(w, "  - %s\n", l)
+	}
+}
@@ -0,0 +1,108 @@
+package trust
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cli-gpt-flows/internal/workflow"
+)
+
+func testRecipe(t *testing.T) workflow.Workflow {
+	t.Helper()
+	wf, err := workflow.LoadFromBytes("remote.yaml", []byte(`
+name: remote
+steps:
+  - id: run
+    type: shell
+    command: echo hi
+`))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	return wf
+}
+
+func TestConfirm_RemembersDecisionPerVersion(t *testing.T) {
+	s := New(filepath.Join(t.TempDir(), "trust.json"))
+	wf := testRecipe(t)
+	data := []byte("v1")
+
+	var out bytes.Buffer
+	if err := Confirm(s, "team/remote", "https://example.com/remote.yaml", data, wf, Prompt{In: strings.NewReader("y\n"), Out: &out}); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	if !strings.Contains(out.String(), "run shell commands") {
+		t.Fatalf("expected inferred capabilities in prompt, got %q", out.String())
+	}
+
+	// Same version: answered from the store without asking.
+	if err := Confirm(s, "team/remote", "", data, wf, Prompt{}); err != nil {
+		t.Fatalf("expected remembered trust, got %v", err)
+	}
+
+	// Changed version: asked again; a "no" is remembered too.
+	out.Reset()
+	err := Confirm(s, "team/remote", "", []byte("v2"), wf, Prompt{In: strings.NewReader("n\n"), Out: &out})
+	if !errors.Is(err, ErrDeclined) {
+		t.Fatalf("expected ErrDeclined, got %v", err)
+	}
+	if !strings.Contains(out.String(), "changed since you last trusted it") {
+		t.Fatalf("expected changed-version notice, got %q", out.String())
+	}
+	if err := Confirm(s, "team/remote", "", []byte("v2"), wf, Prompt{AssumeYes: true}); !errors.Is(err, ErrDeclined) {
+		t.Fatalf("expected remembered decline, got %v", err)
+	}
+}
+
+func TestConfirm_NonInteractiveNeedsTrustFlag(t *testing.T) {
+	s := New(filepath.Join(t.TempDir(), "trust.json"))
+	wf := testRecipe(t)
+
+	if err := Confirm(s, "team/remote", "", []byte("v1"), wf, Prompt{}); !errors.Is(err, ErrUntrusted) {
+		t.Fatalf("expected ErrUntrusted, got %v", err)
+	}
+	if err := Confirm(s, "team/remote", "", []byte("v1"), wf, Prompt{AssumeYes: true}); err != nil {
+		t.Fatalf("confirm with AssumeYes: %v", err)
+	}
+	d, ok, err := s.Get("team/remote", Hash([]byte("v1")))
+	if err != nil || !ok || !d.Trusted {
+		t.Fatalf("expected stored trust, got %+v %v %v", d, ok, err)
+	}
+}
+
+func TestConfirm_LeavesLaterStdinForInputSteps(t *testing.T) {
+	s := New(filepath.Join(t.TempDir(), "trust.json"))
+	in := strings.NewReader("y\nnotes for the first input\n")
+	if err := Confirm(s, "team/remote", "", []byte("v1"), testRecipe(t), Prompt{In: in, Out: &bytes.Buffer{}}); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	rest, err := io.ReadAll(in)
+	if err != nil || string(rest) != "notes for the first input\n" {
+		t.Fatalf("rest of stdin = %q, %v", rest, err)
+	}
+}
+
+func TestRequired_ShowsStepDetailsForDeclaredCapabilities(t *testing.T) {
+	wf, err := workflow.LoadFromBytes("remote.yaml", []byte(`
+name: remote
+capabilities:
+  http: true
+steps:
+  - id: ping
+    type: http
+    url: https://status.example.com/ping
+`))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	var out bytes.Buffer
+	caps, declared := Required(wf)
+	describe(&out, "team/remote", "", "abc", false, caps, declared)
+	if !strings.Contains(out.String(), "send HTTP requests to status.example.com") {
+		t.Fatalf("expected the host in the prompt, got %q", out.String())
+	}
+}
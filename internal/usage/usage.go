@@ -0,0 +1,91 @@
+// Package usage turns token counts into costs using a per-model price table.
+package usage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cli-gpt-flows/internal/llm"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPricesFile points at a YAML price table that overrides the defaults.
+// Without it, <user config dir>/pals-gemflows/prices.yaml is used if present.
+const EnvPricesFile = "PALSGEMFLOWS_PRICES_FILE"
+
+// Price is in USD per one million tokens.
+type Price struct {
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
+}
+
+// Prices maps model names to prices.
+type Prices map[string]Price
+
+// DefaultPrices are Google's list prices at the time of writing. They go
+// stale; override them in the prices file rather than editing code.
+func DefaultPrices() Prices {
+	return Prices{
+		"gemini-2.5-pro":        {Input: 1.25, Output: 10.00},
+		"gemini-2.5-flash":      {Input: 0.30, Output: 2.50},
+		"gemini-2.5-flash-lite": {Input: 0.10, Output: 0.40},
+		"gemini-2.0-flash":      {Input: 0.10, Output: 0.40},
+		"gemini-1.5-pro":        {Input: 1.25, Output: 5.00},
+		"gemini-1.5-flash":      {Input: 0.075, Output: 0.30},
+		// Embedding models only bill input.
+		"text-embedding-004":     {Input: 0},
+		"gemini-embedding-001":   {Input: 0.15},
+		"text-embedding-3-small": {Input: 0.02},
+		"text-embedding-3-large": {Input: 0.13},
+	}
+}
+
+// LoadPrices returns the default table merged with the user's prices file.
+//
+// The file is a mapping of model name to price:
+//
+//	gemini-2.5-flash: {input: 0.30, output: 2.50}
+//	llama3.1: {input: 0, output: 0}
+func LoadPrices() (Prices, error) {
+	prices := DefaultPrices()
+
+	path := strings.TrimSpace(os.Getenv(EnvPricesFile))
+	explicit := path != ""
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err != nil || dir == "" {
+			return prices, nil
+		}
+		path = filepath.Join(dir, "pals-gemflows", "prices.yaml")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return prices, nil
+		}
+		return prices, fmt.Errorf("read prices %s: %w", path, err)
+	}
+	var custom Prices
+	if err := yaml.Unmarshal(b, &custom); err != nil {
+		return prices, fmt.Errorf("parse prices %s: %w", path, err)
+	}
+	for model, p := range custom {
+		prices[model] = p
+	}
+	return prices, nil
+}
+
+// Cost returns the USD cost of u on model, and false if the model has no price.
+func (p Prices) Cost(model string, u llm.Usage) (float64, bool) {
+	price, ok := p[strings.TrimPrefix(model, "models/")]
+	if !ok {
+		return 0, false
+	}
+	return (float64(u.PromptTokens)*price.Input + float64(u.CandidateTokens)*price.Output) / 1e6, true
+}
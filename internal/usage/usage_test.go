@@ -0,0 +1,48 @@
+package usage
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cli-gpt-flows/internal/llm"
+)
+
+func TestCost_UsesPerMillionPrices(t *testing.T) {
+	prices := Prices{"gemini-2.5-flash": {Input: 0.30, Output: 2.50}}
+
+	cost, ok := prices.Cost("models/gemini-2.5-flash", llm.Usage{PromptTokens: 1_000_000, CandidateTokens: 200_000})
+	if !ok {
+		t.Fatalf("expected model to be priced")
+	}
+	if math.Abs(cost-0.80) > 1e-9 {
+		t.Fatalf("expected $0.80, got $%f", cost)
+	}
+
+	if _, ok := prices.Cost("unknown-model", llm.Usage{PromptTokens: 10}); ok {
+		t.Fatalf("expected unknown model to be unpriced")
+	}
+}
+
+func TestLoadPrices_MergesFileOverDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prices.yaml")
+	if err := os.WriteFile(path, []byte("llama3.1: {input: 0, output: 0}\ngemini-2.5-flash: {input: 1, output: 2}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(EnvPricesFile, path)
+
+	prices, err := LoadPrices()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if prices["gemini-2.5-flash"] != (Price{Input: 1, Output: 2}) {
+		t.Fatalf("expected file to override default, got %+v", prices["gemini-2.5-flash"])
+	}
+	if _, ok := prices["llama3.1"]; !ok {
+		t.Fatalf("expected custom model to be added")
+	}
+	if _, ok := prices["gemini-2.5-pro"]; !ok {
+		t.Fatalf("expected defaults to be kept")
+	}
+}
@@ -0,0 +1,465 @@
+// Package vectorindex is a flat-file semantic index over a folder of
+// documents: chunks of every file with their embeddings, searched by cosine
+// similarity. It backs `retrieve` steps and the `index` command.
+package vectorindex
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"cli-gpt-flows/internal/chunk"
+	"cli-gpt-flows/internal/llm"
+)
+
+// Version is the on-disk format version; indexes with another version are
+// rebuilt rather than read.
+const Version = 1
+
+// Default chunking of documents.
+const (
+	DefaultChunkTokens   = 500
+	DefaultOverlapTokens = 50
+)
+
+// embedBatch is how many chunks are sent per Embed call.
+const embedBatch = 64
+
+// Index holds the chunks of a folder's documents and their embeddings.
+type Index struct {
+	Version  int    `json:"version"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Dir      string `json:"dir"`
+	// ChunkTokens and OverlapTokens are the chunking the index was built with.
+	ChunkTokens   int `json:"chunk_tokens"`
+	OverlapTokens int `json:"overlap_tokens"`
+	// Revision counts updates of the index; UpdatedAt is the latest one.
+	Revision  int       `json:"revision"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Files maps each indexed file (relative to Dir) to its content hash.
+	Files  map[string]string `json:"files"`
+	Chunks []Chunk           `json:"chunks"`
+}
+
+// Chunk is one passage of a document.
+type Chunk struct {
+	Source string    `json:"source"`
+	Text   string    `json:"text"`
+	Vector []float32 `json:"vector"`
+}
+
+// Hit is a search result.
+type Hit struct {
+	Chunk
+	Score float64
+}
+
+// Options tune Update. Zero values use the defaults.
+type Options struct {
+	ChunkTokens   int
+	OverlapTokens int
+	// PDFText extracts the text of a PDF. When nil, PDFs are not indexed.
+	PDFText func(ctx context.Context, name string, data []byte) (string, error)
+}
+
+func (o Options) withDefaults() Options {
+	if o.ChunkTokens <= 0 {
+		o.ChunkTokens = DefaultChunkTokens
+	}
+	if o.OverlapTokens <= 0 {
+		o.OverlapTokens = DefaultOverlapTokens
+	}
+	return o
+}
+
+// Stats reports what an Update changed.
+type Stats struct {
+	Added, Changed, Removed, Unchanged int
+	Chunks                             int
+}
+
+// Document extensions Update reads; PDFs need Options.PDFText.
+var textExts = map[string]bool{".md": true, ".markdown": true, ".txt": true}
+
+func indexable(path string, opts Options) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return textExts[ext] || (ext == ".pdf" && opts.PDFText != nil)
+}
+
+// Scan hashes the indexable files under dir, keyed by slash-separated path
+// relative to dir. Hidden files and folders are skipped.
+func Scan(dir string, opts Options) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !indexable(path, opts) {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		h := sha256.Sum256(b)
+		files[filepath.ToSlash(rel)] = hex.EncodeToString(h[:])
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan %s: %w", dir, err)
+	}
+	return files, nil
+}
+
+// Update indexes the documents under dir, reusing the chunks of prev for
+// files whose content hash is unchanged. prev may be nil, and is ignored when
+// it was built with another format, provider, model or chunking.
+func Update(ctx context.Context, emb llm.Embedder, prev *Index, provider, model, dir string, opts Options) (*Index, Stats, error) {
+	opts = opts.withDefaults()
+	files, err := Scan(dir, opts)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	if len(files) == 0 {
+		return nil, Stats{}, fmt.Errorf("no documents found in %s", dir)
+	}
+
+	ix := &Index{
+		Version: Version, Provider: provider, Model: model, Dir: dir,
+		ChunkTokens: opts.ChunkTokens, OverlapTokens: opts.OverlapTokens,
+		Revision: 1, UpdatedAt: time.Now().UTC(), Files: files,
+	}
+	if prev != nil && !prev.compatible(ix) {
+		prev = nil
+	}
+	reuse := map[string][]Chunk{}
+	if prev != nil {
+		ix.Revision = prev.Revision + 1
+		for _, c := range prev.Chunks {
+			reuse[c.Source] = append(reuse[c.Source], c)
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var st Stats
+	var fresh []Chunk
+	for _, name := range names {
+		old, seen := prev.file(name)
+		switch {
+		case seen && old == files[name]:
+			st.Unchanged++
+			ix.Chunks = append(ix.Chunks, reuse[name]...)
+			continue
+		case seen:
+			st.Changed++
+		default:
+			st.Added++
+		}
+		text, err := readDocument(ctx, filepath.Join(dir, filepath.FromSlash(name)), name, opts)
+		if err != nil {
+			return nil, Stats{}, err
+		}
+		for _, t := range chunk.Split(text, opts.ChunkTokens, opts.OverlapTokens) {
+			if strings.TrimSpace(t) != "" {
+				fresh = append(fresh, Chunk{Source: name, Text: t})
+			}
+		}
+	}
+	if prev != nil {
+		for name := range prev.Files {
+			if _, ok := files[name]; !ok {
+				st.Removed++
+			}
+		}
+	}
+	if err := embedChunks(ctx, emb, model, fresh); err != nil {
+		return nil, Stats{}, err
+	}
+	ix.Chunks = append(ix.Chunks, fresh...)
+	sort.SliceStable(ix.Chunks, func(i, j int) bool { return ix.Chunks[i].Source < ix.Chunks[j].Source })
+	st.Chunks = len(ix.Chunks)
+	return ix, st, nil
+}
+
+func (ix *Index) compatible(o *Index) bool {
+	return ix.Version == o.Version && ix.Provider == o.Provider && ix.Model == o.Model &&
+		ix.ChunkTokens == o.ChunkTokens && ix.OverlapTokens == o.OverlapTokens
+}
+
+func (ix *Index) file(name string) (string, bool) {
+	if ix == nil {
+		return "", false
+	}
+	h, ok := ix.Files[name]
+	return h, ok
+}
+
+func readDocument(ctx context.Context, path, name string, opts Options) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".pdf") {
+		text, err := opts.PDFText(ctx, name, b)
+		if err != nil {
+			return "", fmt.Errorf("extract text of %s: %w", name, err)
+		}
+		return text, nil
+	}
+	return string(b), nil
+}
+
+func embedChunks(ctx context.Context, emb llm.Embedder, model string, chunks []Chunk) error {
+	for start := 0; start < len(chunks); start += embedBatch {
+		end := min(start+embedBatch, len(chunks))
+		texts := make([]string, 0, end-start)
+		for _, c := range chunks[start:end] {
+			texts = append(texts, c.Text)
+		}
+		vecs, err := emb.Embed(ctx, model, texts)
+		if err != nil {
+			return fmt.Errorf("embed documents: %w", err)
+		}
+		if len(vecs) != len(texts) {
+			return fmt.Errorf("embed documents: got %d vectors for %d chunks", len(vecs), len(texts))
+		}
+		for i, v := range vecs {
+			chunks[start+i].Vector = v
+		}
+	}
+	return nil
+}
+
+// Current reports whether ix was built by the same format, provider, model
+// and chunking from exactly these files.
+func (ix *Index) Current(provider, model string, opts Options, files map[string]string) bool {
+	opts = opts.withDefaults()
+	want := &Index{Version: Version, Provider: provider, Model: model, ChunkTokens: opts.ChunkTokens, OverlapTokens: opts.OverlapTokens}
+	if !ix.compatible(want) || len(ix.Files) != len(files) {
+		return false
+	}
+	for name, h := range files {
+		if ix.Files[name] != h {
+			return false
+		}
+	}
+	return true
+}
+
+// Search returns the k chunks most similar to query, best first.
+func (ix *Index) Search(query []float32, k int) []Hit {
+	hits := make([]Hit, 0, len(ix.Chunks))
+	for _, c := range ix.Chunks {
+		hits = append(hits, Hit{Chunk: c, Score: Cosine(query, c.Vector)})
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	if k > 0 && len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
+
+// Cosine is the cosine similarity of two vectors, or 0 when their lengths
+// differ or either is zero.
+func Cosine(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// Load reads an index file. A missing file returns an error matching
+// fs.ErrNotExist.
+func Load(path string) (*Index, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ix Index
+	if err := json.Unmarshal(b, &ix); err != nil {
+		return nil, fmt.Errorf("parse index %s: %w", path, err)
+	}
+	return &ix, nil
+}
+
+// Save writes ix to path, replacing any previous file atomically.
+func (ix *Index) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(ix)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// DefaultDir is <user cache dir>/pals-gemflows/indexes, where indexes built
+// on demand by retrieve steps are kept.
+func DefaultDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil || dir == "" {
+		// Fallback to current directory if we can't find a cache dir.
+		dir = "."
+	}
+	return filepath.Join(dir, "pals-gemflows", "indexes")
+}
+
+// Ensure returns the index of dir for provider/model, kept in cacheDir and
+// updated first when documents changed.
+func Ensure(ctx context.Context, emb llm.Embedder, provider, model, dir, cacheDir string, opts Options) (*Index, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := Scan(abs, opts)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256([]byte(provider + "\x00" + model + "\x00" + abs))
+	path := filepath.Join(cacheDir, hex.EncodeToString(key[:8])+".json")
+
+	prev, err := Load(path)
+	if err == nil && prev.Current(provider, model, opts, files) {
+		return prev, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "warning: rebuilding unreadable index %s: %v\n", path, err)
+	}
+	fmt.Printf("    indexing %d documents in %s\n", len(files), dir)
+	ix, _, err := Update(ctx, emb, prev, provider, model, abs, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := ix.Save(path); err != nil {
+		return nil, fmt.Errorf("save index: %w", err)
+	}
+	return ix, nil
+}
+
+// EnvDataDir overrides where named indexes (the `index` command) are kept.
+const EnvDataDir = "PALSGEMFLOWS_INDEX_DIR"
+
+// DataDir is where named indexes live: $PALSGEMFLOWS_INDEX_DIR, or
+// pals-gemflows/indexes in the user data dir ($XDG_DATA_HOME or
+// ~/.local/share on Linux, the config dir on macOS and Windows).
+func DataDir() string {
+	if dir := os.Getenv(EnvDataDir); dir != "" {
+		return dir
+	}
+	base := os.Getenv("XDG_DATA_HOME")
+	if base == "" {
+		switch runtime.GOOS {
+		case "darwin", "ios", "windows", "plan9":
+			base, _ = os.UserConfigDir()
+		default:
+			if home, err := os.UserHomeDir(); err == nil {
+				base = filepath.Join(home, ".local", "share")
+			}
+		}
+	}
+	if base == "" {
+		base = "."
+	}
+	return filepath.Join(base, "pals-gemflows", "indexes")
+}
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// NamedPath returns the file of the named index, rejecting names that
+// aren't plain identifiers.
+func NamedPath(name string) (string, error) {
+	if !namePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid index name %q (use letters, digits, '.', '_' and '-')", name)
+	}
+	return filepath.Join(DataDir(), name, "index.json"), nil
+}
+
+// LoadNamed reads a named index.
+func LoadNamed(name string) (*Index, error) {
+	path, err := NamedPath(name)
+	if err != nil {
+		return nil, err
+	}
+	ix, err := Load(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("index %s not found; create it with `pals-gemflows index <dir> --name %s`", name, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ix.Version != Version {
+		return nil, fmt.Errorf("index %s has format version %d (want %d); re-run `pals-gemflows index %s --name %s`", name, ix.Version, Version, ix.Dir, name)
+	}
+	return ix, nil
+}
+
+// UpdateNamed indexes dir into the named index, re-embedding only new and
+// changed files, and saves it.
+func UpdateNamed(ctx context.Context, emb llm.Embedder, name, provider, model, dir string, opts Options) (*Index, Stats, error) {
+	path, err := NamedPath(name)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	prev, err := Load(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "warning: rebuilding unreadable index %s: %v\n", path, err)
+	}
+	ix, st, err := Update(ctx, emb, prev, provider, model, abs, opts)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	if err := ix.Save(path); err != nil {
+		return nil, Stats{}, fmt.Errorf("save index: %w", err)
+	}
+	return ix, st, nil
+}
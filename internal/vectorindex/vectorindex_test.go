@@ -0,0 +1,151 @@
+package vectorindex
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// letters embeds text as its letter counts, so texts sharing words score high.
+type letters struct{ calls int }
+
+func (l *letters) Embed(_ context.Context, _ string, texts []string) ([][]float32, error) {
+	l.calls++
+	out := make([][]float32, len(texts))
+	for i, t := range texts {
+		v := make([]float32, 26)
+		for _, r := range strings.ToLower(t) {
+			if r >= 'a' && r <= 'z' {
+				v[r-'a']++
+			}
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func writeDocs(t *testing.T, dir string, docs map[string]string) {
+	t.Helper()
+	for name, body := range docs {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEnsure_SearchesAndReusesIndex(t *testing.T) {
+	docs := t.TempDir()
+	writeDocs(t, docs, map[string]string{
+		"portal.md":       "zzz zzz customer portal zzz",
+		"mobile/app.txt":  "xxx mobile app xxx",
+		".hidden/skip.md": "zzz",
+		"image.png":       "not a document",
+	})
+	cacheDir := t.TempDir()
+	emb := &letters{}
+
+	ix, err := Ensure(context.Background(), emb, "gemini", "m", docs, cacheDir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ix.Files) != 2 {
+		t.Fatalf("indexed files = %v", ix.Files)
+	}
+	q, _ := emb.Embed(context.Background(), "m", []string{"zzz portal"})
+	hits := ix.Search(q[0], 1)
+	if len(hits) != 1 || hits[0].Source != "portal.md" {
+		t.Fatalf("hits = %+v", hits)
+	}
+
+	calls := emb.calls
+	if _, err := Ensure(context.Background(), emb, "gemini", "m", docs, cacheDir, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if emb.calls != calls {
+		t.Fatal("unchanged documents were embedded again")
+	}
+
+	writeDocs(t, docs, map[string]string{"portal.md": "changed"})
+	if _, err := Ensure(context.Background(), emb, "gemini", "m", docs, cacheDir, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if emb.calls == calls {
+		t.Fatal("changed documents were not re-embedded")
+	}
+}
+
+func TestCosine(t *testing.T) {
+	if got := Cosine([]float32{1, 0}, []float32{2, 0}); got < 0.999 {
+		t.Fatalf("parallel vectors: %v", got)
+	}
+	if got := Cosine([]float32{1, 0}, []float32{0, 1}); got != 0 {
+		t.Fatalf("orthogonal vectors: %v", got)
+	}
+	if got := Cosine([]float32{1}, []float32{1, 2}); got != 0 {
+		t.Fatalf("length mismatch: %v", got)
+	}
+}
+
+func TestUpdateNamed_ReembedsOnlyChangedFiles(t *testing.T) {
+	t.Setenv(EnvDataDir, t.TempDir())
+	docs := t.TempDir()
+	writeDocs(t, docs, map[string]string{"a.md": "alpha", "b.md": "beta", "c.txt": "gamma"})
+	emb := &counting{}
+
+	ix, st, err := UpdateNamed(context.Background(), emb, "specs", "gemini", "m", docs, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Added != 3 || ix.Revision != 1 {
+		t.Fatalf("first update: %+v, revision %d", st, ix.Revision)
+	}
+
+	writeDocs(t, docs, map[string]string{"b.md": "beta v2", "d.md": "delta"})
+	if err := os.Remove(filepath.Join(docs, "c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	emb.texts = nil
+	ix, st, err = UpdateNamed(context.Background(), emb, "specs", "gemini", "m", docs, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Stats{Added: 1, Changed: 1, Removed: 1, Unchanged: 1, Chunks: 3}
+	if st != want || ix.Revision != 2 {
+		t.Fatalf("second update: %+v (want %+v), revision %d", st, want, ix.Revision)
+	}
+	if strings.Join(emb.texts, ",") != "beta v2,delta" {
+		t.Fatalf("embedded %q", emb.texts)
+	}
+
+	loaded, err := LoadNamed("specs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Chunks) != 3 || loaded.Chunks[0].Source != "a.md" || loaded.Chunks[0].Vector == nil {
+		t.Fatalf("loaded chunks = %+v", loaded.Chunks)
+	}
+	if _, err := LoadNamed("missing"); err == nil || !strings.Contains(err.Error(), "pals-gemflows index") {
+		t.Fatalf("missing index error = %v", err)
+	}
+	if _, err := NamedPath("../escape"); err == nil {
+		t.Fatal("expected an invalid name error")
+	}
+}
+
+// counting records the texts it embeds.
+type counting struct{ texts []string }
+
+func (c *counting) Embed(_ context.Context, _ string, texts []string) ([][]float32, error) {
+	c.texts = append(c.texts, texts...)
+	out := make([][]float32, len(texts))
+	for i := range texts {
+		out[i] = []float32{1}
+	}
+	return out, nil
+}
@@ -0,0 +1,258 @@
+package workflow
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Capabilities is what a recipe may do beyond prompting the user and
+// calling models: read or write files, use the clipboard, run commands or
+// send HTTP requests. Models lists the models (or aliases) it calls.
+//
+// The remaining fields are never declared; Required fills them in from the
+// steps so a trust prompt can say what exactly the recipe touches.
+type Capabilities struct {
+	FileRead       bool     `yaml:"file_read"`
+	FileWrite      bool     `yaml:"file_write"`
+	ClipboardRead  bool     `yaml:"clipboard_read"`
+	ClipboardWrite bool     `yaml:"clipboard_write"`
+	Shell          bool     `yaml:"shell"`
+	HTTP           bool     `yaml:"http"`
+	Models         []string `yaml:"models"`
+
+	// Commands are the shell commands, Hosts the hosts (or templated URLs)
+	// of http steps and TokenEnvs their bearer_token_env variables.
+	Commands  []string `yaml:"-"`
+	Hosts     []string `yaml:"-"`
+	TokenEnvs []string `yaml:"-"`
+	// ToolDirs are the allow_dirs of tools, and RecipeDirs those of the
+	// run_recipe tool, whose child recipes may do anything the recipe
+	// itself is allowed to.
+	ToolDirs   []string `yaml:"-"`
+	RecipeDirs []string `yaml:"-"`
+}
+
+// Required works out the capabilities the steps of wf use. Templated model
+// names can't be known up front and are left out.
+func Required(wf Workflow) Capabilities {
+	var c Capabilities
+	models := map[string]struct{}{}
+	commands, hosts, envs := newSet(), newSet(), newSet()
+	toolDirs, recipeDirs := newSet(), newSet()
+	for _, s := range wf.Steps {
+		switch s.Type {
+		case "input":
+			c.ClipboardRead = c.ClipboardRead || s.FromClipboard
+		case TypeReadFile:
+			c.FileRead = true
+		case "save":
+			c.FileWrite = true
+		case "clipboard":
+			c.ClipboardWrite = true
+		case TypeShell:
+			c.Shell = true
+			if s.Command != "" {
+				commands.add(s.Command)
+			} else {
+				commands.add(strings.Join(s.Args, " "))
+			}
+		case TypeHTTP:
+			c.HTTP = true
+			hosts.add(urlHost(s.URL))
+			envs.add(s.BearerTokenEnv)
+		case TypeRetrieve:
+			c.FileRead = c.FileRead || s.Documents != ""
+		}
+		if len(s.Attachments) > 0 || len(s.Tools) > 0 {
+			c.FileRead = true
+		}
+		for _, t := range s.Tools {
+			for _, d := range t.AllowDirs {
+				toolDirs.add(d)
+				if t.Name == ToolRunRecipe {
+					recipeDirs.add(d)
+				}
+			}
+		}
+		if IsModelStep(s.Type) || IsEmbeddingStep(s.Type) {
+			for _, m := range append([]string{s.Model}, s.FallbackModels...) {
+				if m != "" && !strings.Contains(m, "{{") {
+					models[m] = struct{}{}
+				}
+			}
+		}
+	}
+	for m := range models {
+		c.Models = append(c.Models, m)
+	}
+	sort.Strings(c.Models)
+	c.Commands, c.Hosts, c.TokenEnvs = commands.list(), hosts.list(), envs.list()
+	c.ToolDirs, c.RecipeDirs = toolDirs.list(), recipeDirs.list()
+	return c
+}
+
+// Effective is what wf may do: its declared capabilities, or the inferred
+// ones when it declares none, with the commands, hosts, token variables and
+// directories its steps use.
+func Effective(wf Workflow) Capabilities {
+	inferred := Required(wf)
+	if wf.Capabilities == nil {
+		return inferred
+	}
+	c := *wf.Capabilities
+	c.Commands, c.Hosts, c.TokenEnvs = inferred.Commands, inferred.Hosts, inferred.TokenEnvs
+	c.ToolDirs, c.RecipeDirs = inferred.ToolDirs, inferred.RecipeDirs
+	return c
+}
+
+// urlHost is the host of a URL, or the whole URL when its host is templated
+// or it doesn't parse.
+func urlHost(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || strings.Contains(u.Host, "{{") {
+		return raw
+	}
+	return u.Host
+}
+
+// set collects distinct non-empty strings in the order they were added.
+type set struct {
+	seen  map[string]struct{}
+	items []string
+}
+
+func newSet() *set { return &set{seen: map[string]struct{}{}} }
+
+func (s *set) add(v string) {
+	v = strings.TrimSpace(v)
+	if _, ok := s.seen[v]; ok || v == "" {
+		return
+	}
+	s.seen[v] = struct{}{}
+	s.items = append(s.items, v)
+}
+
+func (s *set) list() []string { return s.items }
+
+// Missing lists the capabilities in need that c doesn't grant.
+func (c Capabilities) Missing(need Capabilities) []string {
+	var out []string
+	for _, f := range c.flags() {
+		if f.need(need) && !f.need(c) {
+			out = append(out, f.name)
+		}
+	}
+	declared := map[string]struct{}{}
+	for _, m := range c.Models {
+		declared[m] = struct{}{}
+	}
+	for _, m := range need.Models {
+		if _, ok := declared[m]; !ok {
+			out = append(out, "model "+m)
+		}
+	}
+	return out
+}
+
+// Exceeded lists what need does beyond c, models aside: capabilities c
+// doesn't grant and commands, hosts and token variables c doesn't list.
+func (c Capabilities) Exceeded(need Capabilities) []string {
+	need.Models = nil
+	out := c.Missing(need)
+	for _, d := range []struct {
+		name       string
+		have, want []string
+	}{
+		{"command", c.Commands, need.Commands},
+		{"host", c.Hosts, need.Hosts},
+		{"token variable", c.TokenEnvs, need.TokenEnvs},
+	} {
+		for _, v := range d.want {
+			if !contains(d.have, v) {
+				out = append(out, d.name+" "+v)
+			}
+		}
+	}
+	return out
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe lists the capabilities as short phrases for a trust prompt,
+// naming the commands, hosts, token variables and directories involved.
+func (c Capabilities) Describe() []string {
+	var out []string
+	for _, f := range c.flags() {
+		if !f.need(c) {
+			continue
+		}
+		desc := f.desc
+		switch f.name {
+		case "shell":
+			if len(c.Commands) > 0 {
+				desc += ": " + strings.Join(quoted(c.Commands), ", ")
+			}
+		case "http":
+			if len(c.Hosts) > 0 {
+				desc += " to " + strings.Join(c.Hosts, ", ")
+			}
+			if len(c.TokenEnvs) > 0 {
+				desc += ", sending tokens from " + strings.Join(c.TokenEnvs, ", ")
+			}
+		}
+		out = append(out, desc)
+	}
+	if len(c.ToolDirs) > 0 {
+		out = append(out, "let the model read files in "+strings.Join(c.ToolDirs, ", "))
+	}
+	if len(c.RecipeDirs) > 0 {
+		out = append(out, "let the model run recipes from "+strings.Join(c.RecipeDirs, ", ")+", limited to the capabilities, commands, hosts and tokens listed here")
+	}
+	if len(c.Models) > 0 {
+		out = append(out, "call models: "+strings.Join(c.Models, ", "))
+	}
+	return out
+}
+
+func quoted(items []string) []string {
+	out := make([]string, len(items))
+	for i, v := range items {
+		out[i] = "`" + v + "`"
+	}
+	return out
+}
+
+type capabilityFlag struct {
+	name, desc string
+	need       func(Capabilities) bool
+}
+
+func (Capabilities) flags() []capabilityFlag {
+	return []capabilityFlag{
+		{"file_read", "read files in the output directory", func(c Capabilities) bool { return c.FileRead }},
+		{"file_write", "write files in the output directory", func(c Capabilities) bool { return c.FileWrite }},
+		{"clipboard_read", "read the clipboard", func(c Capabilities) bool { return c.ClipboardRead }},
+		{"clipboard_write", "write the clipboard", func(c Capabilities) bool { return c.ClipboardWrite }},
+		{"shell", "run shell commands", func(c Capabilities) bool { return c.Shell }},
+		{"http", "send HTTP requests", func(c Capabilities) bool { return c.HTTP }},
+	}
+}
+
+func validateCapabilities(wf Workflow) error {
+	if wf.Capabilities == nil {
+		return nil
+	}
+	if missing := wf.Capabilities.Missing(Required(wf)); len(missing) > 0 {
+		return fmt.Errorf("capabilities does not declare what the steps use: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
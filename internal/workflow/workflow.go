@@ -7,28 +7,252 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"cli-gpt-flows/internal/jsonschema"
+	"cli-gpt-flows/internal/llm"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Step struct {
-	ID           string `yaml:"id"`
-	Type         string `yaml:"type"`
-	Prompt       string `yaml:"prompt"`
-	Multiline    bool   `yaml:"multiline"`
-	FromClipboard bool  `yaml:"from_clipboard"`
-	UserPrompt   string `yaml:"user_prompt"`
-	SystemPrompt string `yaml:"system_prompt"`
-	Model        string `yaml:"model"`
-	Filename     string `yaml:"filename"`
-	Content      string `yaml:"content"`
+	ID            string `yaml:"id"`
+	Type          string `yaml:"type"`
+	Prompt        string `yaml:"prompt"`
+	Multiline     bool   `yaml:"multiline"`
+	FromClipboard bool   `yaml:"from_clipboard"`
+	UserPrompt    string `yaml:"user_prompt"`
+	SystemPrompt  string `yaml:"system_prompt"`
+	// Model is a model name or alias. In YAML it may also be a list
+	// (`model: [primary, fallback]`); the rest of the list ends up in
+	// FallbackModels, tried when a model is missing, out of quota or blocked.
+	Model          string   `yaml:"model"`
+	FallbackModels []string `yaml:"-"`
+	Provider       string   `yaml:"provider"`
+	Filename       string   `yaml:"filename"`
+	Content        string   `yaml:"content"`
+	// Mode is how a save step treats an existing file: overwrite (default),
+	// append, create_only or version (write name-1.ext, name-2.ext, ...).
+	Mode          string `yaml:"mode"`
 	ParallelGroup string `yaml:"parallel_group"`
+	// Conversation names a chat history shared by gemini steps: each step sees
+	// the earlier turns of the same conversation and adds its own.
+	Conversation string `yaml:"conversation"`
+	// InteractiveRefine opens a terminal loop after a gemini step so the user can
+	// request changes before the accepted version is stored under the step id.
+	InteractiveRefine bool `yaml:"interactive_refine"`
+	// Tools lets the model call built-in local capabilities; the engine runs
+	// the calls and feeds results back until the model answers (at most
+	// MaxToolCalls calls, default 10).
+	Tools        []ToolConfig `yaml:"tools"`
+	MaxToolCalls int          `yaml:"max_tool_calls"`
+	// Attachments are file paths (templated, so `{{ save_step }}` works) sent
+	// with the prompt of a gemini step.
+	Attachments []string `yaml:"attachments"`
+	// Stream echoes tokens live for sequential gemini steps (default true).
+	Stream *bool `yaml:"stream"`
+
+	// Generation tunes sampling (temperature, top_p, ...) for gemini steps.
+	Generation *llm.GenerationConfig `yaml:"generation"`
+	// Safety sets Gemini's block threshold per harm category, e.g.
+	// `harassment: block_only_high`.
+	Safety map[string]string `yaml:"safety"`
+
+	// ResponseFormat `json` makes a gemini step return validated JSON, optionally
+	// checked against ResponseSchema and re-prompted up to SchemaRetries times.
+	ResponseFormat string         `yaml:"response_format"`
+	ResponseSchema map[string]any `yaml:"response_schema"`
+	SchemaRetries  *int           `yaml:"schema_retries"`
+
+	// MaxInputTokens caps the prompt size of a gemini step; it defaults to the
+	// model's context window when the provider can report it. Prompts over the
+	// limit fail before the call unless Chunking says how to split them.
+	MaxInputTokens int       `yaml:"max_input_tokens"`
+	Chunking       *Chunking `yaml:"chunking"`
+
+	// Input is the text an embed step embeds.
+	Input string `yaml:"input"`
+	// Query is what a retrieve step searches Documents (a folder of .md/.txt
+	// files) or Index (built by the `index` command) for; the TopK best
+	// passages (default 5) are stored under the id.
+	Query     string `yaml:"query"`
+	Documents string `yaml:"documents"`
+	Index     string `yaml:"index"`
+	TopK      int    `yaml:"top_k"`
+	// ChunkTokens and OverlapTokens split the input of an embed step, or the
+	// documents of a retrieve step, into overlapping passages.
+	ChunkTokens   int `yaml:"chunk_tokens"`
+	OverlapTokens int `yaml:"overlap_tokens"`
+
+	// Command (run by the shell) or Args (run directly, no shell) is what a
+	// shell step executes, with Stdin fed to it. It is killed after Timeout
+	// (default 60s); a non-zero exit fails the step unless AllowFailure.
+	Command      string   `yaml:"command"`
+	Args         []string `yaml:"args"`
+	Stdin        string   `yaml:"stdin"`
+	Timeout      string   `yaml:"timeout"`
+	AllowFailure bool     `yaml:"allow_failure"`
+
+	// Method, URL, Headers and Body (or JSON, sent as application/json) make
+	// the request of an http step. BearerTokenEnv names an environment
+	// variable holding a bearer token; it must start with TokenEnvPrefix so a
+	// recipe can't send other secrets. Failed attempts are retried Retries
+	// times; Timeout (default 30s) bounds each attempt and AllowFailure keeps
+	// non-2xx responses from failing the step.
+	Method         string            `yaml:"method"`
+	URL            string            `yaml:"url"`
+	Headers        map[string]string `yaml:"headers"`
+	Body           string            `yaml:"body"`
+	JSON           any               `yaml:"json"`
+	BearerTokenEnv string            `yaml:"bearer_token_env"`
+	Retries        int               `yaml:"retries"`
+
+	// Path is the file, or glob of files, a read_file step loads. At most
+	// MaxFiles files (default 50) and MaxBytes bytes in total (default 1 MiB)
+	// are read. Concat joins them into one text with a header per file.
+	Path     string `yaml:"path"`
+	MaxFiles int    `yaml:"max_files"`
+	MaxBytes int64  `yaml:"max_bytes"`
+	Concat   bool   `yaml:"concat"`
+}
+
+// Chunking splits an input into overlapping chunks, runs the step's
+// user_prompt once per chunk (with `{{ <input> }}` bound to the chunk, at most
+// Concurrency at a time) and combines the partial results with ReducePrompt,
+// where `{{ partials }}` holds them. gemini steps only chunk inputs over their
+// limit; map_reduce steps always do.
+type Chunking struct {
+	Input         string `yaml:"input"`
+	ChunkTokens   int    `yaml:"chunk_tokens"`
+	OverlapTokens int    `yaml:"overlap_tokens"`
+	Concurrency   int    `yaml:"concurrency"`
+	ReducePrompt  string `yaml:"reduce_prompt"`
+}
+
+// UnmarshalYAML accepts `model` as a single name or as a fallback list.
+func (s *Step) UnmarshalYAML(n *yaml.Node) error {
+	type plain Step
+
+	var model *yaml.Node
+	if n.Kind == yaml.MappingNode {
+		rest := *n
+		rest.Content = nil
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == "model" {
+				model = n.Content[i+1]
+				continue
+			}
+			rest.Content = append(rest.Content, n.Content[i], n.Content[i+1])
+		}
+		n = &rest
+	}
+	if err := n.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	if model == nil {
+		return nil
+	}
+
+	switch model.Kind {
+	case yaml.ScalarNode:
+		return model.Decode(&s.Model)
+	case yaml.SequenceNode:
+		var list []string
+		if err := model.Decode(&list); err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			return fmt.Errorf("line %d: model list is empty", model.Line)
+		}
+		s.Model, s.FallbackModels = list[0], list[1:]
+		return nil
+	default:
+		return fmt.Errorf("line %d: model must be a name or a list of names", model.Line)
+	}
+}
+
+// ToolConfig enables one built-in tool on a gemini step. Every tool only
+// touches files inside AllowDirs.
+type ToolConfig struct {
+	Name      string   `yaml:"name"`
+	AllowDirs []string `yaml:"allow_dirs"`
+}
+
+// Built-in tools available to gemini steps.
+const (
+	ToolReadFile  = "read_file"
+	ToolLookup    = "lookup"
+	ToolRunRecipe = "run_recipe"
+)
+
+// Providers a `gemini` step can be routed to via `provider:`.
+const (
+	ProviderGemini = "gemini"
+	ProviderOpenAI = "openai"
+)
+
+// Step types that call a model. map_reduce runs a gemini-style step over the
+// chunks of a large input and reduces the results.
+const (
+	TypeGemini    = "gemini"
+	TypeMapReduce = "map_reduce"
+)
+
+// Modes of a save step.
+const (
+	SaveOverwrite  = "overwrite"
+	SaveAppend     = "append"
+	SaveCreateOnly = "create_only"
+	SaveVersion    = "version"
+)
+
+// Step types that talk to the outside world: TypeShell runs a local
+// command, TypeHTTP sends an HTTP request and TypeReadFile loads files.
+const (
+	TypeShell    = "shell"
+	TypeHTTP     = "http"
+	TypeReadFile = "read_file"
+)
+
+// TokenEnvPrefix is the prefix every bearer_token_env variable must have.
+const TokenEnvPrefix = "PALSGEMFLOWS_TOKEN_"
+
+// Step types that call an embedding model.
+const (
+	TypeEmbed    = "embed"
+	TypeRetrieve = "retrieve"
+)
+
+// IsEmbeddingStep reports whether steps of type t embed text, and so accept
+// model and provider.
+func IsEmbeddingStep(t string) bool {
+	return t == TypeEmbed || t == TypeRetrieve
+}
+
+// IsModelStep reports whether steps of type t call a model, and so accept
+// model, provider, generation and response_format.
+func IsModelStep(t string) bool {
+	return t == TypeGemini || t == TypeMapReduce
 }
 
 type Workflow struct {
 	Name        string `yaml:"name"`
 	Description string `yaml:"description"`
 	Steps       []Step `yaml:"steps"`
+
+	// MaxCost (USD) and MaxTokens cap what a run may spend on model calls.
+	// Zero means no limit.
+	MaxCost   float64 `yaml:"max_cost"`
+	MaxTokens int     `yaml:"max_tokens"`
+
+	// CacheTTL (e.g. "24h") opts the workflow into the on-disk response
+	// cache: identical model calls within the TTL are answered from disk.
+	CacheTTL string `yaml:"cache_ttl"`
+
+	// Capabilities declares what the recipe needs (files, clipboard, shell,
+	// http, models). When set, steps may not use anything undeclared; the CLI
+	// shows it before running an untrusted remote recipe.
+	Capabilities *Capabilities `yaml:"capabilities"`
 }
 
 func LoadFromWorkflowsDir(dir string, key string) (Workflow, error) {
@@ -118,6 +342,22 @@ func validateWorkflow(wf Workflow) error {
 	if len(wf.Steps) == 0 {
 		return errors.New("steps is required")
 	}
+	if wf.MaxCost < 0 {
+		return errors.New("max_cost must not be negative")
+	}
+	if wf.MaxTokens < 0 {
+		return errors.New("max_tokens must not be negative")
+	}
+	if wf.CacheTTL != "" {
+		ttl, err := time.ParseDuration(wf.CacheTTL)
+		if err != nil || ttl <= 0 {
+			return errors.New(`cache_ttl must be a positive duration such as "30m" or "24h"`)
+		}
+	}
+
+	if err := validateCapabilities(wf); err != nil {
+		return err
+	}
 
 	seenIDs := map[string]struct{}{}
 	for i, s := range wf.Steps {
@@ -130,9 +370,386 @@ func validateWorkflow(wf Workflow) error {
 		seenIDs[s.ID] = struct{}{}
 
 		switch s.Type {
-		case "input", "gemini", "save", "clipboard":
+		case "input", TypeReadFile, TypeGemini, TypeMapReduce, TypeEmbed, TypeRetrieve, TypeShell, TypeHTTP, "save", "clipboard":
+		default:
+			return fmt.Errorf("steps[%d].type must be one of: input, read_file, gemini, map_reduce, embed, retrieve, shell, http, save, clipboard", i)
+		}
+
+		switch s.Provider {
+		case "", ProviderGemini, ProviderOpenAI:
 		default:
-			return fmt.Errorf("steps[%d].type must be one of: input, gemini, save, clipboard", i)
+			return fmt.Errorf("steps[%d].provider must be one of: %s, %s", i, ProviderGemini, ProviderOpenAI)
+		}
+		if len(s.FallbackModels) > 0 {
+			if !IsModelStep(s.Type) {
+				return fmt.Errorf("steps[%d].model lists are only supported on gemini and map_reduce steps", i)
+			}
+			for j, m := range append([]string{s.Model}, s.FallbackModels...) {
+				if strings.TrimSpace(m) == "" {
+					return fmt.Errorf("steps[%d].model[%d] must not be empty", i, j)
+				}
+			}
+		}
+		if s.Provider != "" && !IsModelStep(s.Type) && !IsEmbeddingStep(s.Type) {
+			return fmt.Errorf("steps[%d].provider is only supported on gemini, map_reduce, embed and retrieve steps", i)
+		}
+
+		if s.Generation != nil {
+			if !IsModelStep(s.Type) {
+				return fmt.Errorf("steps[%d].generation is only supported on gemini and map_reduce steps", i)
+			}
+			if err := validateGeneration(*s.Generation, s.Provider); err != nil {
+				return fmt.Errorf("steps[%d].generation.%w", i, err)
+			}
+		}
+
+		if err := validateSafety(s); err != nil {
+			return fmt.Errorf("steps[%d].%w", i, err)
+		}
+
+		if s.Conversation != "" {
+			if s.Type != "gemini" {
+				return fmt.Errorf("steps[%d].conversation is only supported on gemini steps", i)
+			}
+			if s.ParallelGroup != "" {
+				return fmt.Errorf("steps[%d].conversation cannot be used inside a parallel_group", i)
+			}
+		}
+		if s.InteractiveRefine {
+			if s.Type != "gemini" {
+				return fmt.Errorf("steps[%d].interactive_refine is only supported on gemini steps", i)
+			}
+			if s.ParallelGroup != "" {
+				return fmt.Errorf("steps[%d].interactive_refine cannot be used inside a parallel_group", i)
+			}
+			if s.ResponseFormat != "" {
+				return fmt.Errorf("steps[%d].interactive_refine cannot be combined with response_format", i)
+			}
+		}
+		if err := validateTools(s); err != nil {
+			return fmt.Errorf("steps[%d].%w", i, err)
+		}
+		if len(s.Attachments) > 0 && s.Type != "gemini" {
+			return fmt.Errorf("steps[%d].attachments is only supported on gemini steps", i)
+		}
+		if s.Stream != nil && !IsModelStep(s.Type) {
+			return fmt.Errorf("steps[%d].stream is only supported on gemini and map_reduce steps", i)
+		}
+
+		if err := validateResponseFormat(s); err != nil {
+			return fmt.Errorf("steps[%d].%w", i, err)
+		}
+		if err := validateChunking(s); err != nil {
+			return fmt.Errorf("steps[%d].%w", i, err)
+		}
+		if err := validateEmbedding(s); err != nil {
+			return fmt.Errorf("steps[%d].%w", i, err)
+		}
+		if err := validateShell(s); err != nil {
+			return fmt.Errorf("steps[%d].%w", i, err)
+		}
+		if err := validateHTTP(s); err != nil {
+			return fmt.Errorf("steps[%d].%w", i, err)
+		}
+		if err := validateReadFile(s); err != nil {
+			return fmt.Errorf("steps[%d].%w", i, err)
+		}
+		if s.Mode != "" {
+			if s.Type != "save" {
+				return fmt.Errorf("steps[%d].mode is only supported on save steps", i)
+			}
+			switch s.Mode {
+			case SaveOverwrite, SaveAppend, SaveCreateOnly, SaveVersion:
+			default:
+				return fmt.Errorf("steps[%d].mode must be one of: %s, %s, %s, %s", i, SaveOverwrite, SaveAppend, SaveCreateOnly, SaveVersion)
+			}
+		}
+	}
+	return nil
+}
+
+func validateGeneration(g llm.GenerationConfig, provider string) error {
+	if g.Temperature != nil && (*g.Temperature < 0 || *g.Temperature > 2) {
+		return errors.New("temperature must be between 0 and 2")
+	}
+	if g.TopP != nil && (*g.TopP < 0 || *g.TopP > 1) {
+		return errors.New("top_p must be between 0 and 1")
+	}
+	if g.TopK != nil && *g.TopK < 1 {
+		return errors.New("top_k must be at least 1")
+	}
+	if g.MaxOutputTokens != nil && *g.MaxOutputTokens < 1 {
+		return errors.New("max_output_tokens must be at least 1")
+	}
+	if g.CandidateCount != nil && *g.CandidateCount < 1 {
+		return errors.New("candidate_count must be at least 1")
+	}
+	if len(g.StopSequences) > 5 {
+		return errors.New("stop_sequences supports at most 5 entries")
+	}
+	for j, seq := range g.StopSequences {
+		if seq == "" {
+			return fmt.Errorf("stop_sequences[%d] must not be empty", j)
+		}
+	}
+	if g.Seed != nil && provider != ProviderOpenAI {
+		return errors.New("seed is only supported with provider: openai")
+	}
+	return nil
+}
+
+func validateSafety(s Step) error {
+	if len(s.Safety) == 0 {
+		return nil
+	}
+	if !IsModelStep(s.Type) {
+		return errors.New("safety is only supported on gemini and map_reduce steps")
+	}
+	if s.Provider == ProviderOpenAI {
+		return errors.New("safety is not supported with provider: openai")
+	}
+	for category, threshold := range s.Safety {
+		switch category {
+		case llm.HarmHarassment, llm.HarmHateSpeech, llm.HarmSexuallyExplicit, llm.HarmDangerousContent:
+		default:
+			return fmt.Errorf("safety.%s: category must be one of: %s, %s, %s, %s", category,
+				llm.HarmHarassment, llm.HarmHateSpeech, llm.HarmSexuallyExplicit, llm.HarmDangerousContent)
+		}
+		switch threshold {
+		case llm.BlockNone, llm.BlockOnlyHigh, llm.BlockMediumAndAbove, llm.BlockLowAndAbove:
+		default:
+			return fmt.Errorf("safety.%s must be one of: %s, %s, %s, %s", category,
+				llm.BlockNone, llm.BlockOnlyHigh, llm.BlockMediumAndAbove, llm.BlockLowAndAbove)
+		}
+	}
+	return nil
+}
+
+func validateResponseFormat(s Step) error {
+	switch s.ResponseFormat {
+	case "":
+		if s.ResponseSchema != nil {
+			return errors.New("response_schema requires response_format: json")
+		}
+		if s.SchemaRetries != nil {
+			return errors.New("schema_retries requires response_format: json")
+		}
+		return nil
+	case llm.FormatJSON:
+	default:
+		return errors.New("response_format must be json")
+	}
+
+	if !IsModelStep(s.Type) {
+		return errors.New("response_format is only supported on gemini and map_reduce steps")
+	}
+	if s.SchemaRetries != nil && *s.SchemaRetries < 0 {
+		return errors.New("schema_retries must not be negative")
+	}
+	if s.ResponseSchema != nil {
+		if err := jsonschema.Check(s.ResponseSchema); err != nil {
+			return fmt.Errorf("response_schema: %w", err)
+		}
+	}
+	return nil
+}
+
+func validateChunking(s Step) error {
+	if s.MaxInputTokens < 0 {
+		return errors.New("max_input_tokens must not be negative")
+	}
+	if s.MaxInputTokens > 0 && s.Type != TypeGemini {
+		return errors.New("max_input_tokens is only supported on gemini steps")
+	}
+	c := s.Chunking
+	if c == nil {
+		if s.Type == TypeMapReduce {
+			return errors.New("chunking is required for map_reduce steps")
+		}
+		return nil
+	}
+	if !IsModelStep(s.Type) {
+		return errors.New("chunking is only supported on gemini and map_reduce steps")
+	}
+	if s.Type == TypeMapReduce && s.ParallelGroup != "" {
+		return errors.New("map_reduce steps cannot be used inside a parallel_group")
+	}
+	if s.Conversation != "" || len(s.Tools) > 0 || len(s.Attachments) > 0 {
+		return errors.New("chunking cannot be combined with conversation, tools or attachments")
+	}
+	if strings.TrimSpace(c.Input) == "" {
+		return errors.New("chunking.input is required")
+	}
+	if !strings.Contains(s.UserPrompt, c.Input) {
+		return fmt.Errorf("chunking.input %s must be used in user_prompt", c.Input)
+	}
+	if strings.TrimSpace(c.ReducePrompt) == "" {
+		return errors.New("chunking.reduce_prompt is required")
+	}
+	if c.ChunkTokens < 0 {
+		return errors.New("chunking.chunk_tokens must not be negative")
+	}
+	if c.OverlapTokens < 0 {
+		return errors.New("chunking.overlap_tokens must not be negative")
+	}
+	if c.ChunkTokens > 0 && c.OverlapTokens >= c.ChunkTokens {
+		return errors.New("chunking.overlap_tokens must be smaller than chunk_tokens")
+	}
+	if c.Concurrency < 0 {
+		return errors.New("chunking.concurrency must not be negative")
+	}
+	return nil
+}
+
+func validateEmbedding(s Step) error {
+	if !IsEmbeddingStep(s.Type) {
+		if s.Input != "" || s.Query != "" || s.Documents != "" || s.Index != "" || s.TopK != 0 || s.ChunkTokens != 0 || s.OverlapTokens != 0 {
+			return errors.New("input, query, documents, index, top_k, chunk_tokens and overlap_tokens are only supported on embed and retrieve steps")
+		}
+		return nil
+	}
+	if s.ParallelGroup != "" {
+		return fmt.Errorf("%s steps cannot be used inside a parallel_group", s.Type)
+	}
+	switch s.Type {
+	case TypeEmbed:
+		if strings.TrimSpace(s.Input) == "" {
+			return errors.New("input is required for embed steps")
+		}
+		if s.Query != "" || s.Documents != "" || s.Index != "" || s.TopK != 0 {
+			return errors.New("query, documents, index and top_k are only supported on retrieve steps")
+		}
+	case TypeRetrieve:
+		if strings.TrimSpace(s.Query) == "" {
+			return errors.New("query is required for retrieve steps")
+		}
+		hasDocs, hasIndex := strings.TrimSpace(s.Documents) != "", strings.TrimSpace(s.Index) != ""
+		if hasDocs == hasIndex {
+			return errors.New("retrieve steps need exactly one of documents or index")
+		}
+		if hasIndex && (s.Model != "" || s.Provider != "" || s.ChunkTokens != 0 || s.OverlapTokens != 0) {
+			return errors.New("model, provider, chunk_tokens and overlap_tokens of a retrieve step with index come from the index")
+		}
+		if s.Input != "" {
+			return errors.New("input is only supported on embed steps")
+		}
+		if s.TopK < 0 {
+			return errors.New("top_k must not be negative")
+		}
+	}
+	if s.ChunkTokens < 0 || s.OverlapTokens < 0 {
+		return errors.New("chunk_tokens and overlap_tokens must not be negative")
+	}
+	if s.OverlapTokens > 0 && s.OverlapTokens >= s.ChunkTokens && s.ChunkTokens > 0 {
+		return errors.New("overlap_tokens must be smaller than chunk_tokens")
+	}
+	return nil
+}
+
+func validateShell(s Step) error {
+	if s.Type != TypeShell && s.Type != TypeHTTP && (s.Timeout != "" || s.AllowFailure) {
+		return errors.New("timeout and allow_failure are only supported on shell and http steps")
+	}
+	if s.Timeout != "" {
+		d, err := time.ParseDuration(s.Timeout)
+		if err != nil || d <= 0 {
+			return errors.New(`timeout must be a positive duration such as "30s" or "5m"`)
+		}
+	}
+	if s.Type != TypeShell {
+		if s.Command != "" || len(s.Args) > 0 || s.Stdin != "" {
+			return errors.New("command, args and stdin are only supported on shell steps")
+		}
+		return nil
+	}
+	if s.ParallelGroup != "" {
+		return errors.New("shell steps cannot be used inside a parallel_group")
+	}
+	if (strings.TrimSpace(s.Command) == "") == (len(s.Args) == 0) {
+		return errors.New("shell steps need exactly one of command or args")
+	}
+	if len(s.Args) > 0 && strings.TrimSpace(s.Args[0]) == "" {
+		return errors.New("args[0] must name a program")
+	}
+	return nil
+}
+
+func validateHTTP(s Step) error {
+	if s.Type != TypeHTTP {
+		if s.Method != "" || s.URL != "" || len(s.Headers) > 0 || s.Body != "" || s.JSON != nil || s.BearerTokenEnv != "" || s.Retries != 0 {
+			return errors.New("method, url, headers, body, json, bearer_token_env and retries are only supported on http steps")
+		}
+		return nil
+	}
+	if s.ParallelGroup != "" {
+		return errors.New("http steps cannot be used inside a parallel_group")
+	}
+	switch strings.ToUpper(s.Method) {
+	case "", "GET", "POST", "PUT", "PATCH", "DELETE":
+	default:
+		return errors.New("method must be one of: GET, POST, PUT, PATCH, DELETE")
+	}
+	if strings.TrimSpace(s.URL) == "" {
+		return errors.New("url is required for http steps")
+	}
+	if s.Body != "" && s.JSON != nil {
+		return errors.New("http steps take body or json, not both")
+	}
+	if s.BearerTokenEnv != "" && !strings.HasPrefix(s.BearerTokenEnv, TokenEnvPrefix) {
+		return fmt.Errorf("bearer_token_env must start with %s", TokenEnvPrefix)
+	}
+	if s.Retries < 0 {
+		return errors.New("retries must not be negative")
+	}
+	return nil
+}
+
+func validateReadFile(s Step) error {
+	if s.Type != TypeReadFile {
+		if s.Path != "" || s.MaxFiles != 0 || s.MaxBytes != 0 || s.Concat {
+			return errors.New("path, max_files, max_bytes and concat are only supported on read_file steps")
+		}
+		return nil
+	}
+	if strings.TrimSpace(s.Path) == "" {
+		return errors.New("path is required for read_file steps")
+	}
+	if s.MaxFiles < 0 || s.MaxBytes < 0 {
+		return errors.New("max_files and max_bytes must not be negative")
+	}
+	return nil
+}
+
+func validateTools(s Step) error {
+	if len(s.Tools) == 0 {
+		if s.MaxToolCalls != 0 {
+			return errors.New("max_tool_calls requires tools")
+		}
+		return nil
+	}
+	if s.Type != "gemini" {
+		return errors.New("tools is only supported on gemini steps")
+	}
+	if s.ResponseFormat != "" {
+		return errors.New("tools cannot be combined with response_format")
+	}
+	if s.MaxToolCalls < 0 {
+		return errors.New("max_tool_calls must not be negative")
+	}
+
+	seen := map[string]struct{}{}
+	for j, t := range s.Tools {
+		switch t.Name {
+		case ToolReadFile, ToolLookup, ToolRunRecipe:
+		default:
+			return fmt.Errorf("tools[%d].name must be one of: %s, %s, %s", j, ToolReadFile, ToolLookup, ToolRunRecipe)
+		}
+		if _, ok := seen[t.Name]; ok {
+			return fmt.Errorf("tools[%d]: duplicate tool %s", j, t.Name)
+		}
+		seen[t.Name] = struct{}{}
+		if len(t.AllowDirs) == 0 {
+			return fmt.Errorf("tools[%d].allow_dirs is required", j)
 		}
 	}
 	return nil
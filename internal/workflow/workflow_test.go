@@ -0,0 +1,146 @@
+package workflow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadFromBytes_ParsesGenerationConfig(t *testing.T) {
+	wf, err := LoadFromBytes("test.yaml", []byte(`
+name: gen
+steps:
+  - id: extract
+    type: gemini
+    model: gemini-2.5-flash
+    user_prompt: hi
+    generation:
+      temperature: 0
+      max_output_tokens: 512
+      stop_sequences: ["END"]
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	g := wf.Steps[0].Generation
+	if g == nil || g.Temperature == nil || *g.Temperature != 0 {
+		t.Fatalf("expected temperature 0, got %+v", g)
+	}
+	if g.MaxOutputTokens == nil || *g.MaxOutputTokens != 512 {
+		t.Fatalf("expected max_output_tokens 512, got %+v", g.MaxOutputTokens)
+	}
+	if g.TopP != nil {
+		t.Fatalf("expected top_p to stay unset")
+	}
+}
+
+func TestLoadFromBytes_RejectsInvalidGenerationConfig(t *testing.T) {
+	_, err := LoadFromBytes("test.yaml", []byte(`
+name: gen
+steps:
+  - id: draft
+    type: gemini
+    model: gemini-2.5-flash
+    user_prompt: hi
+    generation:
+      top_p: 1.5
+`))
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(err.Error(), "top_p") {
+		t.Fatalf("expected error to mention top_p, got %v", err)
+	}
+}
+
+func TestLoadFromBytes_ParsesModelFallbackList(t *testing.T) {
+	wf, err := LoadFromBytes("test.yaml", []byte(`
+name: models
+steps:
+  - id: a
+    type: gemini
+    model: [smart, gemini-2.5-flash]
+    user_prompt: hi
+  - id: b
+    type: gemini
+    model: fast
+    user_prompt: hi
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a, b := wf.Steps[0], wf.Steps[1]
+	if a.Model != "smart" || len(a.FallbackModels) != 1 || a.FallbackModels[0] != "gemini-2.5-flash" {
+		t.Fatalf("unexpected model list %q %q", a.Model, a.FallbackModels)
+	}
+	if a.UserPrompt != "hi" {
+		t.Fatalf("expected the other fields to be decoded, got %+v", a)
+	}
+	if b.Model != "fast" || len(b.FallbackModels) != 0 {
+		t.Fatalf("unexpected model %q %q", b.Model, b.FallbackModels)
+	}
+}
+
+func TestLoadFromBytes_RejectsUndeclaredCapabilities(t *testing.T) {
+	_, err := LoadFromBytes("test.yaml", []byte(`
+name: caps
+capabilities:
+  file_write: true
+  models: [gemini-2.5-flash]
+steps:
+  - id: draft
+    type: gemini
+    model: gemini-2.5-flash
+    user_prompt: hi
+  - id: save_it
+    type: save
+    filename: out.md
+    content: "{{ draft }}"
+  - id: copy
+    type: clipboard
+    content: "{{ draft }}"
+`))
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(err.Error(), "clipboard_write") || strings.Contains(err.Error(), "file_write") {
+		t.Fatalf("expected only clipboard_write to be missing, got %v", err)
+	}
+}
+
+func TestRequired_DescribesWhatStepsTouch(t *testing.T) {
+	wf, err := LoadFromBytes("test.yaml", []byte(`
+name: caps
+steps:
+  - id: build
+    type: shell
+    command: make deploy
+  - id: ticket
+    type: http
+    method: POST
+    url: "https://tickets.example.com/api/{{ build.stdout }}"
+    bearer_token_env: PALSGEMFLOWS_TOKEN_TICKETS
+  - id: ask
+    type: gemini
+    model: gemini-2.5-flash
+    user_prompt: hi
+    tools:
+      - name: read_file
+        allow_dirs: [docs]
+      - name: run_recipe
+        allow_dirs: [recipes]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(Required(wf).Describe(), "\n")
+	for _, want := range []string{
+		"run shell commands: `make deploy`",
+		"send HTTP requests to tickets.example.com, sending tokens from PALSGEMFLOWS_TOKEN_TICKETS",
+		"let the model read files in docs, recipes",
+		"let the model run recipes from recipes",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}